@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// maxAudienceUsers bounds the users an audience can list
+const maxAudienceUsers = 10000
+
+// maxTopics bounds the topics a user can follow
+const maxTopics = 100
+
+// Audience narrows a broadcast down to the users matching every criterion
+// which is set, a broadcast without one goes to everyone.
+type Audience struct {
+	Users []string `json:"users,omitempty"`
+	// Topics matches the users who follow any of the topics
+	Topics []string `json:"topics,omitempty"`
+	// Roles matches the role of the user's session, eg. "admin"
+	Roles []string `json:"roles,omitempty"`
+	// Online matches the users connected over the websocket to any instance
+	Online bool `json:"online,omitempty"`
+	// Push matches the users with a push subscription
+	Push bool `json:"push,omitempty"`
+	// Not excludes the users it matches
+	Not *Audience `json:"not,omitempty"`
+}
+
+// AudienceSize is how many users a broadcast would reach.
+type AudienceSize struct {
+	Users int `json:"users"`
+	// Websocket counts the users connected to any instance
+	Websocket int `json:"websocket"`
+	Push      int `json:"push"`
+}
+
+// audienceLookup answers what the criteria of an audience ask about users.
+type audienceLookup struct {
+	storage  *storage
+	online   func(ctx context.Context, users []string) (map[string]bool, error)
+	sessions func(ctx context.Context, users []string) (map[string]SessionCookie, error)
+	// subscribed holds users known to have a push subscription, eg. the
+	// page of subscriptions a broadcast is going through, the others are
+	// looked up
+	subscribed map[string]bool
+}
+
+// withSubscribed returns the lookup knowing that the users have a push
+// subscription.
+func (lookup audienceLookup) withSubscribed(users []string) audienceLookup {
+	lookup.subscribed = stringSet(users)
+	return lookup
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Match reports which of the users are in the audience, the lookups are
+// done for the users which are still candidates only.
+func (lookup audienceLookup) Match(ctx context.Context, audience *Audience, users []string) (map[string]bool, error) {
+	matched := make(map[string]bool, len(users))
+	for _, user := range users {
+		matched[user] = true
+	}
+	if audience == nil {
+		return matched, nil
+	}
+
+	candidates := func() []string {
+		remaining := []string{}
+		for _, user := range users {
+			if matched[user] {
+				remaining = append(remaining, user)
+			}
+		}
+		return remaining
+	}
+	narrow := func(keep func(user string) (bool, error)) error {
+		for _, user := range candidates() {
+			ok, err := keep(user)
+			if err != nil {
+				return err
+			}
+			matched[user] = ok
+		}
+		return nil
+	}
+
+	if len(audience.Users) > 0 {
+		listed := stringSet(audience.Users)
+		narrow(func(user string) (bool, error) {
+			return listed[user], nil
+		})
+	}
+
+	if audience.Online {
+		online, err := lookup.online(ctx, candidates())
+		if err != nil {
+			return nil, err
+		}
+		narrow(func(user string) (bool, error) {
+			return online[user], nil
+		})
+	}
+
+	if audience.Push {
+		err := narrow(func(user string) (bool, error) {
+			if lookup.subscribed[user] {
+				return true, nil
+			}
+			_, err := lookup.storage.GetSubscription(user)
+			if errors.Is(err, errSubscriptionNotFound) || errors.Is(err, errCorruptRecord) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(audience.Topics) > 0 {
+		topics := stringSet(audience.Topics)
+		err := narrow(func(user string) (bool, error) {
+			prefs, err := lookup.storage.GetPreferences(user)
+			if err != nil {
+				return false, err
+			}
+			return slices.ContainsFunc(prefs.Topics, func(topic string) bool {
+				return topics[topic]
+			}), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(audience.Roles) > 0 {
+		// users whose session is gone have no role any more and are left
+		// out of the sessions
+		sessions, err := lookup.sessions(ctx, candidates())
+		if err != nil {
+			return nil, err
+		}
+		roles := stringSet(audience.Roles)
+		narrow(func(user string) (bool, error) {
+			session, ok := sessions[user]
+			return ok && roles[session.Role], nil
+		})
+	}
+
+	if audience.Not != nil {
+		excluded, err := lookup.Match(ctx, audience.Not, candidates())
+		if err != nil {
+			return nil, err
+		}
+		narrow(func(user string) (bool, error) {
+			return !excluded[user], nil
+		})
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func newTestAudienceLookup(t *testing.T) audienceLookup {
+	t.Helper()
+	storage := newTestBoltStorage(t)
+	storage.SetPreferences("alice", UserPreferences{Topics: []string{"events", "news"}})
+	storage.SetPreferences("bob", UserPreferences{Topics: []string{"news"}})
+	storage.AddSubscription("alice", StoredSubscription{Provider: ProviderFCM, DeviceToken: "alice-device"})
+
+	online := map[string]bool{"alice": true, "carol": true}
+	sessions := map[string]SessionCookie{"alice": {Role: "admin"}, "bob": {Role: "user"}, "carol": {Role: "admin"}}
+	return audienceLookup{
+		storage: storage,
+		online: func(ctx context.Context, users []string) (map[string]bool, error) {
+			return online, nil
+		},
+		sessions: func(ctx context.Context, users []string) (map[string]SessionCookie, error) {
+			found := map[string]SessionCookie{}
+			for _, user := range users {
+				if session, ok := sessions[user]; ok {
+					found[user] = session
+				}
+			}
+			return found, nil
+		},
+	}
+}
+
+func matchedUsers(matched map[string]bool) []string {
+	users := []string{}
+	for user, ok := range matched {
+		if ok {
+			users = append(users, user)
+		}
+	}
+	slices.Sort(users)
+	return users
+}
+
+func TestAudienceMatch(t *testing.T) {
+	lookup := newTestAudienceLookup(t)
+	users := []string{"alice", "bob", "carol", "dave"}
+
+	tests := []struct {
+		name     string
+		audience *Audience
+		want     []string
+	}{
+		{"everyone", nil, users},
+		{"users", &Audience{Users: []string{"bob", "dave", "erin"}}, []string{"bob", "dave"}},
+		{"topics", &Audience{Topics: []string{"events"}}, []string{"alice"}},
+		{"any topic", &Audience{Topics: []string{"events", "news"}}, []string{"alice", "bob"}},
+		{"roles", &Audience{Roles: []string{"admin"}}, []string{"alice", "carol"}},
+		{"online", &Audience{Online: true}, []string{"alice", "carol"}},
+		{"push", &Audience{Push: true}, []string{"alice"}},
+		{"every criterion", &Audience{Topics: []string{"news"}, Roles: []string{"admin"}}, []string{"alice"}},
+		{"not", &Audience{Roles: []string{"admin"}, Not: &Audience{Online: true, Topics: []string{"events"}}}, []string{"carol"}},
+	}
+	for _, test := range tests {
+		matched, err := lookup.Match(context.Background(), test.audience, users)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := matchedUsers(matched); !slices.Equal(got, test.want) {
+			t.Errorf("%s: matched %v, want %v", test.name, got, test.want)
+		}
+		if !slices.Equal(slices.Sorted(maps.Keys(matched)), users) {
+			t.Errorf("%s: the result doesn't cover exactly the users", test.name)
+		}
+	}
+}
+
+// the users of a subscriptions page are known to have one, they aren't
+// looked up again
+func TestAudienceMatchSubscribed(t *testing.T) {
+	lookup := newTestAudienceLookup(t).withSubscribed([]string{"bob"})
+	matched, err := lookup.Match(context.Background(), &Audience{Push: true}, []string{"alice", "bob", "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := matchedUsers(matched); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Errorf("matched %v, want alice, from storage, and bob, known", got)
+	}
+}
+
+func TestAudienceSchema(t *testing.T) {
+	for body, valid := range map[string]bool{
+		`{"audience": {"users": ["alice"], "topics": ["news"], "roles": ["admin"], "not": {"online": true}}}`: true,
+		`{"audience": {"users": [""]}}`:          false,
+		`{"audience": {"topics": [""]}}`:         false,
+		`{"audience": {"not": {"roles": [""]}}}`: false,
+	} {
+		var reqMap map[string]any
+		if err := json.Unmarshal([]byte(body), &reqMap); err != nil {
+			t.Fatal(err)
+		}
+		var req struct {
+			Audience *Audience
+		}
+		if got := audienceRequestSchema.Parse(reqMap, &req) == nil; got != valid {
+			t.Errorf("%s: valid = %v, want %v", body, got, valid)
+		}
+	}
+}
@@ -6,29 +6,41 @@ import (
 	"crypto/cipher"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go/v4"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var secretKey []byte
 var API_KEY string
 var firestoreClient *firestore.Client
 
-func init() {
-	opt := option.WithCredentialsFile("./serviceAccountKey.json")
-	app, err := firebase.NewApp(context.Background(), nil, opt)
+var firebaseCredentials = option.WithCredentialsFile("./serviceAccountKey.json")
+var firebaseApp *firebase.App
+
+// setupFirebase connects to firestore, the session tokens are looked up
+// there.
+func setupFirebase() {
+	var err error
+	firebaseApp, err = firebase.NewApp(context.Background(), nil, firebaseCredentials)
 	if err != nil {
 		panic("unable to initialize firebase: " + err.Error())
 	}
 
-	firestoreClient, err = app.Firestore(context.Background())
+	firestoreClient, err = firebaseApp.Firestore(context.Background())
 	if err != nil {
 		panic("unable to initialize firestore: " + err.Error())
 	}
@@ -71,57 +83,118 @@ func decrypt(encryptedText string) ([]byte, error) {
 	return (plainText), nil
 }
 
+var errTokenNotFound = errors.New("token doesnt exist")
+
+// tokenLookupError keeps the token out of the error of a firestore lookup,
+// firestore quotes the path of the document, which ends with the token.
+func tokenLookupError(err error) error {
+	code := status.Code(err)
+	if code == codes.NotFound {
+		return errTokenNotFound
+	}
+	return fmt.Errorf("token lookup failed: %s", code)
+}
+
 type SessionCookie struct {
 	Token string `json:"token"`
 	Role  string `json:"role"`
 }
 
-func getToken(token string) (SessionCookie, error) {
+func getToken(ctx context.Context, token string) (session SessionCookie, err error) {
+	ctx, span := tracer.Start(ctx, "token.lookup")
+	defer func() { endSpan(span, err) }()
+
+	if session, ok := tokenCache.Get(token); ok {
+		span.SetAttributes(attribute.Bool("token.cache_hit", true))
+		return session, nil
+	}
+	span.SetAttributes(attribute.Bool("token.cache_hit", false))
+
+	start := time.Now()
 	snap, err := firestoreClient.
 		Collection("tokens").
 		Doc(token).
-		Get(context.Background())
+		Get(ctx)
+	tokenLookupDuration.ObserveSince(start)
 
 	if err != nil {
-		return SessionCookie{}, err
+		return SessionCookie{}, tokenLookupError(err)
 	}
 
 	if !snap.Exists() {
-		return SessionCookie{}, fmt.Errorf("token doesnt exist")
+		return SessionCookie{}, errTokenNotFound
 	}
 
 	data := snap.Data()
-	return SessionCookie{
+	session = SessionCookie{
 		Token: data["token"].(string),
 		Role:  data["role"].(string),
-	}, nil
+	}
+	tokenCache.Set(token, session)
+	return session, nil
+}
+
+// tokenBatchSize is how many sessions getTokens reads in one request
+const tokenBatchSize = 300
+
+// getTokens looks up the sessions of many tokens with batched reads, the
+// tokens which don't exist are left out of the result.
+func getTokens(ctx context.Context, tokens []string) (sessions map[string]SessionCookie, err error) {
+	ctx, span := tracer.Start(ctx, "token.lookup_batch")
+	defer func() { endSpan(span, err) }()
+
+	sessions = make(map[string]SessionCookie, len(tokens))
+	for batch := range slices.Chunk(tokens, tokenBatchSize) {
+		refs := make([]*firestore.DocumentRef, len(batch))
+		for i, token := range batch {
+			refs[i] = firestoreClient.Collection("tokens").Doc(token)
+		}
+
+		start := time.Now()
+		snaps, err := firestoreClient.GetAll(ctx, refs)
+		tokenLookupDuration.ObserveSince(start)
+		if err != nil {
+			return nil, tokenLookupError(err)
+		}
+
+		for i, snap := range snaps {
+			if !snap.Exists() {
+				continue
+			}
+			data := snap.Data()
+			token, _ := data["token"].(string)
+			role, _ := data["role"].(string)
+			sessions[batch[i]] = SessionCookie{Token: token, Role: role}
+		}
+	}
+	return sessions, nil
 }
 
 // checkAuth accepts the cookieValue and tries to authenticate the request.
 // if successfull, it returns true and the token value.
-func checkAuth(cookieValue []byte) (bool, SessionCookie) {
+func checkAuth(ctx context.Context, cookieValue []byte) (bool, SessionCookie) {
 	var emptyCookie SessionCookie
 	decryptedCookie, err := decrypt(string(cookieValue))
 	if err != nil {
-		fmt.Println("unable to decrypt cookie: ", err)
+		slog.Debug("unable to decrypt session cookie", "error", err)
 		return false, emptyCookie
 	}
 
 	var sessionCookie SessionCookie
 	err = json.Unmarshal([]byte(decryptedCookie), &sessionCookie)
 	if err != nil {
-		fmt.Println("unable to decode cookie into struct", err)
+		slog.Debug("unable to decode session cookie", "error", err)
 		return false, emptyCookie
 	}
 
 	if sessionCookie.Token == "" {
-		fmt.Println("session cookie token empty")
+		slog.Debug("session cookie token is empty")
 		return false, emptyCookie
 	}
 
-	dbToken, err := getToken(sessionCookie.Token)
+	dbToken, err := getToken(ctx, sessionCookie.Token)
 	if err != nil {
-		fmt.Println("error getting token from db", err)
+		slog.Warn("unable to get session token", "token", sessionCookie.Token, "error", err)
 		return false, emptyCookie
 	}
 	if dbToken.Token != sessionCookie.Token {
@@ -139,7 +212,7 @@ func authorizeUserRequest(r *http.Request, w http.ResponseWriter) (string, error
 		return "", err
 	}
 
-	success, token := checkAuth([]byte(sessionCookie.Value))
+	success, token := checkAuth(r.Context(), []byte(sessionCookie.Value))
 	if !success {
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("unauthenticated"))
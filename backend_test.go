@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// testBackends opens an empty backend of every kind. Postgres is only tested
+// when TEST_DATABASE_URL points at a database whose kv tables may be wiped.
+var testBackends = map[string]func(t *testing.T) Backend{
+	"bolt": func(t *testing.T) Backend {
+		backend, err := openBoltBackend(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	},
+	"sqlite": func(t *testing.T) Backend {
+		backend, err := openSQLiteBackend(filepath.Join(t.TempDir(), "test.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	},
+	"postgres": func(t *testing.T) Backend {
+		url := os.Getenv("TEST_DATABASE_URL")
+		if url == "" {
+			t.Skip("TEST_DATABASE_URL not set")
+		}
+		db, err := sql.Open("pgx", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`DROP TABLE IF EXISTS kv, kv_buckets`)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backend, err := openPostgresBackend(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	},
+}
+
+// forEachBackend runs the test against every backend.
+func forEachBackend(t *testing.T, test func(t *testing.T, backend Backend)) {
+	for name, open := range testBackends {
+		t.Run(name, func(t *testing.T) {
+			backend := open(t)
+			t.Cleanup(func() { backend.Close() })
+			test(t, backend)
+		})
+	}
+}
+
+func mustUpdate(t *testing.T, backend Backend, fn func(Tx) error) {
+	t.Helper()
+	if err := backend.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collect returns the keys of the bucket in the order ForEach visits them.
+func collect(t *testing.T, backend Backend, bucket string) []string {
+	t.Helper()
+	keys := []string{}
+	err := backend.View(func(tx Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func TestBackendOrdering(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		mustUpdate(t, backend, func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			// byte order, not insertion or string order of the values
+			for _, k := range []string{"m", "b", "\x00z", "a", "ab", "\xff"} {
+				if err := b.Put([]byte(k), []byte("v"+k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		want := []string{"\x00z", "a", "ab", "b", "m", "\xff"}
+		if got := collect(t, backend, "b"); !equalKeys(got, want) {
+			t.Fatalf("ForEach order = %q, want %q", got, want)
+		}
+
+		err := backend.View(func(tx Tx) error {
+			b := tx.Bucket([]byte("b"))
+			if n := b.Len(); n != len(want) {
+				t.Errorf("Len = %d, want %d", n, len(want))
+			}
+			if v := b.Get([]byte("ab")); string(v) != "vab" {
+				t.Errorf("Get(ab) = %q", v)
+			}
+			if v := b.Get([]byte("missing")); v != nil {
+				t.Errorf("Get(missing) = %q, want nil", v)
+			}
+			if tx.Bucket([]byte("missing")) != nil {
+				t.Error("missing bucket is not nil")
+			}
+
+			c := b.Cursor()
+			got := []string{}
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				got = append(got, string(k))
+			}
+			if !equalKeys(got, want) {
+				t.Errorf("cursor forward = %q, want %q", got, want)
+			}
+			got = []string{}
+			for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+				got = append([]string{string(k)}, got...)
+			}
+			if !equalKeys(got, want) {
+				t.Errorf("cursor backward = %q, want %q", got, want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBackendCursorSeek(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		mustUpdate(t, backend, func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			for _, k := range []string{"b", "d", "f"} {
+				if err := b.Put([]byte(k), []byte(k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		err := backend.View(func(tx Tx) error {
+			c := tx.Bucket([]byte("b")).Cursor()
+			for _, tc := range []struct{ seek, want string }{
+				{"a", "b"},
+				{"d", "d"},
+				{"e", "f"},
+			} {
+				k, v := c.Seek([]byte(tc.seek))
+				if string(k) != tc.want || string(v) != tc.want {
+					t.Errorf("Seek(%s) = %q, %q, want %q", tc.seek, k, v, tc.want)
+				}
+			}
+			if k, _ := c.Seek([]byte("g")); k != nil {
+				t.Errorf("Seek past the end = %q, want nil", k)
+			}
+
+			c.Seek([]byte("c"))
+			if k, _ := c.Next(); string(k) != "f" {
+				t.Errorf("Next after Seek(c) = %q, want f", k)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBackendCursorDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		mustUpdate(t, backend, func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			for i := range 5 {
+				if err := b.Put([]byte{byte(i)}, []byte("v")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		// the outbox pops its entries this way
+		mustUpdate(t, backend, func(tx Tx) error {
+			c := tx.Bucket([]byte("b")).Cursor()
+			for k, _ := c.First(); k != nil && k[0] < 3; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		if got := collect(t, backend, "b"); !equalKeys(got, []string{"\x03", "\x04"}) {
+			t.Fatalf("keys left = %q", got)
+		}
+	})
+}
+
+func TestBackendNestedBuckets(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		mustUpdate(t, backend, func(tx Tx) error {
+			parent, err := tx.CreateBucketIfNotExists([]byte("parent"))
+			if err != nil {
+				return err
+			}
+			if err := parent.Put([]byte("key"), []byte("parent")); err != nil {
+				return err
+			}
+			for _, name := range []string{"a", "ab"} {
+				child, err := parent.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+				if err := child.Put([]byte("key"), []byte(name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		mustUpdate(t, backend, func(tx Tx) error {
+			parent := tx.Bucket([]byte("parent"))
+			if v := parent.Bucket([]byte("a")).Get([]byte("key")); string(v) != "a" {
+				t.Errorf("nested Get = %q, want a", v)
+			}
+			if parent.Bucket([]byte("missing")) != nil {
+				t.Error("missing nested bucket is not nil")
+			}
+			if err := parent.DeleteBucket([]byte("missing")); !errors.Is(err, errBucketNotFound) {
+				t.Errorf("DeleteBucket(missing) = %v, want errBucketNotFound", err)
+			}
+			return parent.DeleteBucket([]byte("a"))
+		})
+
+		err := backend.View(func(tx Tx) error {
+			parent := tx.Bucket([]byte("parent"))
+			if parent.Bucket([]byte("a")) != nil {
+				t.Error("deleted bucket still exists")
+			}
+			// a bucket sharing the deleted one's prefix is left alone
+			if v := parent.Bucket([]byte("ab")).Get([]byte("key")); string(v) != "ab" {
+				t.Errorf("sibling bucket Get = %q, want ab", v)
+			}
+			if v := parent.Get([]byte("key")); string(v) != "parent" {
+				t.Errorf("parent Get = %q, want parent", v)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBackendSequence(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		var seqs []uint64
+		for range 3 {
+			mustUpdate(t, backend, func(tx Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("b"))
+				if err != nil {
+					return err
+				}
+				seq, err := b.NextSequence()
+				seqs = append(seqs, seq)
+				return err
+			})
+		}
+		if fmt.Sprint(seqs) != "[1 2 3]" {
+			t.Fatalf("sequences = %v, want [1 2 3]", seqs)
+		}
+	})
+}
+
+func TestBackendRollback(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		mustUpdate(t, backend, func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("kept"), []byte("v"))
+		})
+
+		errFailed := errors.New("failed")
+		err := backend.Update(func(tx Tx) error {
+			b := tx.Bucket([]byte("b"))
+			if err := b.Put([]byte("rolled back"), []byte("v")); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte("kept")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists([]byte("rolled back")); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("Update = %v, want the error of fn", err)
+		}
+
+		if got := collect(t, backend, "b"); !equalKeys(got, []string{"kept"}) {
+			t.Errorf("keys after rollback = %q, want [kept]", got)
+		}
+		backend.View(func(tx Tx) error {
+			if tx.Bucket([]byte("rolled back")) != nil {
+				t.Error("bucket created by the rolled back transaction exists")
+			}
+			return nil
+		})
+	})
+}
+
+// TestBackendConcurrentUpdates increments a counter from several goroutines,
+// postgres aborts the conflicting transactions and Update runs them again.
+func TestBackendConcurrentUpdates(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		mustUpdate(t, backend, func(tx Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("b"))
+			return err
+		})
+
+		const workers, increments = 4, 10
+		var wg sync.WaitGroup
+		errs := make(chan error, workers*increments)
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range increments {
+					errs <- backend.Update(func(tx Tx) error {
+						b := tx.Bucket([]byte("b"))
+						n := 0
+						if v := b.Get([]byte("counter")); v != nil {
+							fmt.Sscan(string(v), &n)
+						}
+						return b.Put([]byte("counter"), []byte(fmt.Sprint(n+1)))
+					})
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		backend.View(func(tx Tx) error {
+			if v := tx.Bucket([]byte("b")).Get([]byte("counter")); string(v) != fmt.Sprint(workers*increments) {
+				t.Errorf("counter = %s, want %d", v, workers*increments)
+			}
+			return nil
+		})
+	})
+}
+
+// TestSQLBackendRetry fails the first attempt of a transaction the way
+// postgres does on a serialization failure, the sqlite backend stands in
+// for it.
+func TestSQLBackendRetry(t *testing.T) {
+	backend, err := openSQLiteBackend(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	backend.retryable = postgresRetryable
+
+	attempts := 0
+	err = backend.Update(func(tx Tx) error {
+		attempts++
+		b, err := tx.CreateBucketIfNotExists([]byte("b"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(fmt.Sprint("attempt", attempts)), []byte("v")); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return &pgconn.PgError{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", attempts)
+	}
+	if got := collect(t, backend, "b"); !equalKeys(got, []string{"attempt2"}) {
+		t.Errorf("keys = %q, the first attempt must be rolled back", got)
+	}
+
+	attempts = 0
+	err = backend.Update(func(tx Tx) error {
+		attempts++
+		return &pgconn.PgError{Code: "40001"}
+	})
+	if !postgresRetryable(err) || attempts != sqlTxRetries {
+		t.Errorf("Update = %v after %d attempts, want the error after %d", err, attempts, sqlTxRetries)
+	}
+
+	attempts = 0
+	backend.Update(func(tx Tx) error {
+		attempts++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	if attempts != 1 {
+		t.Errorf("a unique violation was attempted %d times, want 1", attempts)
+	}
+}
+
+// replayBackend runs every write transaction twice, the first time is
+// rolled back as if postgres had aborted it. The storage methods must give
+// the same results as with a single run.
+type replayBackend struct {
+	Backend
+}
+
+var errReplay = errors.New("replay")
+
+func (b replayBackend) Update(fn func(Tx) error) error {
+	if err := b.Backend.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return errReplay
+	}); err != errReplay {
+		return err
+	}
+	return b.Backend.Update(fn)
+}
+
+func newTestStorage(t *testing.T, backend Backend) *storage {
+	t.Helper()
+	s, err := newStorage(backend, "subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStorageUpdatesAreRetriable(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		s := newTestStorage(t, replayBackend{backend})
+
+		outbox := NewOutbox(s, outboxBucket, func(NotificationRequest, func()) bool { return true })
+		now := time.Now()
+		for _, id := range []string{"1", "2"} {
+			if err := outbox.Defer(NotificationRequest{ID: id}, now.Add(-time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		due, err := outbox.claimDue(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) != 2 {
+			t.Errorf("claimDue returned %d entries, want 2", len(due))
+		}
+
+		sub := StoredSubscription{DeviceToken: "token", Provider: ProviderFCM}
+		if err := s.AddSubscription("user", sub); err != nil {
+			t.Fatal(err)
+		}
+		if removed, err := s.RemoveSubscription("user", sub); err != nil || !removed {
+			t.Errorf("RemoveSubscription = %v, %v, want true", removed, err)
+		}
+		if removed, _ := s.RemoveSubscription("user", sub); removed {
+			t.Error("RemoveSubscription of a missing subscription = true")
+		}
+
+		if err := s.AddUnread("n1", "user"); err != nil {
+			t.Fatal(err)
+		}
+		if found, _ := s.MarkRead("n1", "user"); !found {
+			t.Error("MarkRead = false, want true")
+		}
+		if found, _ := s.TakeUnread("n1"); found {
+			t.Error("TakeUnread of a read notification = true")
+		}
+
+		results, err := s.Migrate(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(migrations) {
+			t.Errorf("dry run reported %d migrations, want %d", len(results), len(migrations))
+		}
+	})
+}
+
+func TestBackendValuesAreCopies(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		value := []byte("value")
+		mustUpdate(t, backend, func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("b"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("k"), value)
+		})
+		copy(value, "xxxxx")
+
+		backend.View(func(tx Tx) error {
+			if v := tx.Bucket([]byte("b")).Get([]byte("k")); !bytes.Equal(v, []byte("value")) {
+				t.Errorf("Get = %q, want the value as it was put", v)
+			}
+			return nil
+		})
+	})
+}
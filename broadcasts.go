@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var broadcastsBucket = []byte("broadcasts")
+
+var errBroadcastNotFound = errors.New("broadcast not found")
+var errBroadcastFinished = errors.New("broadcast has already finished")
+
+// broadcast statuses
+const (
+	BroadcastRunning   = "running"
+	BroadcastCompleted = "completed"
+	BroadcastCancelled = "cancelled"
+	BroadcastFailed    = "failed"
+)
+
+// broadcastLease is how long a broadcast stays claimed by the instance
+// running it without a checkpoint, after that another instance resumes it
+const broadcastLease = 2 * time.Minute
+
+// broadcastCheckpointInterval is how often a running broadcast persists
+// its counts and renews its lease, it also picks up cancellations made on
+// other instances
+const broadcastCheckpointInterval = 30 * time.Second
+
+// broadcastPollInterval is how often instances look for broadcasts whose
+// instance has gone away
+const broadcastPollInterval = time.Minute
+
+// broadcastRetention is how long finished broadcasts are kept, they can be
+// looked up until then
+const broadcastRetention = 7 * 24 * time.Hour
+
+// BroadcastCounts are the deliveries of a broadcast over one channel.
+type BroadcastCounts struct {
+	Targeted int `json:"targeted"`
+	Sent     int `json:"sent"`
+	Failed   int `json:"failed"`
+	// Deferred push notifications are held back by quiet hours and sent by
+	// the outbox later on
+	Deferred int `json:"deferred,omitempty"`
+}
+
+// BroadcastJob is a persisted broadcast. Push notifications are sent in
+// batches of subscriptions, Cursor is the last user whose delivery was
+// handed to the dispatcher so a resumed broadcast carries on after it.
+// Websocket clients are only sent the broadcast when it starts.
+type BroadcastJob struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Request    BroadcastRequest `json:"request"`
+	RequestID  string           `json:"requestId,omitempty"`
+	Cursor     string           `json:"-"`
+	Websocket  BroadcastCounts  `json:"websocket"`
+	Push       BroadcastCounts  `json:"push"`
+	Error      string           `json:"error,omitempty"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	UpdatedAt  time.Time        `json:"updatedAt"`
+	FinishedAt *time.Time       `json:"finishedAt,omitempty"`
+
+	// the instance running the broadcast and until when it holds it
+	Owner      string    `json:"owner,omitempty"`
+	LeaseUntil time.Time `json:"leaseUntil"`
+}
+
+// broadcastJobRecord is how a job is stored, the cursor is a user token so
+// it is left out of the API responses.
+type broadcastJobRecord struct {
+	BroadcastJob
+	Cursor string `json:"cursor,omitempty"`
+}
+
+func (job BroadcastJob) finished() bool {
+	return job.Status != BroadcastRunning
+}
+
+// broadcastRun is a broadcast running on this instance.
+type broadcastRun struct {
+	mu  sync.Mutex
+	job BroadcastJob
+
+	// ctx is cancelled when the broadcast is, the deliveries which haven't
+	// started by then are skipped
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (run *broadcastRun) snapshot() BroadcastJob {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	return run.job
+}
+
+func (run *broadcastRun) count(f func(job *BroadcastJob)) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	f(&run.job)
+}
+
+// BroadcastRunner runs the broadcasts, persisting their progress so that
+// they can be followed, cancelled and resumed after a restart.
+type BroadcastRunner struct {
+	// ctx is done when the server shuts down, the broadcasts stop at their
+	// next batch and are left to be resumed
+	ctx         context.Context
+	storage     *storage
+	outbox      *Outbox
+	dispatcher  *Dispatcher
+	cluster     *Cluster
+	connManager *WebsocketConnectionsManager
+	instanceID  string
+
+	mu   sync.Mutex
+	runs map[string]*broadcastRun
+	wg   sync.WaitGroup
+}
+
+func NewBroadcastRunner(ctx context.Context, storage *storage, outbox *Outbox, dispatcher *Dispatcher, cluster *Cluster, connManager *WebsocketConnectionsManager, instanceID string) *BroadcastRunner {
+	return &BroadcastRunner{
+		ctx:         ctx,
+		storage:     storage,
+		outbox:      outbox,
+		dispatcher:  dispatcher,
+		cluster:     cluster,
+		connManager: connManager,
+		instanceID:  instanceID,
+		runs:        make(map[string]*broadcastRun),
+	}
+}
+
+// Start persists the broadcast and starts sending it, ctx carries the
+// request ID and the trace the deliveries belong to.
+func (r *BroadcastRunner) Start(ctx context.Context, req BroadcastRequest) (BroadcastJob, error) {
+	now := time.Now().UTC()
+	job := BroadcastJob{
+		ID:         newID(),
+		Status:     BroadcastRunning,
+		Request:    req,
+		RequestID:  middleware.GetRequestID(ctx),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Owner:      r.instanceID,
+		LeaseUntil: now.Add(broadcastLease),
+	}
+	if err := r.storage.PutBroadcast(job); err != nil {
+		return job, err
+	}
+
+	r.start(ctx, job, true)
+	return job, nil
+}
+
+func (r *BroadcastRunner) start(ctx context.Context, job BroadcastJob, websocket bool) {
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	run := &broadcastRun{job: job, ctx: runCtx, cancel: cancel}
+
+	r.mu.Lock()
+	r.runs[job.ID] = run
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		r.execute(run, websocket)
+
+		r.mu.Lock()
+		delete(r.runs, job.ID)
+		r.mu.Unlock()
+	}()
+}
+
+func (r *BroadcastRunner) execute(run *broadcastRun, websocket bool) {
+	job := run.snapshot()
+	notif := job.Request.Notification()
+	notif.RequestID = job.RequestID
+	priority := notif.Priority
+
+	// the span covers the fan-out, the deliveries are its children. They
+	// aren't cut short by a cancellation, only the ones not started yet
+	// are skipped
+	deliveryCtx, span := tracer.Start(context.WithoutCancel(run.ctx), "broadcast.fanout", trace.WithAttributes(
+		attribute.String("broadcast.id", job.ID),
+		attribute.String("notification.priority", priority),
+	))
+	defer span.End()
+
+	// checkpoints renew the lease while the batches are being sent
+	checkpointsDone := make(chan struct{})
+	defer close(checkpointsDone)
+	go func() {
+		ticker := time.NewTicker(broadcastCheckpointInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-checkpointsDone:
+				return
+			case <-ticker.C:
+				r.checkpoint(run, false)
+			}
+		}
+	}()
+
+	audience := job.Request.Audience
+	fail := func(message string, err error) {
+		slog.ErrorContext(deliveryCtx, message, "broadcast", job.ID, "error", err)
+		run.count(func(job *BroadcastJob) {
+			job.Status = BroadcastFailed
+			job.Error = message + ": " + err.Error()
+		})
+	}
+
+	var websocketSends sync.WaitGroup
+	if websocket {
+		wsMessage := notif.TransmissionJSON()
+
+		conns := r.connManager.Connections()
+		matched, err := r.cluster.audience().Match(deliveryCtx, audience, slices.Collect(maps.Keys(conns)))
+		if err != nil {
+			fail("unable to match the audience", err)
+			conns = nil
+		}
+
+		for user, wsConn := range conns {
+			if !matched[user] {
+				continue
+			}
+			run.count(func(job *BroadcastJob) { job.Websocket.Targeted++ })
+			websocketSends.Add(1)
+			accepted := r.dispatcher.SubmitWait(r.ctx, priority, func() {
+				defer websocketSends.Done()
+				if run.ctx.Err() != nil {
+					return
+				}
+
+				err := writeWebsocketMessage(deliveryCtx, wsConn, wsMessage)
+				recordWebsocketWrite(deliveryCtx, "", "", err)
+				run.count(func(job *BroadcastJob) {
+					if err != nil {
+						job.Websocket.Failed++
+					} else {
+						job.Websocket.Sent++
+					}
+				})
+			})
+			if !accepted {
+				websocketSends.Done()
+			}
+		}
+		// the other instances send it to their own clients
+		r.cluster.BroadcastRemote(deliveryCtx, priority, audience, wsMessage)
+	}
+
+	pushEvent := notif.PushEvent()
+	after := job.Cursor
+	for {
+		if run.ctx.Err() != nil || run.snapshot().Status == BroadcastFailed {
+			break
+		}
+		if r.ctx.Err() != nil {
+			r.release(run, &websocketSends)
+			return
+		}
+
+		page, next, err := r.storage.GetSubscriptionsPage(after, subscriptionBatchSize)
+		if err != nil {
+			fail("unable to read subscriptions", err)
+			break
+		}
+
+		users := make([]string, len(page))
+		for i, us := range page {
+			users[i] = us.User
+		}
+		matched, err := r.cluster.audience().withSubscribed(users).Match(deliveryCtx, audience, users)
+		if err != nil {
+			fail("unable to match the audience", err)
+			break
+		}
+
+		var batch sync.WaitGroup
+		rejected := false
+		// the last user of the batch whose delivery was accepted, the
+		// deliveries are submitted in the order of the users
+		lastAccepted := ""
+		for _, us := range page {
+			if !matched[us.User] {
+				continue
+			}
+			userNotif := notif
+			userNotif.User = us.User
+			sub := us.Subscription
+
+			run.count(func(job *BroadcastJob) { job.Push.Targeted++ })
+			batch.Add(1)
+			accepted := r.dispatcher.SubmitWait(r.ctx, priority, func() {
+				defer batch.Done()
+				if run.ctx.Err() != nil {
+					return
+				}
+
+				if holdForQuietHours(deliveryCtx, r.storage, r.outbox, userNotif) {
+					run.count(func(job *BroadcastJob) { job.Push.Deferred++ })
+					return
+				}
+				result := sendPushNotification(deliveryCtx, pushEvent, sub, priority)
+				result.User = us.User
+				recordPushResult(deliveryCtx, r.storage, "", sub, result)
+				run.count(func(job *BroadcastJob) {
+					if result.Delivered {
+						job.Push.Sent++
+					} else {
+						job.Push.Failed++
+					}
+				})
+			})
+			if !accepted {
+				batch.Done()
+				rejected = true
+				run.count(func(job *BroadcastJob) { job.Push.Targeted-- })
+				break
+			}
+			lastAccepted = us.User
+		}
+		batch.Wait()
+
+		// the server is shutting down, the resumed broadcast carries on
+		// with the first user whose delivery wasn't accepted
+		if rejected {
+			if lastAccepted != "" {
+				run.count(func(job *BroadcastJob) { job.Cursor = lastAccepted })
+			}
+			r.release(run, &websocketSends)
+			return
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+		run.count(func(job *BroadcastJob) { job.Cursor = next })
+		r.checkpoint(run, false)
+	}
+
+	websocketSends.Wait()
+	r.checkpoint(run, true)
+}
+
+// DryRun counts the users the broadcast would reach with the audience,
+// without sending anything.
+func (r *BroadcastRunner) DryRun(ctx context.Context, audience *Audience) (AudienceSize, error) {
+	var size AudienceSize
+	lookup := r.cluster.audience()
+	reached := map[string]bool{}
+
+	online, err := r.cluster.OnlineUsers(ctx)
+	if err != nil {
+		return size, err
+	}
+	matched, err := lookup.Match(ctx, audience, online)
+	if err != nil {
+		return size, err
+	}
+	for _, user := range online {
+		if matched[user] {
+			size.Websocket++
+			reached[user] = true
+		}
+	}
+
+	after := ""
+	for {
+		page, next, err := r.storage.GetSubscriptionsPage(after, subscriptionBatchSize)
+		if err != nil {
+			return size, err
+		}
+
+		users := make([]string, len(page))
+		for i, us := range page {
+			users[i] = us.User
+		}
+		matched, err := lookup.withSubscribed(users).Match(ctx, audience, users)
+		if err != nil {
+			return size, err
+		}
+		for _, user := range users {
+			if matched[user] {
+				size.Push++
+				reached[user] = true
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	size.Users = len(reached)
+	return size, nil
+}
+
+// release saves the progress of a broadcast stopped by the shutdown and
+// gives up its lease, so that it is resumed as soon as an instance starts.
+func (r *BroadcastRunner) release(run *broadcastRun, websocketSends *sync.WaitGroup) {
+	websocketSends.Wait()
+	run.count(func(job *BroadcastJob) { job.LeaseUntil = time.Time{} })
+	r.checkpoint(run, false)
+}
+
+// checkpoint persists the progress of the broadcast and renews its lease.
+// A broadcast cancelled on another instance, or taken over by one, is
+// stopped.
+func (r *BroadcastRunner) checkpoint(run *broadcastRun, done bool) {
+	err := r.storage.updateBroadcast(run.snapshot().ID, func(stored *BroadcastJob) error {
+		run.mu.Lock()
+		defer run.mu.Unlock()
+
+		if stored.finished() || stored.Owner != r.instanceID {
+			run.cancel()
+			if stored.Owner == r.instanceID {
+				// keep the status, the counts are still ours
+				run.job.Status = stored.Status
+				run.job.FinishedAt = stored.FinishedAt
+				run.job.Error = stored.Error
+				*stored = run.job
+			}
+			return nil
+		}
+
+		now := time.Now().UTC()
+		run.job.UpdatedAt = now
+		if !run.job.LeaseUntil.IsZero() {
+			run.job.LeaseUntil = now.Add(broadcastLease)
+		}
+		if done {
+			if run.job.Status == BroadcastRunning {
+				run.job.Status = BroadcastCompleted
+			}
+			run.job.FinishedAt = &now
+		}
+		*stored = run.job
+		return nil
+	})
+	if err != nil {
+		slog.Error("unable to save broadcast progress", "broadcast", run.snapshot().ID, "error", err)
+	}
+}
+
+// Get returns the broadcast, with the live counts if it is running here.
+func (r *BroadcastRunner) Get(id string) (BroadcastJob, error) {
+	r.mu.Lock()
+	run, ok := r.runs[id]
+	r.mu.Unlock()
+	if ok {
+		return run.snapshot(), nil
+	}
+
+	return r.storage.GetBroadcast(id)
+}
+
+// Cancel stops the broadcast, the deliveries which have already started
+// are let through. An instance running the broadcast elsewhere notices at
+// its next checkpoint.
+func (r *BroadcastRunner) Cancel(id string) (BroadcastJob, error) {
+	var cancelled BroadcastJob
+	err := r.storage.updateBroadcast(id, func(stored *BroadcastJob) error {
+		if stored.finished() {
+			return errBroadcastFinished
+		}
+		now := time.Now().UTC()
+		stored.Status = BroadcastCancelled
+		stored.UpdatedAt = now
+		stored.FinishedAt = &now
+		cancelled = *stored
+		return nil
+	})
+	if err != nil {
+		return cancelled, err
+	}
+
+	r.mu.Lock()
+	run, ok := r.runs[id]
+	r.mu.Unlock()
+	if ok {
+		run.count(func(job *BroadcastJob) {
+			job.Status = cancelled.Status
+			job.FinishedAt = cancelled.FinishedAt
+		})
+		run.cancel()
+		return run.snapshot(), nil
+	}
+	return cancelled, nil
+}
+
+// Run resumes the broadcasts which are still running but aren't held by
+// any instance, on startup and then every broadcastPollInterval until the
+// server shuts down.
+func (r *BroadcastRunner) Run() {
+	ticker := time.NewTicker(broadcastPollInterval)
+	defer ticker.Stop()
+
+	r.resume()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.resume()
+		}
+	}
+}
+
+func (r *BroadcastRunner) resume() {
+	pruned, err := r.storage.PruneBroadcasts(time.Now().Add(-broadcastRetention))
+	if err != nil {
+		slog.Error("unable to prune finished broadcasts", "error", err)
+	} else if pruned > 0 {
+		slog.Info("pruned finished broadcasts", "count", pruned)
+	}
+
+	jobs, err := r.storage.GetAllBroadcasts()
+	if err != nil {
+		slog.Error("unable to read broadcasts", "error", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if job.finished() || time.Now().Before(job.LeaseUntil) {
+			continue
+		}
+
+		claimed, err := r.claim(job.ID)
+		if err != nil {
+			slog.Error("unable to claim broadcast", "broadcast", job.ID, "error", err)
+			continue
+		}
+		if claimed == nil {
+			continue
+		}
+
+		slog.Info("resuming broadcast", "broadcast", claimed.ID, "targeted", claimed.Push.Targeted)
+		r.start(middleware.WithRequestID(context.Background(), claimed.RequestID), *claimed, false)
+	}
+}
+
+// claim takes the broadcast over if it is still running and its lease has
+// expired, it returns nil if another instance got to it first.
+func (r *BroadcastRunner) claim(id string) (*BroadcastJob, error) {
+	var claimed *BroadcastJob
+	err := r.storage.updateBroadcast(id, func(stored *BroadcastJob) error {
+		claimed = nil
+		now := time.Now().UTC()
+		if stored.finished() || now.Before(stored.LeaseUntil) {
+			return nil
+		}
+		stored.Owner = r.instanceID
+		stored.LeaseUntil = now.Add(broadcastLease)
+		stored.UpdatedAt = now
+		job := *stored
+		claimed = &job
+		return nil
+	})
+
+	return claimed, err
+}
+
+// Wait waits for the broadcasts running here to stop, giving up once ctx is
+// done.
+func (r *BroadcastRunner) Wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (s *storage) PutBroadcast(job BroadcastJob) error {
+	return s.update(func(tx Tx) error {
+		return tx.Bucket(broadcastsBucket).Put([]byte(job.ID), jsonify(broadcastJobRecord{job, job.Cursor}))
+	})
+}
+
+func decodeBroadcast(v []byte) (BroadcastJob, error) {
+	var record broadcastJobRecord
+	if err := json.Unmarshal(v, &record); err != nil {
+		return BroadcastJob{}, err
+	}
+	record.BroadcastJob.Cursor = record.Cursor
+	return record.BroadcastJob, nil
+}
+
+func (s *storage) GetBroadcast(id string) (BroadcastJob, error) {
+	var job BroadcastJob
+	err := s.view(func(tx Tx) error {
+		v := tx.Bucket(broadcastsBucket).Get([]byte(id))
+		if v == nil {
+			return errBroadcastNotFound
+		}
+
+		var err error
+		job, err = decodeBroadcast(v)
+		return err
+	})
+
+	return job, err
+}
+
+func (s *storage) GetAllBroadcasts() ([]BroadcastJob, error) {
+	jobs := []BroadcastJob{}
+	err := s.view(func(tx Tx) error {
+		return tx.Bucket(broadcastsBucket).ForEach(func(k, v []byte) error {
+			job, err := decodeBroadcast(v)
+			if err != nil {
+				slog.Error("unable to unmarshal broadcast", "broadcast", string(k), "error", err)
+				return nil
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+
+	return jobs, err
+}
+
+// PruneBroadcasts deletes the broadcasts which finished before cutoff and
+// returns how many there were.
+func (s *storage) PruneBroadcasts(cutoff time.Time) (int, error) {
+	pruned := 0
+	err := s.update(func(tx Tx) error {
+		b := tx.Bucket(broadcastsBucket)
+		expired := [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			job, err := decodeBroadcast(v)
+			if err == nil && job.finished() && job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+				expired = append(expired, slices.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		pruned = len(expired)
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return pruned, err
+}
+
+// updateBroadcast reads the broadcast, lets fn change it and stores it in a
+// single transaction. Nothing is stored if fn returns an error.
+func (s *storage) updateBroadcast(id string, fn func(*BroadcastJob) error) error {
+	return s.update(func(tx Tx) error {
+		b := tx.Bucket(broadcastsBucket)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errBroadcastNotFound
+		}
+
+		job, err := decodeBroadcast(v)
+		if err != nil {
+			return err
+		}
+		if err := fn(&job); err != nil {
+			return err
+		}
+		return b.Put([]byte(id), jsonify(broadcastJobRecord{job, job.Cursor}))
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func newTestBroadcastRunner(t *testing.T, ctx context.Context, storage *storage, dispatcher *Dispatcher) *BroadcastRunner {
+	t.Helper()
+	connManager := NewWebsocketConnectionsManager()
+	cluster, err := NewCluster(ctx, config.BusConfig{Backend: config.BusLocal, InstanceID: "test"}, connManager, dispatcher, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Close() })
+	outbox := NewOutbox(storage, outboxBucket, func(NotificationRequest, func()) bool { return false })
+	return NewBroadcastRunner(ctx, storage, outbox, dispatcher, cluster, connManager, "test")
+}
+
+// TestBroadcastResumeAfterShutdown stops a broadcast in the middle of a
+// batch, the resumed broadcast must reach the users the first run didn't
+// and only them.
+func TestBroadcastResumeAfterShutdown(t *testing.T) {
+	var mu sync.Mutex
+	pushes := map[string]int{}
+	arrived := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-unblock
+		mu.Lock()
+		pushes[strings.TrimPrefix(r.URL.Path, "/")]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	storage := newTestBoltStorage(t)
+	users := []string{"user-0", "user-1", "user-2", "user-3", "user-4"}
+	for _, user := range users {
+		if err := storage.AddSubscription(user, testWebPushSubscription(t, server.URL+"/"+user)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one worker busy with the first user and a queue of one leaves the
+	// third user waiting for room when the server shuts down
+	ctx, shutdown := context.WithCancel(context.Background())
+	dispatcher := NewDispatcher(1, 1)
+	runner := newTestBroadcastRunner(t, ctx, storage, dispatcher)
+	job, err := runner.Start(context.Background(), BroadcastRequest{Title: "hello", Description: "everyone", Link: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-arrived
+	for dispatcher.Len() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	shutdown()
+	close(unblock)
+	runner.Wait(context.Background())
+	dispatcher.Close()
+
+	stopped, err := storage.GetBroadcast(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stopped.Status != BroadcastRunning || stopped.Cursor != "user-1" || stopped.Push.Targeted != 2 || stopped.Push.Sent != 2 {
+		t.Fatalf("stopped broadcast = %+v, want it running with the first two users sent", stopped)
+	}
+
+	dispatcher = NewDispatcher(1, dispatcherCapacity)
+	defer dispatcher.Close()
+	runner = newTestBroadcastRunner(t, context.Background(), storage, dispatcher)
+	runner.resume()
+	runner.Wait(context.Background())
+
+	finished, _ := storage.GetBroadcast(job.ID)
+	if finished.Status != BroadcastCompleted || finished.Push.Targeted != len(users) || finished.Push.Sent != len(users) {
+		t.Errorf("resumed broadcast = %+v, want it completed with every user sent once", finished)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, user := range users {
+		if pushes[user] != 1 {
+			t.Errorf("%s got %d pushes, want 1", user, pushes[user])
+		}
+	}
+}
+
+func TestPruneBroadcasts(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	now := time.Now().UTC()
+	old, recent := now.Add(-2*broadcastRetention), now.Add(-time.Hour)
+	for _, job := range []BroadcastJob{
+		{ID: "old", Status: BroadcastCompleted, FinishedAt: &old},
+		{ID: "recent", Status: BroadcastCancelled, FinishedAt: &recent},
+		{ID: "running", Status: BroadcastRunning, CreatedAt: old},
+	} {
+		if err := storage.PutBroadcast(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := storage.PruneBroadcasts(now.Add(-broadcastRetention))
+	if err != nil || pruned != 1 {
+		t.Fatalf("PruneBroadcasts = %d, %v, want 1", pruned, err)
+	}
+	if _, err := storage.GetBroadcast("old"); err != errBroadcastNotFound {
+		t.Errorf("the old broadcast is still there: %v", err)
+	}
+	for _, id := range []string{"recent", "running"} {
+		if _, err := storage.GetBroadcast(id); err != nil {
+			t.Errorf("broadcast %s: %v", id, err)
+		}
+	}
+}
+
+func TestBroadcastDryRun(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storage.AddSubscription("alice", StoredSubscription{Provider: ProviderFCM, DeviceToken: "alice-device"})
+	storage.AddSubscription("bob", StoredSubscription{Provider: ProviderFCM, DeviceToken: "bob-device"})
+	storage.SetPreferences("bob", UserPreferences{Topics: []string{"events"}})
+	storage.SetPreferences("carol", UserPreferences{Topics: []string{"events"}})
+
+	dispatcher := NewDispatcher(1, dispatcherCapacity)
+	defer dispatcher.Close()
+	runner := newTestBroadcastRunner(t, context.Background(), storage, dispatcher)
+	for _, user := range []string{"alice", "carol"} {
+		server, client := net.Pipe()
+		defer client.Close()
+		runner.connManager.Add(user, server)
+	}
+
+	size, err := runner.DryRun(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != (AudienceSize{Users: 3, Websocket: 2, Push: 2}) {
+		t.Errorf("DryRun for everyone = %+v", size)
+	}
+
+	size, err = runner.DryRun(context.Background(), &Audience{Topics: []string{"events"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != (AudienceSize{Users: 2, Websocket: 1, Push: 1}) {
+		t.Errorf("DryRun for a topic = %+v", size)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Bus carries messages between the instances of the service, so that a
+// notification reaches a user connected to any of them.
+type Bus interface {
+	Publish(ctx context.Context, subject string, data []byte) error
+	// Subscribe calls handler with every message published on subject, from
+	// any instance including this one, until ctx is done.
+	Subscribe(ctx context.Context, subject string, handler func(data []byte)) error
+	Close() error
+}
+
+// PresenceRegistry records which users are connected to which instance.
+// Entries expire unless refreshed, so that the users of an instance which
+// died without cleaning up are eventually seen as offline.
+type PresenceRegistry interface {
+	SetOnline(ctx context.Context, user string) error
+	SetOffline(ctx context.Context, user string) error
+	// Refresh extends the presence of the users connected to this instance
+	Refresh(ctx context.Context, users []string) error
+	Online(ctx context.Context, users []string) (map[string]bool, error)
+	// Users lists the users connected to any instance
+	Users(ctx context.Context) ([]string, error)
+	Close() error
+}
+
+const (
+	presenceTTL             = 90 * time.Second
+	presenceRefreshInterval = 30 * time.Second
+)
+
+// presenceEntry maps the instances a user is connected to to the unix time
+// at which that presence expires, the redis and nats registries store one
+// per user.
+type presenceEntry map[string]int64
+
+func parsePresenceEntry(data []byte) presenceEntry {
+	entry := presenceEntry{}
+	if len(data) > 0 {
+		json.Unmarshal(data, &entry)
+	}
+	return entry
+}
+
+// live drops the expired instances and reports whether any is left.
+func (entry presenceEntry) live(now time.Time) bool {
+	for instance, expiresAt := range entry {
+		if expiresAt < now.Unix() {
+			delete(entry, instance)
+		}
+	}
+	return len(entry) > 0
+}
+
+// localBus is the bus of a single instance, messages are handed to the
+// subscribers in the same process.
+type localBus struct {
+	mu       sync.Mutex
+	handlers map[string][]*func([]byte)
+}
+
+func newLocalBus() *localBus {
+	return &localBus{handlers: make(map[string][]*func([]byte))}
+}
+
+func (b *localBus) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.Lock()
+	handlers := append([]*func([]byte){}, b.handlers[subject]...)
+	b.mu.Unlock()
+
+	for _, handler := range handlers {
+		(*handler)(data)
+	}
+	return nil
+}
+
+func (b *localBus) Subscribe(ctx context.Context, subject string, handler func([]byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := &handler
+	b.handlers[subject] = append(b.handlers[subject], h)
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, registered := range b.handlers[subject] {
+			if registered == h {
+				b.handlers[subject] = append(b.handlers[subject][:i], b.handlers[subject][i+1:]...)
+				break
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *localBus) Close() error {
+	return nil
+}
+
+// onlineUsers keeps the users whose presence is live, the listed entries
+// may only hold expired ones.
+func onlineUsers(ctx context.Context, registry PresenceRegistry, users []string) ([]string, error) {
+	online, err := registry.Online(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(users, func(user string) bool { return !online[user] }), nil
+}
+
+// localPresence answers from the connections of this instance, it is used
+// with the local bus.
+type localPresence struct {
+	connManager *WebsocketConnectionsManager
+}
+
+func (p localPresence) SetOnline(context.Context, string) error  { return nil }
+func (p localPresence) SetOffline(context.Context, string) error { return nil }
+func (p localPresence) Refresh(context.Context, []string) error  { return nil }
+func (p localPresence) Close() error                             { return nil }
+
+func (p localPresence) Online(ctx context.Context, users []string) (map[string]bool, error) {
+	return p.connManager.Online(users), nil
+}
+
+func (p localPresence) Users(context.Context) ([]string, error) {
+	return slices.Collect(maps.Keys(p.connManager.Connections())), nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	natsPresenceBucket = "everynyan_presence_v2"
+	// natsLegacyPresenceBucket has the entries of the instances which keyed
+	// them by a hash of the user. Entries are written to and read from both
+	// buckets until every instance runs with the current one, the legacy
+	// bucket can then be dropped.
+	natsLegacyPresenceBucket = "everynyan_presence"
+	// natsPresenceConcurrency bounds the key-value requests in flight for a
+	// refresh or a lookup of many users
+	natsPresenceConcurrency = 32
+	// optimistic updates of a presence entry are retried this many times
+	// when another instance updates it concurrently
+	natsPresenceRetries = 5
+)
+
+// natsBus publishes over core nats subjects.
+type natsBus struct {
+	conn *nats.Conn
+}
+
+func newNATSConn(url string) (*nats.Conn, error) {
+	conn, err := nats.Connect(url, nats.Name(serviceName), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to nats: %v", err)
+	}
+	return conn, nil
+}
+
+func newNATSBus(conn *nats.Conn) *natsBus {
+	return &natsBus{conn: conn}
+}
+
+func (b *natsBus) Publish(ctx context.Context, subject string, data []byte) error {
+	return b.conn.Publish(subject, data)
+}
+
+func (b *natsBus) Subscribe(ctx context.Context, subject string, handler func([]byte)) error {
+	sub, err := b.conn.Subscribe(subject, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	// make sure the server knows about the subscription before returning
+	if err := b.conn.Flush(); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+	}()
+	return nil
+}
+
+func (b *natsBus) Close() error {
+	return b.conn.Drain()
+}
+
+// natsPresence keeps a presence entry per user in a JetStream key-value
+// bucket. Keys are the users in URL-safe base64, users may contain
+// characters that are not valid in keys.
+type natsPresence struct {
+	kv       jetstream.KeyValue
+	legacyKV jetstream.KeyValue
+	instance string
+}
+
+func newNATSPresence(ctx context.Context, conn *nats.Conn, instance string) (*natsPresence, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &natsPresence{instance: instance}
+	for bucket, kv := range map[string]*jetstream.KeyValue{natsPresenceBucket: &p.kv, natsLegacyPresenceBucket: &p.legacyKV} {
+		*kv, err = js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket: bucket,
+			TTL:    presenceTTL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the nats presence bucket %s: %v", bucket, err)
+		}
+	}
+
+	return p, nil
+}
+
+func natsPresenceKey(user string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(user))
+}
+
+// natsLegacyPresenceKey is the key of the user in the legacy bucket.
+func natsLegacyPresenceKey(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:])
+}
+
+// forEachUser runs fn for every user, at most natsPresenceConcurrency at a
+// time, and joins the errors it returns.
+func forEachUser(users []string, fn func(user string) error) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	sem := make(chan struct{}, natsPresenceConcurrency)
+
+	for _, user := range users {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(user); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// update applies change to the user's entries with compare and swap, so
+// that instances updating the same user don't overwrite each other.
+func (p *natsPresence) update(ctx context.Context, user string, change func(presenceEntry)) error {
+	return errors.Join(
+		updateNATSPresence(ctx, p.kv, natsPresenceKey(user), change),
+		updateNATSPresence(ctx, p.legacyKV, natsLegacyPresenceKey(user), change),
+	)
+}
+
+func updateNATSPresence(ctx context.Context, kv jetstream.KeyValue, key string, change func(presenceEntry)) error {
+	for range natsPresenceRetries {
+		var revision uint64
+		entry := presenceEntry{}
+
+		current, err := kv.Get(ctx, key)
+		switch {
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			revision = current.Revision()
+			entry = parsePresenceEntry(current.Value())
+		}
+
+		change(entry)
+		entry.live(time.Now())
+
+		if revision == 0 {
+			_, err = kv.Create(ctx, key, jsonify(entry))
+		} else {
+			_, err = kv.Update(ctx, key, jsonify(entry), revision)
+		}
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) && !isWrongLastSequence(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("presence of user kept changing concurrently")
+}
+
+func isWrongLastSequence(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+}
+
+func (p *natsPresence) SetOnline(ctx context.Context, user string) error {
+	return p.update(ctx, user, func(entry presenceEntry) {
+		entry[p.instance] = time.Now().Add(presenceTTL).Unix()
+	})
+}
+
+func (p *natsPresence) SetOffline(ctx context.Context, user string) error {
+	return p.update(ctx, user, func(entry presenceEntry) {
+		delete(entry, p.instance)
+	})
+}
+
+// Refresh refreshes every user, the users whose refresh failed are in the
+// joined error.
+func (p *natsPresence) Refresh(ctx context.Context, users []string) error {
+	return forEachUser(users, func(user string) error {
+		if err := p.SetOnline(ctx, user); err != nil {
+			return fmt.Errorf("user %s: %w", user, err)
+		}
+		return nil
+	})
+}
+
+// livePresence reads the entry of key and reports whether it is live.
+func livePresence(ctx context.Context, kv jetstream.KeyValue, key string, now time.Time) (bool, error) {
+	current, err := kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return parsePresenceEntry(current.Value()).live(now), nil
+}
+
+func (p *natsPresence) Online(ctx context.Context, users []string) (map[string]bool, error) {
+	now := time.Now()
+	var mu sync.Mutex
+	online := make(map[string]bool, len(users))
+
+	err := forEachUser(users, func(user string) error {
+		live, err := livePresence(ctx, p.kv, natsPresenceKey(user), now)
+		if err == nil && !live {
+			// the user may be connected to an instance which only writes
+			// the legacy bucket
+			live, err = livePresence(ctx, p.legacyKV, natsLegacyPresenceKey(user), now)
+		}
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		online[user] = live
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return online, nil
+}
+
+// Users lists the users of the current bucket, the keys of the legacy one
+// can't be turned back into users.
+func (p *natsPresence) Users(ctx context.Context) ([]string, error) {
+	lister, err := p.kv.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lister.Stop()
+
+	users := []string{}
+	for key := range lister.Keys() {
+		user, err := base64.RawURLEncoding.DecodeString(key)
+		if err != nil {
+			continue
+		}
+		users = append(users, string(user))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return onlineUsers(ctx, p, users)
+}
+
+func (p *natsPresence) Close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisPresencePrefix = "everynyan:presence:"
+
+// redisBus publishes over redis pub/sub.
+type redisBus struct {
+	client *redis.Client
+}
+
+func newRedisClient(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+func newRedisBus(client *redis.Client) *redisBus {
+	return &redisBus{client: client}
+}
+
+func (b *redisBus) Publish(ctx context.Context, subject string, data []byte) error {
+	return b.client.Publish(ctx, subject, data).Err()
+}
+
+func (b *redisBus) Subscribe(ctx context.Context, subject string, handler func([]byte)) error {
+	pubsub := b.client.Subscribe(ctx, subject)
+	// wait for the confirmation so that no message published after
+	// Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	go func() {
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				handler([]byte(msg.Payload))
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *redisBus) Close() error {
+	return b.client.Close()
+}
+
+// redisPresence keeps a hash per user, from instance to the unix time at
+// which the presence expires.
+type redisPresence struct {
+	client   *redis.Client
+	instance string
+}
+
+func newRedisPresence(client *redis.Client, instance string) *redisPresence {
+	return &redisPresence{client: client, instance: instance}
+}
+
+func (p *redisPresence) SetOnline(ctx context.Context, user string) error {
+	return p.Refresh(ctx, []string{user})
+}
+
+func (p *redisPresence) SetOffline(ctx context.Context, user string) error {
+	return p.client.HDel(ctx, redisPresencePrefix+user, p.instance).Err()
+}
+
+func (p *redisPresence) Refresh(ctx context.Context, users []string) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(presenceTTL).Unix()
+	_, err := p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, user := range users {
+			key := redisPresencePrefix + user
+			pipe.HSet(ctx, key, p.instance, expiresAt)
+			pipe.Expire(ctx, key, presenceTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+func (p *redisPresence) Online(ctx context.Context, users []string) (map[string]bool, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(users))
+	_, err := p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, user := range users {
+			cmds[i] = pipe.HGetAll(ctx, redisPresencePrefix+user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	online := make(map[string]bool, len(users))
+	for i, user := range users {
+		entry := presenceEntry{}
+		for instance, expiresAt := range cmds[i].Val() {
+			unix, err := strconv.ParseInt(expiresAt, 10, 64)
+			if err != nil {
+				slog.Warn("invalid presence entry in redis", "user", user, "instance", instance)
+				continue
+			}
+			entry[instance] = unix
+		}
+		online[user] = entry.live(now)
+	}
+	return online, nil
+}
+
+func (p *redisPresence) Users(ctx context.Context) ([]string, error) {
+	users := []string{}
+	iter := p.client.Scan(ctx, 0, redisPresencePrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		users = append(users, strings.TrimPrefix(iter.Val(), redisPresencePrefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return onlineUsers(ctx, p, users)
+}
+
+func (p *redisPresence) Close() error {
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gobwas/ws/wsutil"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// startNATSServer runs a nats-server with JetStream for the test, the
+// presence registry needs its key-value store.
+func startNATSServer(t *testing.T) string {
+	t.Helper()
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats-server did not start")
+	}
+	t.Cleanup(server.Shutdown)
+	return server.ClientURL()
+}
+
+// testBusConfigs return the bus config of an instance for every shared bus,
+// the instances of a test all get the same server.
+var testBusConfigs = map[string]func(t *testing.T) func(instance string) config.BusConfig{
+	"redis": func(t *testing.T) func(string) config.BusConfig {
+		server := miniredis.RunT(t)
+		return func(instance string) config.BusConfig {
+			return config.BusConfig{Backend: config.BusRedis, RedisURL: "redis://" + server.Addr(), InstanceID: instance}
+		}
+	},
+	"nats": func(t *testing.T) func(string) config.BusConfig {
+		url := startNATSServer(t)
+		return func(instance string) config.BusConfig {
+			return config.BusConfig{Backend: config.BusNATS, NATSURL: url, InstanceID: instance}
+		}
+	},
+}
+
+func forEachBus(t *testing.T, test func(t *testing.T, newCluster func(instance string) *Cluster)) {
+	for name, start := range testBusConfigs {
+		t.Run(name, func(t *testing.T) {
+			busConfig := start(t)
+			test(t, func(instance string) *Cluster {
+				ctx := context.Background()
+				cluster, err := NewCluster(ctx, busConfig(instance), NewWebsocketConnectionsManager(), NewDispatcher(1, dispatcherCapacity), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { cluster.Close() })
+				return cluster
+			})
+		})
+	}
+}
+
+func TestBusPublishSubscribe(t *testing.T) {
+	forEachBus(t, func(t *testing.T, newCluster func(string) *Cluster) {
+		a, b := newCluster("a"), newCluster("b")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		received := make(chan string, 10)
+		err := b.bus.Subscribe(ctx, "test.subject", func(data []byte) {
+			received <- string(data)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := a.bus.Publish(context.Background(), "test.subject", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.bus.Publish(context.Background(), "other.subject", []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if msg != "hello" {
+				t.Errorf("received %q, want hello", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received")
+		}
+
+		cancel()
+		// the subscription goes away in the background
+		time.Sleep(200 * time.Millisecond)
+		a.bus.Publish(context.Background(), "test.subject", []byte("after cancel"))
+		select {
+		case msg := <-received:
+			t.Errorf("received %q after the subscription was cancelled", msg)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+func TestPresenceRegistry(t *testing.T) {
+	forEachBus(t, func(t *testing.T, newCluster func(string) *Cluster) {
+		ctx := context.Background()
+		a, b := newCluster("a"), newCluster("b")
+
+		online := func(want map[string]bool) {
+			t.Helper()
+			for _, cluster := range []*Cluster{a, b} {
+				got, err := cluster.presence.Online(ctx, []string{"alice", "bob"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for user, wantOnline := range want {
+					if got[user] != wantOnline {
+						t.Errorf("instance %s sees %s online = %v, want %v", cluster.instanceID, user, got[user], wantOnline)
+					}
+				}
+			}
+		}
+
+		online(map[string]bool{"alice": false, "bob": false})
+
+		a.presence.SetOnline(ctx, "alice")
+		b.presence.SetOnline(ctx, "alice")
+		b.presence.Refresh(ctx, []string{"bob"})
+		online(map[string]bool{"alice": true, "bob": true})
+
+		// alice is still connected to b
+		a.presence.SetOffline(ctx, "alice")
+		online(map[string]bool{"alice": true, "bob": true})
+
+		b.presence.SetOffline(ctx, "alice")
+		online(map[string]bool{"alice": false, "bob": true})
+
+		// users with characters which aren't valid in keys
+		a.presence.SetOnline(ctx, "user/with spaces:and*")
+		for _, cluster := range []*Cluster{a, b} {
+			users, err := cluster.presence.Users(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(users)
+			if want := []string{"bob", "user/with spaces:and*"}; !slices.Equal(users, want) {
+				t.Errorf("instance %s lists %q online, want %q", cluster.instanceID, users, want)
+			}
+		}
+	})
+}
+
+// TestNATSPresenceLegacyBucket checks that instances which still key the
+// presence entries by a hash of the user and the current ones see each
+// other's users during a rolling deploy.
+func TestNATSPresenceLegacyBucket(t *testing.T) {
+	ctx := context.Background()
+	cluster, err := NewCluster(ctx, testBusConfigs["nats"](t)("a"), NewWebsocketConnectionsManager(), NewDispatcher(1, dispatcherCapacity), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	p := cluster.presence.(*natsPresence)
+
+	// an instance on the legacy keys registers carol
+	err = updateNATSPresence(ctx, p.legacyKV, natsLegacyPresenceKey("carol"), func(entry presenceEntry) {
+		entry["legacy"] = time.Now().Add(presenceTTL).Unix()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	online, err := p.Online(ctx, []string{"carol"})
+	if err != nil || !online["carol"] {
+		t.Errorf("user of a legacy instance online = %v, %v", online["carol"], err)
+	}
+
+	// and sees the users of the current instances
+	p.SetOnline(ctx, "dave")
+	live, err := livePresence(ctx, p.legacyKV, natsLegacyPresenceKey("dave"), time.Now())
+	if err != nil || !live {
+		t.Errorf("user in the legacy bucket online = %v, %v", live, err)
+	}
+}
+
+func TestNATSPresenceRefresh(t *testing.T) {
+	ctx := context.Background()
+	cluster, err := NewCluster(ctx, testBusConfigs["nats"](t)("a"), NewWebsocketConnectionsManager(), NewDispatcher(1, dispatcherCapacity), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Close()
+	p := cluster.presence.(*natsPresence)
+
+	users := []string{}
+	for i := range natsPresenceConcurrency * 3 {
+		users = append(users, fmt.Sprintf("user-%d", i))
+	}
+	if err := p.Refresh(ctx, users); err != nil {
+		t.Fatal(err)
+	}
+	online, err := p.Online(ctx, append(users, "offline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		if !online[user] {
+			t.Errorf("refreshed user %s is offline", user)
+		}
+	}
+	if online["offline"] {
+		t.Error("user who never connected is online")
+	}
+
+	// a failed refresh doesn't stop the refresh of the other users, every
+	// failure is reported
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = p.Refresh(cancelled, users[:3])
+	for _, user := range users[:3] {
+		if err == nil || !strings.Contains(err.Error(), "user "+user+":") {
+			t.Errorf("refresh error %v doesn't name %s", err, user)
+		}
+	}
+}
+
+func TestClusterOnlineUsers(t *testing.T) {
+	forEachBus(t, func(t *testing.T, newCluster func(string) *Cluster) {
+		ctx := context.Background()
+		a, b := newCluster("a"), newCluster("b")
+		// alice's presence is registered, carol's connection is too new
+		// for it to be
+		for _, user := range []string{"alice", "carol"} {
+			server, client := net.Pipe()
+			defer client.Close()
+			a.connManager.Add(user, server)
+		}
+		a.presence.SetOnline(ctx, "alice")
+		b.presence.SetOnline(ctx, "bob")
+
+		users, err := a.OnlineUsers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(users)
+		if want := []string{"alice", "bob", "carol"}; !slices.Equal(users, want) {
+			t.Errorf("online users = %q, want %q", users, want)
+		}
+	})
+}
+
+func TestPresenceEntryExpiry(t *testing.T) {
+	now := time.Now()
+	entry := parsePresenceEntry(jsonify(presenceEntry{
+		"crashed": now.Add(-time.Second).Unix(),
+		"running": now.Add(presenceTTL).Unix(),
+	}))
+	if !entry.live(now) {
+		t.Fatal("entry with a running instance is not live")
+	}
+	if _, ok := entry["crashed"]; ok {
+		t.Error("the expired instance was not dropped")
+	}
+
+	if parsePresenceEntry([]byte("not json")).live(now) {
+		t.Error("an unreadable entry is live")
+	}
+	if parsePresenceEntry(jsonify(presenceEntry{"crashed": now.Add(-time.Second).Unix()})).live(now) {
+		t.Error("an entry with only expired instances is live")
+	}
+}
+
+// TestClusterDeliverRemote sends a notification from one instance to the
+// websocket of a user connected to another.
+func TestClusterDeliverRemote(t *testing.T) {
+	forEachBus(t, func(t *testing.T, newCluster func(string) *Cluster) {
+		ctx := context.Background()
+		sender, holder := newCluster("sender"), newCluster("holder")
+		for _, cluster := range []*Cluster{sender, holder} {
+			if err := cluster.Run(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		server, client := net.Pipe()
+		defer client.Close()
+		holder.connManager.Add("alice", server)
+		holder.Connected(ctx, "alice")
+
+		notif := NotificationRequest{ID: "n1", User: "alice", Priority: PriorityNormal}
+		if sender.DeliverRemote(ctx, NotificationRequest{ID: "n0", User: "bob"}, []byte("nobody")) {
+			t.Error("DeliverRemote to a user connected nowhere = true")
+		}
+		if !sender.DeliverRemote(ctx, notif, []byte("hello alice")) {
+			t.Fatal("DeliverRemote = false, want true")
+		}
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := wsutil.ReadServerText(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != "hello alice" {
+			t.Errorf("received %q, want hello alice", msg)
+		}
+
+		holder.Disconnected(ctx, "alice")
+		if sender.DeliverRemote(ctx, notif, []byte("gone")) {
+			t.Error("DeliverRemote after the user disconnected = true")
+		}
+	})
+}
+
+// TestClusterRevokeToken checks that a revocation published by another
+// instance drops the token from the cache, the caches of the instances of
+// a test are the same one so RevokeToken's own delete isn't used.
+func TestClusterRevokeToken(t *testing.T) {
+	forEachBus(t, func(t *testing.T, newCluster func(string) *Cluster) {
+		ctx := context.Background()
+		a, b := newCluster("a"), newCluster("b")
+		if err := b.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		token := "revoked-" + t.Name()
+		tokenCache.Set(token, SessionCookie{Token: token, Role: "user"})
+		if err := a.publish(ctx, subjectRevoke, busEnvelope{Token: token}); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			tokenCache.mu.Lock()
+			_, cached := tokenCache.entries[token]
+			tokenCache.mu.Unlock()
+			if !cached {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("revoked token is still cached")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	"github.com/shravanasati/everynyan-notification-service/middleware"
+)
+
+// bus subjects
+const (
+	subjectDeliver   = "everynyan.deliver"
+	subjectBroadcast = "everynyan.broadcast"
+	subjectPresence  = "everynyan.presence"
+	subjectRevoke    = "everynyan.revoke"
+)
+
+// busEnvelope is a message on the bus, instances ignore the ones they sent
+// themselves.
+type busEnvelope struct {
+	Origin    string `json:"origin"`
+	RequestID string `json:"requestId,omitempty"`
+
+	// deliveries carry the websocket message for one user, broadcasts for
+	// every connected user
+	User           string `json:"user,omitempty"`
+	NotificationID string `json:"notificationId,omitempty"`
+	Priority       string `json:"priority,omitempty"`
+	Message        []byte `json:"message,omitempty"`
+	// broadcasts only go to the users of their audience
+	Audience *Audience `json:"audience,omitempty"`
+
+	// presence events are passed on to the presence streams of the other
+	// instances
+	Event *Event `json:"event,omitempty"`
+
+	// revocations drop a session token from the token cache of the other
+	// instances
+	Token string `json:"token,omitempty"`
+}
+
+// Cluster lets any instance deliver to users connected to any other
+// instance, through the bus and the presence registry.
+type Cluster struct {
+	instanceID  string
+	bus         Bus
+	presence    PresenceRegistry
+	connManager *WebsocketConnectionsManager
+	dispatcher  *Dispatcher
+	storage     *storage
+}
+
+// NewCluster connects to the configured bus backend.
+func NewCluster(ctx context.Context, conf config.BusConfig, connManager *WebsocketConnectionsManager, dispatcher *Dispatcher, storage *storage) (*Cluster, error) {
+	cluster := &Cluster{
+		instanceID:  conf.InstanceID,
+		connManager: connManager,
+		dispatcher:  dispatcher,
+		storage:     storage,
+	}
+
+	switch conf.Backend {
+	case config.BusRedis:
+		client, err := newRedisClient(conf.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.Ping(ctx).Err(); err != nil {
+			return nil, err
+		}
+		cluster.bus = newRedisBus(client)
+		cluster.presence = newRedisPresence(client, conf.InstanceID)
+
+	case config.BusNATS:
+		conn, err := newNATSConn(conf.NATSURL)
+		if err != nil {
+			return nil, err
+		}
+		presence, err := newNATSPresence(ctx, conn, conf.InstanceID)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cluster.bus = newNATSBus(conn)
+		cluster.presence = presence
+
+	default:
+		cluster.bus = newLocalBus()
+		cluster.presence = localPresence{connManager}
+	}
+
+	return cluster, nil
+}
+
+// Run handles the messages of the other instances and keeps the presence of
+// the local users fresh until ctx is done.
+func (c *Cluster) Run(ctx context.Context) error {
+	handlers := map[string]func(busEnvelope){
+		subjectDeliver:   c.handleDeliver,
+		subjectBroadcast: c.handleBroadcast,
+		subjectPresence:  c.handlePresence,
+		subjectRevoke:    c.handleRevoke,
+	}
+	for subject, handle := range handlers {
+		err := c.bus.Subscribe(ctx, subject, func(data []byte) {
+			var envelope busEnvelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				slog.Warn("dropping malformed bus message", "subject", subject, "error", err)
+				return
+			}
+			if envelope.Origin == c.instanceID {
+				return
+			}
+			handle(envelope)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(presenceRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.presence.Refresh(ctx, c.connManager.Users()); err != nil {
+					slog.Warn("unable to refresh presence", "error", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *Cluster) publish(ctx context.Context, subject string, envelope busEnvelope) error {
+	envelope.Origin = c.instanceID
+	envelope.RequestID = middleware.GetRequestID(ctx)
+	return c.bus.Publish(ctx, subject, jsonify(envelope))
+}
+
+// Connected records the user as online and tells the other instances.
+func (c *Cluster) Connected(ctx context.Context, user string) {
+	if err := c.presence.SetOnline(ctx, user); err != nil {
+		slog.WarnContext(ctx, "unable to record presence", "user", user, "error", err)
+	}
+	c.publishPresence(ctx, Event{Type: EventUserConnected, User: user})
+}
+
+func (c *Cluster) Disconnected(ctx context.Context, user string) {
+	if err := c.presence.SetOffline(ctx, user); err != nil {
+		slog.WarnContext(ctx, "unable to clear presence", "user", user, "error", err)
+	}
+	c.publishPresence(ctx, Event{Type: EventUserDisconnected, User: user})
+}
+
+func (c *Cluster) publishPresence(ctx context.Context, event Event) {
+	event = events.Publish(event)
+	if err := c.publish(ctx, subjectPresence, busEnvelope{Event: &event}); err != nil {
+		slog.WarnContext(ctx, "unable to publish presence on the bus", "error", err)
+	}
+}
+
+// RevokeToken drops the session token from the token cache of every
+// instance, so that it is looked up in firestore again on its next use.
+func (c *Cluster) RevokeToken(ctx context.Context, token string) error {
+	tokenCache.Delete(token)
+	return c.publish(ctx, subjectRevoke, busEnvelope{Token: token})
+}
+
+// Online reports which of the users are connected to any instance.
+func (c *Cluster) Online(ctx context.Context, users []string) (map[string]bool, error) {
+	online, err := c.presence.Online(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	for user, local := range c.connManager.Online(users) {
+		online[user] = online[user] || local
+	}
+	return online, nil
+}
+
+// OnlineUsers lists the users connected to any instance.
+func (c *Cluster) OnlineUsers(ctx context.Context) ([]string, error) {
+	users, err := c.presence.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]struct{}, len(users))
+	for _, user := range users {
+		listed[user] = struct{}{}
+	}
+	for user := range c.connManager.Connections() {
+		if _, ok := listed[user]; !ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// DeliverRemote hands the websocket message to the instance the user is
+// connected to, it reports whether the user is connected anywhere else.
+func (c *Cluster) DeliverRemote(ctx context.Context, notif NotificationRequest, message []byte) bool {
+	online, err := c.presence.Online(ctx, []string{notif.User})
+	if err != nil {
+		slog.WarnContext(ctx, "unable to look up presence", "user", notif.User, "error", err)
+		return false
+	}
+	if !online[notif.User] {
+		return false
+	}
+
+	err = c.publish(ctx, subjectDeliver, busEnvelope{
+		User:           notif.User,
+		NotificationID: notif.ID,
+		Priority:       notif.Priority,
+		Message:        message,
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "unable to publish delivery on the bus", "user", notif.User, "error", err)
+		return false
+	}
+	return true
+}
+
+// audience looks up the criteria of audiences across the cluster.
+func (c *Cluster) audience() audienceLookup {
+	return audienceLookup{storage: c.storage, online: c.Online, sessions: getTokens}
+}
+
+// BroadcastRemote hands the websocket message to the other instances for
+// their connected users in the audience.
+func (c *Cluster) BroadcastRemote(ctx context.Context, priority string, audience *Audience, message []byte) {
+	err := c.publish(ctx, subjectBroadcast, busEnvelope{Priority: priority, Audience: audience, Message: message})
+	if err != nil {
+		slog.WarnContext(ctx, "unable to publish broadcast on the bus", "error", err)
+	}
+}
+
+func (c *Cluster) handleDeliver(envelope busEnvelope) {
+	conn, ok := c.connManager.Get(envelope.User)
+	if !ok {
+		return
+	}
+
+	ctx := middleware.WithRequestID(context.Background(), envelope.RequestID)
+	accepted := c.dispatcher.Submit(envelope.Priority, func() {
+		recordWebsocketWrite(ctx, envelope.User, envelope.NotificationID, writeWebsocketMessage(ctx, conn, envelope.Message))
+	})
+	if !accepted {
+		slog.WarnContext(ctx, "dispatcher queue full, dropping remote delivery", "notification_id", envelope.NotificationID)
+	}
+}
+
+func (c *Cluster) handleBroadcast(envelope busEnvelope) {
+	ctx := middleware.WithRequestID(context.Background(), envelope.RequestID)
+
+	// matching the audience may take lookups, it isn't done on the bus'
+	// goroutine
+	c.dispatcher.Submit(envelope.Priority, func() {
+		conns := c.connManager.Connections()
+		matched, err := c.audience().Match(ctx, envelope.Audience, slices.Collect(maps.Keys(conns)))
+		if err != nil {
+			slog.WarnContext(ctx, "unable to match broadcast audience", "error", err)
+			return
+		}
+
+		for user, conn := range conns {
+			if !matched[user] {
+				continue
+			}
+			c.dispatcher.Submit(envelope.Priority, func() {
+				recordWebsocketWrite(ctx, "", "", writeWebsocketMessage(ctx, conn, envelope.Message))
+			})
+		}
+	})
+}
+
+// handlePresence passes the presence events of the other instances on to
+// the local presence streams, webhooks only get the events of their own
+// instance so that they aren't sent more than once.
+func (c *Cluster) handlePresence(envelope busEnvelope) {
+	if envelope.Event == nil {
+		return
+	}
+	event := *envelope.Event
+	event.Remote = true
+	events.Forward(event)
+}
+
+func (c *Cluster) handleRevoke(envelope busEnvelope) {
+	tokenCache.Delete(envelope.Token)
+}
+
+func (c *Cluster) Close() error {
+	c.presence.Close()
+	return c.bus.Close()
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+const (
+	BusLocal = "local"
+	BusRedis = "redis"
+	BusNATS  = "nats"
+)
+
+// BusConfig selects how instances share websocket deliveries and presence,
+// the local bus is for a single instance.
+type BusConfig struct {
+	Backend  string
+	RedisURL string
+	NATSURL  string
+	// InstanceID tells the instances apart on the bus
+	InstanceID string
+}
+
+func getBusConfig() (BusConfig, error) {
+	conf := BusConfig{
+		Backend:    lookupEnvDefault("BUS_BACKEND", BusLocal),
+		RedisURL:   lookupEnvDefault("REDIS_URL", ""),
+		NATSURL:    lookupEnvDefault("NATS_URL", ""),
+		InstanceID: lookupEnvDefault("INSTANCE_ID", ""),
+	}
+
+	switch conf.Backend {
+	case BusLocal:
+	case BusRedis:
+		if conf.RedisURL == "" {
+			return conf, fmt.Errorf("REDIS_URL must be set when BUS_BACKEND is redis")
+		}
+	case BusNATS:
+		if conf.NATSURL == "" {
+			return conf, fmt.Errorf("NATS_URL must be set when BUS_BACKEND is nats")
+		}
+	default:
+		return conf, fmt.Errorf("BUS_BACKEND must be one of local, redis or nats")
+	}
+
+	if conf.InstanceID == "" {
+		hostname, _ := os.Hostname()
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		conf.InstanceID = hostname + "-" + hex.EncodeToString(suffix)
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EmailConfig holds the SMTP settings of the email channel.
+type EmailConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// Timeout bounds a whole SMTP conversation, from dialing to QUIT
+	Timeout time.Duration
+	// Delay is how long a notification has to stay unread before it is
+	// emailed
+	Delay time.Duration
+	// PublicURL is the base URL of this service, used for unsubscribe links
+	PublicURL string
+	// SiteURL is the base URL of the website, relative notification links
+	// are resolved against it
+	SiteURL *url.URL
+}
+
+func (c EmailConfig) Addr() string {
+	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
+func getEmailConfig() (*EmailConfig, error) {
+	host := lookupEnvDefault("SMTP_HOST", "")
+	if host == "" {
+		return nil, nil
+	}
+
+	var err error
+	conf := &EmailConfig{
+		Host:      host,
+		Username:  lookupEnvDefault("SMTP_USERNAME", ""),
+		Password:  lookupEnvDefault("SMTP_PASSWORD", ""),
+		From:      lookupEnvDefault("SMTP_FROM", ""),
+		PublicURL: strings.TrimSuffix(lookupEnvDefault("PUBLIC_URL", ""), "/"),
+	}
+
+	conf.Port, err = lookupPositiveInt("SMTP_PORT", 587)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := mail.ParseAddress(conf.From); err != nil {
+		return nil, fmt.Errorf("SMTP_FROM must be a valid email address")
+	}
+
+	if u, err := url.Parse(conf.PublicURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("PUBLIC_URL must be set to a valid URL when SMTP_HOST is set")
+	}
+
+	conf.SiteURL, err = url.Parse(lookupEnvDefault("SITE_URL", ""))
+	if err != nil || conf.SiteURL.Host == "" {
+		return nil, fmt.Errorf("SITE_URL must be set to a valid URL when SMTP_HOST is set")
+	}
+
+	conf.Timeout, err = lookupDuration("SMTP_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.Delay, err = lookupDuration("EMAIL_DELAY", 30*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
@@ -11,6 +11,15 @@ import (
 type Config struct {
 	SecretKey []byte
 	API_KEY   string
+	Push      PushConfig
+	// Email is nil unless the email channel is configured
+	Email     *EmailConfig
+	Log       LogConfig
+	Tracing   TracingConfig
+	Server    ServerConfig
+	Bus       BusConfig
+	Storage   StorageConfig
+	RateLimit RateLimitConfig
 }
 
 func GetConfig() (*Config, error) {
@@ -35,9 +44,57 @@ func GetConfig() (*Config, error) {
 		return nil, err
 	}
 
+	pushConfig, err := getPushConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	emailConfig, err := getEmailConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	logConfig, err := getLogConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tracingConfig, err := getTracingConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	serverConfig, err := getServerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	busConfig, err := getBusConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	storageConfig, err := getStorageConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimitConfig, err := getRateLimitConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	conf := &Config{
 		SecretKey: secretKey,
-		API_KEY: apiKey,
+		API_KEY:   apiKey,
+		Push:      pushConfig,
+		Email:     emailConfig,
+		Log:       logConfig,
+		Tracing:   tracingConfig,
+		Server:    serverConfig,
+		Bus:       busConfig,
+		Storage:   storageConfig,
+		RateLimit: rateLimitConfig,
 	}
 
 	return conf, nil
@@ -62,4 +119,4 @@ func processSecretKey(inputKey []byte, salt []byte) ([]byte, error) {
 
 	return secretKey, nil
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+type LogConfig struct {
+	Level  slog.Level
+	Format string
+}
+
+func getLogConfig() (LogConfig, error) {
+	var conf LogConfig
+
+	level := lookupEnvDefault("LOG_LEVEL", "info")
+	if err := conf.Level.UnmarshalText([]byte(level)); err != nil {
+		return conf, fmt.Errorf("LOG_LEVEL must be one of debug, info, warn or error")
+	}
+
+	conf.Format = strings.ToLower(lookupEnvDefault("LOG_FORMAT", LogFormatText))
+	if conf.Format != LogFormatText && conf.Format != LogFormatJSON {
+		return conf, fmt.Errorf("LOG_FORMAT must be either text or json")
+	}
+
+	return conf, nil
+}
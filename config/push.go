@@ -0,0 +1,268 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+type VAPIDKeyPair struct {
+	PublicKey  string
+	PrivateKey string
+}
+
+// VAPIDKeys holds the key pair new subscriptions are created under along
+// with the legacy pairs which older subscriptions still need to be signed
+// with.
+type VAPIDKeys struct {
+	Active VAPIDKeyPair
+	Legacy []VAPIDKeyPair
+	// BackfillPublicKey is the public key the subscriptions stored before
+	// they recorded their key were created under
+	BackfillPublicKey string
+}
+
+// BackfillKey returns the public key to record on the subscriptions which
+// don't have one. Without rotation the active key is the only one they can
+// have been created under, once there are legacy keys it has to be set.
+func (keys VAPIDKeys) BackfillKey() (string, error) {
+	if keys.BackfillPublicKey != "" {
+		return keys.BackfillPublicKey, nil
+	}
+	if len(keys.Legacy) > 0 {
+		return "", fmt.Errorf("the VAPID keys have been rotated, set VAPID_BACKFILL_PUBLIC_KEY to the public key the subscriptions without one were created under")
+	}
+	return keys.Active.PublicKey, nil
+}
+
+// Lookup finds the key pair for the public key a subscription was created
+// under.
+func (keys VAPIDKeys) Lookup(publicKey string) (VAPIDKeyPair, bool) {
+	if publicKey == keys.Active.PublicKey {
+		return keys.Active, true
+	}
+	for _, pair := range keys.Legacy {
+		if pair.PublicKey == publicKey {
+			return pair, true
+		}
+	}
+	return VAPIDKeyPair{}, false
+}
+
+type PushConfig struct {
+	VAPIDKeys VAPIDKeys
+	// Subscriber is the contact sent to push services in the VAPID token,
+	// either an email address or an https URL
+	Subscriber string
+	// DefaultTTL and Urgency apply to notifications of normal priority
+	DefaultTTL            time.Duration
+	Urgency               webpush.Urgency
+	HTTPTimeout           time.Duration
+	MaxConcurrentRequests int
+	// per push service host limits on requests in flight and requests
+	// started per second
+	MaxConcurrentPerHost int
+	RateLimitPerHost     float64
+	RateBurstPerHost     int
+	// ProxyURL, if set, is used for all requests to push services
+	ProxyURL *url.URL
+
+	// FCMEndpoint overrides the FCM HTTP v1 endpoint, eg. for a local fake
+	FCMEndpoint string
+	// APNs is nil unless the APNs provider is configured
+	APNs *APNsConfig
+}
+
+// APNsConfig holds the token based authentication settings of APNs.
+type APNsConfig struct {
+	// KeyFile is the path of the .p8 signing key
+	KeyFile string
+	KeyID   string
+	TeamID  string
+	// Topic is the bundle ID of the app
+	Topic    string
+	Endpoint string
+}
+
+func getAPNsConfig() (*APNsConfig, error) {
+	keyFile := lookupEnvDefault("APNS_KEY_FILE", "")
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	conf := &APNsConfig{
+		KeyFile:  keyFile,
+		KeyID:    os.Getenv("APNS_KEY_ID"),
+		TeamID:   os.Getenv("APNS_TEAM_ID"),
+		Topic:    os.Getenv("APNS_TOPIC"),
+		Endpoint: lookupEnvDefault("APNS_ENDPOINT", "https://api.push.apple.com"),
+	}
+	if conf.KeyID == "" || conf.TeamID == "" || conf.Topic == "" {
+		return nil, fmt.Errorf("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC must be set along with APNS_KEY_FILE")
+	}
+	if _, err := url.Parse(conf.Endpoint); err != nil {
+		return nil, fmt.Errorf("APNS_ENDPOINT must be a valid URL")
+	}
+
+	return conf, nil
+}
+
+// parseVAPIDKeyPairs parses a comma separated list of "public:private" key
+// pairs.
+func parseVAPIDKeyPairs(value string) ([]VAPIDKeyPair, error) {
+	pairs := []VAPIDKeyPair{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		public, private, found := strings.Cut(entry, ":")
+		if !found || public == "" || private == "" {
+			return nil, fmt.Errorf("invalid VAPID key pair %q, expected public:private", entry)
+		}
+		pairs = append(pairs, VAPIDKeyPair{PublicKey: public, PrivateKey: private})
+	}
+	return pairs, nil
+}
+
+func missingVAPIDKeyError(env string) error {
+	privateKey, publicKey, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		return fmt.Errorf("%s env not set", env)
+	}
+	return fmt.Errorf("%s env not set, a freshly generated pair is VAPID_PRIVATE_KEY=%s VAPID_PUBLIC_KEY=%s", env, privateKey, publicKey)
+}
+
+func lookupEnvDefault(key, fallback string) string {
+	value, set := os.LookupEnv(key)
+	if !set || value == "" {
+		return fallback
+	}
+	return value
+}
+
+func lookupDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := lookupEnvDefault(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, eg. 30s", key)
+	}
+	return d, nil
+}
+
+func lookupPositiveInt(key string, fallback int) (int, error) {
+	value := lookupEnvDefault(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", key)
+	}
+	return n, nil
+}
+
+func lookupPositiveFloat(key string, fallback float64) (float64, error) {
+	value := lookupEnvDefault(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number", key)
+	}
+	return f, nil
+}
+
+func getPushConfig() (PushConfig, error) {
+	var conf PushConfig
+	var set bool
+
+	conf.VAPIDKeys.Active.PublicKey, set = os.LookupEnv("VAPID_PUBLIC_KEY")
+	if !set {
+		return conf, missingVAPIDKeyError("VAPID_PUBLIC_KEY")
+	}
+	conf.VAPIDKeys.Active.PrivateKey, set = os.LookupEnv("VAPID_PRIVATE_KEY")
+	if !set {
+		return conf, missingVAPIDKeyError("VAPID_PRIVATE_KEY")
+	}
+
+	legacyKeys, err := parseVAPIDKeyPairs(os.Getenv("VAPID_LEGACY_KEYS"))
+	if err != nil {
+		return conf, fmt.Errorf("VAPID_LEGACY_KEYS: %v", err)
+	}
+	conf.VAPIDKeys.Legacy = legacyKeys
+
+	conf.VAPIDKeys.BackfillPublicKey = os.Getenv("VAPID_BACKFILL_PUBLIC_KEY")
+	if conf.VAPIDKeys.BackfillPublicKey != "" {
+		if _, ok := conf.VAPIDKeys.Lookup(conf.VAPIDKeys.BackfillPublicKey); !ok {
+			return conf, fmt.Errorf("VAPID_BACKFILL_PUBLIC_KEY must be the active public key or one of VAPID_LEGACY_KEYS")
+		}
+	}
+
+	conf.Subscriber = strings.TrimPrefix(lookupEnvDefault("VAPID_SUBSCRIBER", "dev.shravan@proton.me"), "mailto:")
+	if !strings.HasPrefix(conf.Subscriber, "https://") && !strings.Contains(conf.Subscriber, "@") {
+		return conf, fmt.Errorf("VAPID_SUBSCRIBER must be an email address or an https URL")
+	}
+
+	conf.DefaultTTL, err = lookupDuration("PUSH_DEFAULT_TTL", 24*time.Hour)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.Urgency = webpush.Urgency(lookupEnvDefault("PUSH_URGENCY", string(webpush.UrgencyNormal)))
+	switch conf.Urgency {
+	case webpush.UrgencyVeryLow, webpush.UrgencyLow, webpush.UrgencyNormal, webpush.UrgencyHigh:
+	default:
+		return conf, fmt.Errorf("PUSH_URGENCY must be one of very-low, low, normal or high")
+	}
+
+	conf.HTTPTimeout, err = lookupDuration("PUSH_HTTP_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.MaxConcurrentRequests, err = lookupPositiveInt("PUSH_MAX_CONCURRENT_REQUESTS", 64)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.MaxConcurrentPerHost, err = lookupPositiveInt("PUSH_MAX_CONCURRENT_PER_HOST", 16)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.RateLimitPerHost, err = lookupPositiveFloat("PUSH_RATE_LIMIT_PER_HOST", 50)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.RateBurstPerHost, err = lookupPositiveInt("PUSH_RATE_BURST_PER_HOST", 50)
+	if err != nil {
+		return conf, err
+	}
+
+	if proxy := lookupEnvDefault("PUSH_PROXY_URL", ""); proxy != "" {
+		conf.ProxyURL, err = url.Parse(proxy)
+		if err != nil || conf.ProxyURL.Host == "" {
+			return conf, fmt.Errorf("PUSH_PROXY_URL must be a valid URL")
+		}
+	}
+
+	conf.FCMEndpoint = lookupEnvDefault("PUSH_FCM_ENDPOINT", "")
+
+	conf.APNs, err = getAPNsConfig()
+	if err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
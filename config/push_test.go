@@ -0,0 +1,119 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+func TestParseVAPIDKeyPairs(t *testing.T) {
+	pairs, err := parseVAPIDKeyPairs(" pub1:priv1 , pub2:priv2,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VAPIDKeyPair{{"pub1", "priv1"}, {"pub2", "priv2"}}
+	if !slices.Equal(pairs, want) {
+		t.Errorf("parseVAPIDKeyPairs = %v, want %v", pairs, want)
+	}
+
+	for _, invalid := range []string{"pub1", "pub1:", ":priv1"} {
+		if _, err := parseVAPIDKeyPairs(invalid); err == nil {
+			t.Errorf("parseVAPIDKeyPairs(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestVAPIDKeysLookup(t *testing.T) {
+	keys := VAPIDKeys{
+		Active: VAPIDKeyPair{"active", "active-private"},
+		Legacy: []VAPIDKeyPair{{"old", "old-private"}},
+	}
+	if pair, ok := keys.Lookup("old"); !ok || pair.PrivateKey != "old-private" {
+		t.Errorf("Lookup(old) = %v, %v", pair, ok)
+	}
+	if pair, ok := keys.Lookup("active"); !ok || pair.PrivateKey != "active-private" {
+		t.Errorf("Lookup(active) = %v, %v", pair, ok)
+	}
+	if _, ok := keys.Lookup("unknown"); ok {
+		t.Error("Lookup(unknown) found a pair")
+	}
+}
+
+func TestVAPIDBackfillKey(t *testing.T) {
+	t.Setenv("VAPID_PUBLIC_KEY", "active")
+	t.Setenv("VAPID_PRIVATE_KEY", "active-private")
+
+	conf, err := getPushConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := conf.VAPIDKeys.BackfillKey(); err != nil || key != "active" {
+		t.Errorf("BackfillKey without rotation = %q, %v, want the active key", key, err)
+	}
+
+	t.Setenv("VAPID_LEGACY_KEYS", "old:old-private")
+	conf, err = getPushConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conf.VAPIDKeys.BackfillKey(); err == nil {
+		t.Error("BackfillKey after a rotation succeeded without VAPID_BACKFILL_PUBLIC_KEY")
+	}
+
+	t.Setenv("VAPID_BACKFILL_PUBLIC_KEY", "old")
+	conf, err = getPushConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := conf.VAPIDKeys.BackfillKey(); err != nil || key != "old" {
+		t.Errorf("BackfillKey = %q, %v, want old", key, err)
+	}
+
+	t.Setenv("VAPID_BACKFILL_PUBLIC_KEY", "unknown")
+	if _, err := getPushConfig(); err == nil || !strings.Contains(err.Error(), "VAPID_BACKFILL_PUBLIC_KEY") {
+		t.Errorf("getPushConfig with an unknown backfill key = %v, want an error", err)
+	}
+}
+
+func TestPushConfig(t *testing.T) {
+	t.Setenv("VAPID_PUBLIC_KEY", "active")
+	t.Setenv("VAPID_PRIVATE_KEY", "active-private")
+
+	conf, err := getPushConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Subscriber != "dev.shravan@proton.me" || conf.Urgency != webpush.UrgencyNormal || conf.DefaultTTL != 24*time.Hour {
+		t.Errorf("default push config = %+v", conf)
+	}
+
+	t.Setenv("VAPID_SUBSCRIBER", "mailto:push@everynyan.test")
+	t.Setenv("PUSH_URGENCY", "high")
+	t.Setenv("PUSH_DEFAULT_TTL", "1h")
+	conf, err = getPushConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Subscriber != "push@everynyan.test" || conf.Urgency != webpush.UrgencyHigh || conf.DefaultTTL != time.Hour {
+		t.Errorf("push config = %+v", conf)
+	}
+
+	for env, value := range map[string]string{
+		"VAPID_SUBSCRIBER":             "http://everynyan.test",
+		"PUSH_URGENCY":                 "urgent",
+		"PUSH_DEFAULT_TTL":             "a day",
+		"PUSH_MAX_CONCURRENT_PER_HOST": "0",
+		"PUSH_PROXY_URL":               "not a url",
+		"VAPID_LEGACY_KEYS":            "public-only",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := getPushConfig(); err == nil {
+				t.Errorf("%s=%q was accepted", env, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package config
+
+import "fmt"
+
+// what happens to a notification over its user's rate limit
+const (
+	RateLimitDrop     = "drop"
+	RateLimitDefer    = "defer"
+	RateLimitCollapse = "collapse"
+)
+
+// RateLimitConfig bounds how many notifications a user gets over each
+// channel and how many requests an API key makes to the admin API.
+type RateLimitConfig struct {
+	// UserRate is the notifications per minute a user gets over a channel,
+	// UserBurst how many of them can be sent at once
+	UserRate  float64
+	UserBurst int
+	// Policy is one of drop, defer or collapse
+	Policy string
+	// APIRate is the admin API requests per second of an API key
+	APIRate  float64
+	APIBurst int
+}
+
+func getRateLimitConfig() (RateLimitConfig, error) {
+	var conf RateLimitConfig
+	var err error
+
+	conf.UserRate, err = lookupPositiveFloat("RATE_LIMIT_USER_PER_MINUTE", 30)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.UserBurst, err = lookupPositiveInt("RATE_LIMIT_USER_BURST", 10)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.Policy = lookupEnvDefault("RATE_LIMIT_POLICY", RateLimitDrop)
+	switch conf.Policy {
+	case RateLimitDrop, RateLimitDefer, RateLimitCollapse:
+	default:
+		return conf, fmt.Errorf("RATE_LIMIT_POLICY must be one of drop, defer or collapse")
+	}
+
+	conf.APIRate, err = lookupPositiveFloat("RATE_LIMIT_API_PER_SECOND", 50)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.APIBurst, err = lookupPositiveInt("RATE_LIMIT_API_BURST", 100)
+	if err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
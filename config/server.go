@@ -0,0 +1,38 @@
+package config
+
+import "time"
+
+type ServerConfig struct {
+	// ShutdownDrainDelay is how long the server keeps serving, while
+	// reporting not ready, before it shuts down so that load balancers stop
+	// sending it traffic first
+	ShutdownDrainDelay time.Duration
+	// ShutdownTimeout bounds the time spent finishing requests and draining
+	// the queued deliveries once the server stops accepting connections
+	ShutdownTimeout time.Duration
+	// ReconnectWindow spreads the reconnects of the websocket clients which
+	// are told to go away on shutdown
+	ReconnectWindow time.Duration
+}
+
+func getServerConfig() (ServerConfig, error) {
+	var conf ServerConfig
+	var err error
+
+	conf.ShutdownDrainDelay, err = lookupDuration("SHUTDOWN_DRAIN_DELAY", 5*time.Second)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.ShutdownTimeout, err = lookupDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return conf, err
+	}
+
+	conf.ReconnectWindow, err = lookupDuration("WS_RECONNECT_WINDOW", 30*time.Second)
+	if err != nil {
+		return conf, err
+	}
+
+	return conf, nil
+}
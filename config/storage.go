@@ -0,0 +1,41 @@
+package config
+
+import "fmt"
+
+const (
+	StorageBolt     = "bolt"
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+)
+
+// StorageConfig selects the database holding subscriptions, preferences
+// and the other records of the service.
+type StorageConfig struct {
+	Backend string
+	// Path is the database file of the bolt and sqlite backends
+	Path string
+	// DatabaseURL is the connection string of the postgres backend
+	DatabaseURL string
+}
+
+func getStorageConfig() (StorageConfig, error) {
+	conf := StorageConfig{
+		Backend:     lookupEnvDefault("STORAGE_BACKEND", StorageBolt),
+		DatabaseURL: lookupEnvDefault("DATABASE_URL", ""),
+	}
+
+	switch conf.Backend {
+	case StorageBolt:
+		conf.Path = lookupEnvDefault("STORAGE_PATH", "./subscriptions.db")
+	case StorageSQLite:
+		conf.Path = lookupEnvDefault("STORAGE_PATH", "./everynyan.sqlite")
+	case StoragePostgres:
+		if conf.DatabaseURL == "" {
+			return conf, fmt.Errorf("DATABASE_URL must be set when STORAGE_BACKEND is postgres")
+		}
+	default:
+		return conf, fmt.Errorf("STORAGE_BACKEND must be one of bolt, sqlite or postgres")
+	}
+
+	return conf, nil
+}
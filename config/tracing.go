@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	TracesExporterNone    = "none"
+	TracesExporterOTLP    = "otlp"
+	TracesExporterConsole = "console"
+)
+
+// TracingConfig follows the OpenTelemetry environment variables, the OTLP
+// exporter reads its endpoint and headers from the OTEL_EXPORTER_OTLP_*
+// variables itself.
+type TracingConfig struct {
+	Exporter string
+	// SampleRatio is the fraction of traces started here which are sampled,
+	// traces started by the caller follow the caller's decision
+	SampleRatio float64
+}
+
+func getTracingConfig() (TracingConfig, error) {
+	conf := TracingConfig{
+		Exporter:    lookupEnvDefault("OTEL_TRACES_EXPORTER", TracesExporterNone),
+		SampleRatio: 1,
+	}
+
+	switch conf.Exporter {
+	case TracesExporterNone, TracesExporterOTLP, TracesExporterConsole:
+	default:
+		return conf, fmt.Errorf("OTEL_TRACES_EXPORTER must be one of none, otlp or console")
+	}
+
+	if value, set := os.LookupEnv("OTEL_TRACES_SAMPLER_ARG"); set {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return conf, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a number between 0 and 1")
+		}
+		conf.SampleRatio = ratio
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTracingConfig(t *testing.T) {
+	// t.Setenv restores the variables after the test
+	for _, env := range []string{"OTEL_TRACES_EXPORTER", "OTEL_TRACES_SAMPLER_ARG"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+
+	conf, err := getTracingConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Exporter != TracesExporterNone || conf.SampleRatio != 1 {
+		t.Errorf("default tracing config = %+v", conf)
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "0.25")
+	conf, err = getTracingConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Exporter != TracesExporterOTLP || conf.SampleRatio != 0.25 {
+		t.Errorf("tracing config = %+v", conf)
+	}
+
+	for env, value := range map[string]string{
+		"OTEL_TRACES_EXPORTER":    "jaeger",
+		"OTEL_TRACES_SAMPLER_ARG": "1.5",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := getTracingConfig(); err == nil {
+				t.Errorf("%s=%q was accepted", env, value)
+			}
+		})
+	}
+}
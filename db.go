@@ -5,89 +5,241 @@ import (
 	"errors"
 	"fmt"
 	"iter"
-	"log"
+	"log/slog"
+	"os"
 	"time"
 
-	"github.com/SherClockHolmes/webpush-go"
-	"github.com/boltdb/bolt"
+	"github.com/shravanasati/everynyan-notification-service/config"
 )
 
+// Storage holds the users' subscriptions and preferences, it is what the
+// delivery paths need from the database. storage implements it on top of
+// any Backend.
+type Storage interface {
+	AddSubscription(user string, sub StoredSubscription) error
+	GetSubscription(user string) (StoredSubscription, error)
+	RemoveSubscription(user string, sub StoredSubscription) (bool, error)
+	GetAllSubscriptions() iter.Seq2[string, StoredSubscription]
+
+	GetPreferences(user string) (UserPreferences, error)
+	SetPreferences(user string, prefs UserPreferences) error
+	UpdatePreferences(user string, fn func(prefs *UserPreferences)) (UserPreferences, error)
+}
 
 type storage struct {
-	db *bolt.DB
+	backend    Backend
 	bucketName []byte
 }
 
-func NewStorage(filename, bucketName string) *storage {
-	db, err := bolt.Open(filename, 0600, &bolt.Options{
-		Timeout: 1 * time.Second,
-	})
+// view and update run transactions on the backend, timing them for the
+// metrics
+func (s *storage) view(fn func(Tx) error) error {
+	defer storageTxDuration.ObserveSince(time.Now(), "read")
+	return s.backend.View(fn)
+}
 
+func (s *storage) update(fn func(Tx) error) error {
+	defer storageTxDuration.ObserveSince(time.Now(), "write")
+	return s.backend.Update(fn)
+}
+
+func NewStorage(conf config.StorageConfig, bucketName string) *storage {
+	backend, err := openBackend(conf)
 	if err != nil {
-		log.Fatalf("unable to open boltdb: %v", err)
+		slog.Error("unable to open storage", "backend", conf.Backend, "error", err)
+		os.Exit(1)
 	}
 
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		if err != nil {
-			return fmt.Errorf("create bucket: %v", err)
+	s, err := newStorage(backend, bucketName)
+	if err != nil {
+		slog.Error("unable to create storage buckets", "backend", conf.Backend, "error", err)
+		os.Exit(1)
+	}
+	return s
+}
+
+// newStorage creates the buckets of the service on the backend.
+func newStorage(backend Backend, bucketName string) (*storage, error) {
+	err := backend.Update(func(tx Tx) error {
+		buckets := [][]byte{[]byte(bucketName), preferencesBucket, outboxBucket, templatesBucket, emailOutboxBucket, unreadBucket, webhooksBucket, webhookDeliveriesBucket, metaBucket, quarantineBucket, broadcastsBucket}
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return fmt.Errorf("create bucket: %v", err)
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return &storage{db: db, bucketName: []byte(bucketName)}
+	return &storage{backend: backend, bucketName: []byte(bucketName)}, nil
 }
 
-func (s *storage) AddSubscription(user string, sub webpush.Subscription) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+func (s *storage) AddSubscription(user string, sub StoredSubscription) error {
+	return s.update(func(tx Tx) error {
 		b := tx.Bucket(s.bucketName)
 		err := b.Put([]byte(user), jsonify(sub))
 		return err
 	})
 }
 
-func getSubscriptionFromBytes(byteSlice []byte) webpush.Subscription {
-	var sub webpush.Subscription
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+func getSubscriptionFromBytes(byteSlice []byte) (StoredSubscription, error) {
+	var sub StoredSubscription
 	if err := json.Unmarshal(byteSlice, &sub); err != nil {
-		panic("unable to unmarshal byteslice into subscription")
+		return sub, fmt.Errorf("unable to unmarshal subscription: %w", err)
 	}
-	return sub
+	return sub, nil
 }
 
-func (s *storage) GetSubscription(user string) (webpush.Subscription, error) {
+// GetSubscription returns errSubscriptionNotFound if the user has no
+// subscription, and errCorruptRecord if it doesn't decode. A corrupt
+// subscription is quarantined.
+func (s *storage) GetSubscription(user string) (StoredSubscription, error) {
 	byteSlice := []byte{}
-	var emptySub webpush.Subscription
+	var emptySub StoredSubscription
 
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx Tx) error {
 		b := tx.Bucket(s.bucketName)
 		v := b.Get([]byte(user))
 		if v != nil {
 			byteSlice = append(byteSlice, v...)
 			return nil
 		}
-		return fmt.Errorf("not found")
+		return errSubscriptionNotFound
 	})
 	if err != nil {
 		return emptySub, err
 	}
 
-	return getSubscriptionFromBytes(byteSlice), nil
+	sub, err := getSubscriptionFromBytes(byteSlice)
+	if err != nil {
+		s.quarantine(newCorruptRecord(s.bucketName, []byte(user), byteSlice, err))
+		return emptySub, fmt.Errorf("%w: %w", errCorruptRecord, err)
+	}
+	return sub, nil
+}
+
+// RemoveSubscription deletes the user's subscription if it is still sub, it
+// reports whether it was deleted. A subscription the user registered in the
+// meantime is kept.
+func (s *storage) RemoveSubscription(user string, sub StoredSubscription) (bool, error) {
+	removed := false
+	err := s.update(func(tx Tx) error {
+		removed = false
+		b := tx.Bucket(s.bucketName)
+		v := b.Get([]byte(user))
+		if v == nil {
+			return nil
+		}
+
+		stored, err := getSubscriptionFromBytes(v)
+		if err != nil {
+			return quarantineTx(tx, newCorruptRecord(s.bucketName, []byte(user), v, err))
+		}
+		if stored.Endpoint != sub.Endpoint || stored.DeviceToken != sub.DeviceToken {
+			return nil
+		}
+		removed = true
+		return b.Delete([]byte(user))
+	})
+
+	return removed, err
 }
 
 var errIterationEnd = errors.New("iteration has ended")
 
-func (s *storage) GetAllSubscriptions() iter.Seq[webpush.Subscription] {
-	return func(yield func(webpush.Subscription) bool) {
-		s.db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(s.bucketName)
-			b.ForEach(func(k, v []byte) error {
-				if !yield(getSubscriptionFromBytes(v)) {
-					return errIterationEnd
-				}
+// subscriptionBatchSize is how many subscriptions are read per transaction
+// when iterating over all of them
+const subscriptionBatchSize = 500
+
+// UserSubscription is a subscription along with the user it belongs to.
+type UserSubscription struct {
+	User         string
+	Subscription StoredSubscription
+}
+
+// GetSubscriptionsPage reads up to limit subscriptions of the users after
+// the given one, in key order, within a single short transaction. It
+// returns the user to pass as after for the next page, which is empty once
+// the last page has been read.
+func (s *storage) GetSubscriptionsPage(after string, limit int) ([]UserSubscription, string, error) {
+	page := make([]UserSubscription, 0, limit)
+	next := ""
+	// corrupt subscriptions are skipped and quarantined after the read, the
+	// read transaction can't move them
+	corrupt := []corruptRecord{}
+
+	err := s.view(func(tx Tx) error {
+		c := tx.Bucket(s.bucketName).Cursor()
+
+		var k, v []byte
+		if after == "" {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+
+		read := 0
+		last := ""
+		for ; k != nil; k, v = c.Next() {
+			if read == limit {
+				next = last
 				return nil
-			})
+			}
+			read++
+			last = string(k)
+
+			sub, err := getSubscriptionFromBytes(v)
+			if err != nil {
+				corrupt = append(corrupt, newCorruptRecord(s.bucketName, k, v, err))
+				continue
+			}
+			page = append(page, UserSubscription{User: string(k), Subscription: sub})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
 
-			return nil
-		})
+	s.quarantine(corrupt...)
+	return page, next, nil
+}
+
+// SubscriptionsAfter iterates over the subscriptions of the users after the
+// given one in key order, a batch per transaction so that no transaction
+// stays open while the subscriptions are being handled. The last user
+// yielded is a checkpoint, iterating from it again resumes where the
+// iteration stopped.
+func (s *storage) SubscriptionsAfter(after string) iter.Seq2[string, StoredSubscription] {
+	return func(yield func(string, StoredSubscription) bool) {
+		for {
+			page, next, err := s.GetSubscriptionsPage(after, subscriptionBatchSize)
+			if err != nil {
+				slog.Error("unable to read subscriptions", "after", after, "error", err)
+				return
+			}
+
+			for _, us := range page {
+				if !yield(us.User, us.Subscription) {
+					return
+				}
+			}
+			if next == "" {
+				return
+			}
+			after = next
+		}
 	}
-}
\ No newline at end of file
+}
+
+func (s *storage) GetAllSubscriptions() iter.Seq2[string, StoredSubscription] {
+	return s.SubscriptionsAfter("")
+}
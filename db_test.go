@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func pageUsers(page []UserSubscription) []string {
+	users := []string{}
+	for _, us := range page {
+		users = append(users, us.User)
+	}
+	return users
+}
+
+func TestGetSubscriptionsPage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		s := newTestStorage(t, backend)
+		for _, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+			s.AddSubscription(user, StoredSubscription{Provider: ProviderFCM, DeviceToken: user + "-device"})
+		}
+
+		page, next, err := s.GetSubscriptionsPage("", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(pageUsers(page), []string{"alice", "bob"}) || next != "bob" {
+			t.Errorf("first page = %v, next %q", pageUsers(page), next)
+		}
+		if page[0].Subscription.DeviceToken != "alice-device" {
+			t.Errorf("subscription = %+v", page[0].Subscription)
+		}
+
+		page, next, _ = s.GetSubscriptionsPage(next, 2)
+		if !slices.Equal(pageUsers(page), []string{"carol", "dave"}) || next != "dave" {
+			t.Errorf("second page = %v, next %q", pageUsers(page), next)
+		}
+
+		// a page ending on the last user is the last one
+		page, next, _ = s.GetSubscriptionsPage("carol", 2)
+		if !slices.Equal(pageUsers(page), []string{"dave", "erin"}) || next != "" {
+			t.Errorf("last page = %v, next %q", pageUsers(page), next)
+		}
+
+		// after needn't be a stored user
+		page, next, _ = s.GetSubscriptionsPage("bz", 10)
+		if !slices.Equal(pageUsers(page), []string{"carol", "dave", "erin"}) || next != "" {
+			t.Errorf("page after a missing user = %v, next %q", pageUsers(page), next)
+		}
+
+		page, next, _ = s.GetSubscriptionsPage("erin", 10)
+		if len(page) != 0 || next != "" {
+			t.Errorf("page after the last user = %v, next %q", pageUsers(page), next)
+		}
+	})
+}
+
+func TestGetSubscriptionsPageSkipsCorrupt(t *testing.T) {
+	s := newTestBoltStorage(t)
+	s.AddSubscription("alice", StoredSubscription{Provider: ProviderFCM, DeviceToken: "alice-device"})
+	putCorruptSubscription(t, s, "bob")
+	putCorruptSubscription(t, s, "carol")
+	s.AddSubscription("dave", StoredSubscription{Provider: ProviderFCM, DeviceToken: "dave-device"})
+
+	// the corrupt records count towards the limit, so that a page can be
+	// empty while there are more to read
+	page, next, err := s.GetSubscriptionsPage("alice", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 || next != "carol" {
+		t.Errorf("page of corrupt records = %v, next %q", pageUsers(page), next)
+	}
+	if records, _ := s.GetQuarantinedRecords(); len(records) != 2 {
+		t.Errorf("%d quarantined records, want 2", len(records))
+	}
+
+	page, next, _ = s.GetSubscriptionsPage(next, 2)
+	if !slices.Equal(pageUsers(page), []string{"dave"}) || next != "" {
+		t.Errorf("page after the corrupt records = %v, next %q", pageUsers(page), next)
+	}
+}
+
+func TestSubscriptionsAfter(t *testing.T) {
+	s := newTestBoltStorage(t)
+	want := []string{}
+	for i := range subscriptionBatchSize*2 + 1 {
+		user := fmt.Sprintf("user-%04d", i)
+		s.AddSubscription(user, StoredSubscription{Provider: ProviderFCM, DeviceToken: user})
+		want = append(want, user)
+	}
+	putCorruptSubscription(t, s, fmt.Sprintf("user-%04d", subscriptionBatchSize))
+	want = slices.Delete(want, subscriptionBatchSize, subscriptionBatchSize+1)
+
+	users := []string{}
+	for user := range s.GetAllSubscriptions() {
+		users = append(users, user)
+	}
+	if !slices.Equal(users, want) {
+		t.Errorf("iterated over %d users, want %d", len(users), len(want))
+	}
+
+	// resuming from a checkpoint
+	users = users[:0]
+	for user := range s.SubscriptionsAfter(want[10]) {
+		users = append(users, user)
+		if len(users) == 3 {
+			break
+		}
+	}
+	if !slices.Equal(users, want[11:14]) {
+		t.Errorf("users after %s = %v", want[10], users)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+const (
+	ChannelWebsocket = "websocket"
+	ChannelPush      = "push"
+	ChannelEmail     = "email"
+)
+
+// DeliveryResult is the outcome of delivering a notification to a user over
+// one channel.
+type DeliveryResult struct {
+	User       string            `json:"user,omitempty"`
+	Channel    string            `json:"channel"`
+	Delivered  bool              `json:"delivered"`
+	StatusCode int               `json:"statusCode,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Truncation PayloadTruncation `json:"truncation,omitempty"`
+}
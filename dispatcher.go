@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+const (
+	dispatcherWorkers = 64
+	// dispatcherCapacity bounds the queued jobs, past it Submit rejects new
+	// ones rather than letting the queue grow until the process runs out of
+	// memory
+	dispatcherCapacity = 100000
+)
+
+// priorityRank orders the notification priorities, higher runs first.
+var priorityRank = map[string]int{
+	PriorityLow:      0,
+	PriorityNormal:   1,
+	PriorityHigh:     2,
+	PriorityCritical: 3,
+}
+
+type dispatchJob struct {
+	rank int
+	seq  uint64
+	run  func()
+}
+
+// jobQueue is a max-heap on the job rank, jobs of the same rank are run in
+// the order they were submitted.
+type jobQueue []*dispatchJob
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank > q[j].rank
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jobQueue) Push(x any) { *q = append(*q, x.(*dispatchJob)) }
+
+func (q *jobQueue) Pop() any {
+	old := *q
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return job
+}
+
+// Dispatcher runs delivery work on a fixed pool of workers, picking the
+// highest priority job first so that critical notifications jump ahead of
+// a large broadcast.
+type Dispatcher struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// room is signalled when a job leaves a full queue
+	room     *sync.Cond
+	queue    jobQueue
+	capacity int
+	seq      uint64
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// DispatchJob is a job for SubmitAll.
+type DispatchJob struct {
+	Priority string
+	Run      func()
+}
+
+func NewDispatcher(workers, capacity int) *Dispatcher {
+	d := &Dispatcher{capacity: capacity}
+	d.cond = sync.NewCond(&d.mu)
+	d.room = sync.NewCond(&d.mu)
+
+	d.wg.Add(workers)
+	for range workers {
+		go d.work()
+	}
+
+	return d
+}
+
+// Submit queues the job, it reports false if the dispatcher is draining and
+// no longer accepts jobs or if its queue is full.
+func (d *Dispatcher) Submit(priority string, job func()) bool {
+	return d.SubmitAll([]DispatchJob{{Priority: priority, Run: job}})
+}
+
+// SubmitAll queues either all of the jobs or, if they don't fit in the
+// queue, none of them.
+func (d *Dispatcher) SubmitAll(jobs []DispatchJob) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed || d.queue.Len()+len(jobs) > d.capacity {
+		return false
+	}
+	for _, job := range jobs {
+		d.push(job.Priority, job.Run)
+	}
+	return true
+}
+
+// SubmitWait queues the job like Submit, but waits for room in the queue
+// instead of rejecting the job. It is for the producers which can slow
+// down, like broadcasts. It gives up once ctx is done.
+func (d *Dispatcher) SubmitWait(ctx context.Context, priority string, job func()) bool {
+	stop := context.AfterFunc(ctx, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.room.Broadcast()
+	})
+	defer stop()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for !d.closed && ctx.Err() == nil && d.queue.Len() >= d.capacity {
+		d.room.Wait()
+	}
+	if d.closed || ctx.Err() != nil {
+		return false
+	}
+	d.push(priority, job)
+	return true
+}
+
+func (d *Dispatcher) push(priority string, job func()) {
+	d.seq++
+	heap.Push(&d.queue, &dispatchJob{rank: priorityRank[priority], seq: d.seq, run: job})
+	d.cond.Signal()
+}
+
+func (d *Dispatcher) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.queue.Len()
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		d.mu.Lock()
+		for d.queue.Len() == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.queue.Len() == 0 {
+			d.mu.Unlock()
+			return
+		}
+		job := heap.Pop(&d.queue).(*dispatchJob)
+		d.room.Signal()
+		d.mu.Unlock()
+
+		job.run()
+	}
+}
+
+// Close stops accepting new jobs and waits for the queued ones to finish.
+func (d *Dispatcher) Close() {
+	d.Drain(context.Background())
+}
+
+// Drain stops accepting new jobs and waits for the queued ones to finish,
+// giving up once ctx is done. It returns how many jobs were left queued.
+func (d *Dispatcher) Drain(ctx context.Context) int {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.room.Broadcast()
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return d.Len()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// blockWorkers occupies every worker of d until the returned function is
+// called.
+func blockWorkers(t *testing.T, d *Dispatcher, workers int) func() {
+	t.Helper()
+	release := make(chan struct{})
+	started := make(chan struct{}, workers)
+	for range workers {
+		d.Submit(PriorityCritical, func() {
+			started <- struct{}{}
+			<-release
+		})
+	}
+	for range workers {
+		<-started
+	}
+	return func() { close(release) }
+}
+
+func TestDispatcherPriorityOrder(t *testing.T) {
+	d := NewDispatcher(1, 10)
+	release := blockWorkers(t, d, 1)
+
+	ran := make(chan string, 5)
+	for _, p := range []string{PriorityLow, PriorityNormal, PriorityCritical, PriorityNormal, PriorityHigh} {
+		p := p
+		d.Submit(p, func() { ran <- p })
+	}
+	release()
+	d.Close()
+	close(ran)
+
+	var got []string
+	for p := range ran {
+		got = append(got, p)
+	}
+	want := []string{PriorityCritical, PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow}
+	if !slices.Equal(got, want) {
+		t.Errorf("jobs ran in the order %v, want %v", got, want)
+	}
+}
+
+func TestDispatcherCapacity(t *testing.T) {
+	d := NewDispatcher(1, 2)
+	release := blockWorkers(t, d, 1)
+	defer d.Close()
+	defer release()
+
+	noop := func() {}
+	if !d.Submit(PriorityNormal, noop) {
+		t.Fatal("Submit to a queue with room = false")
+	}
+	if d.SubmitAll([]DispatchJob{{PriorityNormal, noop}, {PriorityNormal, noop}}) {
+		t.Error("SubmitAll of more jobs than there is room for = true")
+	}
+	if d.Len() != 1 {
+		t.Errorf("queue holds %d jobs after a rejected SubmitAll, want 1", d.Len())
+	}
+	if !d.Submit(PriorityNormal, noop) {
+		t.Fatal("Submit of the last job which fits = false")
+	}
+	if d.Submit(PriorityCritical, noop) {
+		t.Error("Submit to a full queue = true")
+	}
+
+	// SubmitWait gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if d.SubmitWait(ctx, PriorityNormal, noop) {
+		t.Error("SubmitWait to a full queue returned true before its context ended")
+	}
+}
+
+func TestDispatcherSubmitWait(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	release := blockWorkers(t, d, 1)
+	d.Submit(PriorityNormal, func() {})
+
+	done := make(chan bool)
+	go func() {
+		done <- d.SubmitWait(context.Background(), PriorityNormal, func() {})
+	}()
+	select {
+	case <-done:
+		t.Fatal("SubmitWait returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	if !<-done {
+		t.Error("SubmitWait = false once the queue had room")
+	}
+
+	d.Close()
+	if d.Submit(PriorityNormal, func() {}) || d.SubmitWait(context.Background(), PriorityNormal, func() {}) {
+		t.Error("a closed dispatcher accepted a job")
+	}
+}
+
+func TestDispatcherDrain(t *testing.T) {
+	d := NewDispatcher(1, 10)
+	ran := 0
+	for range 3 {
+		d.Submit(PriorityNormal, func() {
+			time.Sleep(10 * time.Millisecond)
+			ran++
+		})
+	}
+	if left := d.Drain(context.Background()); left != 0 || ran != 3 {
+		t.Errorf("Drain left %d jobs, ran %d, want every job run", left, ran)
+	}
+	if d.Submit(PriorityNormal, func() {}) {
+		t.Error("a drained dispatcher accepted a job")
+	}
+
+	// a drain which times out reports the jobs it left behind
+	d = NewDispatcher(1, 10)
+	release := blockWorkers(t, d, 1)
+	defer release()
+	d.Submit(PriorityNormal, func() {})
+	d.Submit(PriorityNormal, func() {})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if left := d.Drain(ctx); left != 2 {
+		t.Errorf("Drain left %d jobs, want 2", left)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+)
+
+var unreadBucket = []byte("unread")
+var emailOutboxBucket = []byte("email_outbox")
+
+// an email which fails for a temporary reason is retried after
+// emailRetryBackoff, doubled for every further attempt
+const (
+	emailMaxAttempts  = 5
+	emailRetryBackoff = time.Minute
+)
+
+//go:embed email_templates
+var emailTemplatesFS embed.FS
+
+var emailHTMLTemplate = htmltemplate.Must(htmltemplate.ParseFS(emailTemplatesFS, "email_templates/notification.html"))
+var emailTextTemplate = texttemplate.Must(texttemplate.ParseFS(emailTemplatesFS, "email_templates/notification.txt"))
+
+var errInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+// EmailPreferences decide whether notifications which stay unread are
+// emailed to the user.
+type EmailPreferences struct {
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+}
+
+type emailData struct {
+	Title          string
+	Description    string
+	Link           string
+	UnsubscribeURL string
+}
+
+// emailSender delivers notification emails over SMTP.
+type emailSender struct {
+	conf config.EmailConfig
+	auth smtp.Auth
+}
+
+func newEmailSender(conf config.EmailConfig) *emailSender {
+	sender := &emailSender{conf: conf}
+	if conf.Username != "" {
+		sender.auth = smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)
+	}
+	return sender
+}
+
+// unsubscribeToken encrypts the user with the secret key, the user is their
+// session token so it must not appear in a link as is. GCM authenticates the
+// token so that it can only have been issued by us.
+func unsubscribeToken(user string) (string, error) {
+	block, err := aes.NewCipher(conf.SecretKey)
+	if err != nil {
+		return "", err
+	}
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aesGCM.Seal(nonce, nonce, []byte("unsubscribe:"+user), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// parseUnsubscribeToken validates an unsubscribe token and returns the user
+// it was issued for.
+func parseUnsubscribeToken(token string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errInvalidUnsubscribeToken
+	}
+
+	block, err := aes.NewCipher(conf.SecretKey)
+	if err != nil {
+		return "", err
+	}
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aesGCM.NonceSize() {
+		return "", errInvalidUnsubscribeToken
+	}
+
+	nonce, ciphertext := sealed[:aesGCM.NonceSize()], sealed[aesGCM.NonceSize():]
+	plainText, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errInvalidUnsubscribeToken
+	}
+
+	user, found := strings.CutPrefix(string(plainText), "unsubscribe:")
+	if !found || user == "" {
+		return "", errInvalidUnsubscribeToken
+	}
+	return user, nil
+}
+
+func (sender *emailSender) absoluteLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return sender.conf.SiteURL.String()
+	}
+	return sender.conf.SiteURL.ResolveReference(u).String()
+}
+
+// buildMessage renders the notification as a multipart/alternative email
+// with a text and an HTML part.
+func (sender *emailSender) buildMessage(to string, notif NotificationRequest, unsubscribeURL string) ([]byte, error) {
+	data := emailData{
+		Title:          notif.Title,
+		Description:    notif.Description,
+		Link:           sender.absoluteLink(notif.Link),
+		UnsubscribeURL: unsubscribeURL,
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, part := range []struct {
+		contentType string
+		execute     func(*bytes.Buffer) error
+	}{
+		{"text/plain", func(b *bytes.Buffer) error { return emailTextTemplate.Execute(b, data) }},
+		{"text/html", func(b *bytes.Buffer) error { return emailHTMLTemplate.Execute(b, data) }},
+	} {
+		var rendered bytes.Buffer
+		if err := part.execute(&rendered); err != nil {
+			return nil, err
+		}
+
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write(rendered.Bytes())
+		qp.Close()
+	}
+	parts.Close()
+
+	var msg bytes.Buffer
+	headers := []string{
+		"From: " + sender.conf.From,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", notif.Title),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"List-Unsubscribe: <" + unsubscribeURL + ">",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+		"Content-Type: multipart/alternative; boundary=" + parts.Boundary(),
+	}
+	msg.WriteString(strings.Join(headers, "\r\n"))
+	msg.WriteString("\r\n\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// sendMail is smtp.SendMail with a deadline, a server which stops answering
+// would otherwise hold the delivery forever.
+func (sender *emailSender) sendMail(to string, msg []byte) error {
+	dialer := net.Dialer{Timeout: sender.conf.Timeout}
+	conn, err := dialer.Dial("tcp", sender.conf.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(sender.conf.Timeout)); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, sender.conf.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: sender.conf.Host}); err != nil {
+			return err
+		}
+	}
+	if sender.auth != nil {
+		if err := client.Auth(sender.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sender.conf.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (sender *emailSender) Send(user, to string, notif NotificationRequest) DeliveryResult {
+	result := DeliveryResult{User: user, Channel: ChannelEmail}
+
+	token, err := unsubscribeToken(user)
+	if err != nil {
+		result.Error = "unable to create unsubscribe token: " + err.Error()
+		return result
+	}
+	unsubscribeURL := sender.conf.PublicURL + "/unsubscribe?token=" + token
+
+	msg, err := sender.buildMessage(to, notif, unsubscribeURL)
+	if err != nil {
+		result.Error = "unable to build email: " + err.Error()
+		return result
+	}
+
+	err = sender.sendMail(to, msg)
+	if err != nil {
+		result.Error = err.Error()
+		var smtpErr *textproto.Error
+		if errors.As(err, &smtpErr) {
+			result.StatusCode = smtpErr.Code
+		}
+		return result
+	}
+
+	result.Delivered = true
+	return result
+}
+
+// scheduleEmail records the notification as unread and defers an email for
+// it, if the user wants emails at all. Emails over the user's rate limit are
+// scheduled for once it allows them.
+func scheduleEmail(ctx context.Context, storage *storage, emailOutbox *Outbox, throttle *Throttle, notif NotificationRequest) {
+	prefs, err := storage.GetPreferences(notif.User)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to get user preferences", "user", notif.User, "error", err)
+		return
+	}
+	if prefs.Email == nil || !prefs.Email.Enabled || prefs.Email.Address == "" {
+		return
+	}
+
+	schedule := func(notif NotificationRequest, at time.Time) {
+		if err := storage.AddUnread(notif.ID, notif.User); err != nil {
+			slog.ErrorContext(ctx, "unable to record unread notification", "user", notif.User, "error", err)
+			return
+		}
+		if err := emailOutbox.Defer(notif, at.Add(conf.Email.Delay)); err != nil {
+			slog.ErrorContext(ctx, "unable to schedule notification email", "user", notif.User, "error", err)
+		}
+	}
+	if throttle.Admit(ctx, ChannelEmail, notif, schedule) {
+		schedule(notif, time.Now())
+	}
+}
+
+// emailIfUnread is run once the email delay has passed, it emails the
+// notification unless it has been read in the meantime or the user has
+// turned emails off. The notification stays unread until the email is
+// sent, an email which fails with anything but a permanent SMTP error (5xx)
+// is deferred through the outbox again with backoff.
+func emailIfUnread(ctx context.Context, storage *storage, emailOutbox *Outbox, sender *emailSender, notif NotificationRequest) {
+	unread, err := storage.IsUnread(notif.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to check unread notification", "user", notif.User, "error", err)
+		return
+	}
+	if !unread {
+		return
+	}
+
+	forget := func() {
+		if _, err := storage.TakeUnread(notif.ID); err != nil {
+			slog.ErrorContext(ctx, "unable to forget unread notification", "user", notif.User, "error", err)
+		}
+	}
+
+	prefs, err := storage.GetPreferences(notif.User)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to get user preferences", "user", notif.User, "error", err)
+		return
+	}
+	if prefs.Email == nil || !prefs.Email.Enabled || prefs.Email.Address == "" {
+		forget()
+		return
+	}
+
+	result := sender.Send(notif.User, prefs.Email.Address, notif)
+	if !result.Delivered {
+		notif.EmailAttempts++
+		if result.StatusCode < 500 && notif.EmailAttempts < emailMaxAttempts {
+			retryAt := time.Now().Add(emailRetryBackoff << (notif.EmailAttempts - 1))
+			err := emailOutbox.Defer(notif, retryAt)
+			if err == nil {
+				slog.WarnContext(ctx, "notification email not delivered, retrying", "user", notif.User, "error", result.Error, "attempt", notif.EmailAttempts, "retry_at", retryAt)
+				notificationsTotal.Inc(ChannelEmail, OutcomeDeferred)
+				return
+			}
+			slog.ErrorContext(ctx, "unable to defer notification email retry", "user", notif.User, "error", err)
+		}
+
+		slog.WarnContext(ctx, "notification email not delivered", "user", notif.User, "error", result.Error, "attempts", notif.EmailAttempts)
+		notificationsTotal.Inc(ChannelEmail, OutcomeFailed)
+		forget()
+		return
+	}
+
+	forget()
+	notificationsTotal.Inc(ChannelEmail, OutcomeDelivered)
+	events.Publish(Event{
+		Type:           EventNotificationDelivered,
+		User:           notif.User,
+		NotificationID: notif.ID,
+		Channel:        ChannelEmail,
+	})
+}
+
+// markRead records that the user read the notification, so that it is not
+// emailed to them.
+func markRead(ctx context.Context, storage *storage, id, user string) error {
+	if _, err := storage.MarkRead(id, user); err != nil {
+		slog.ErrorContext(ctx, "unable to mark notification as read", "user", user, "error", err)
+		return err
+	}
+	events.Publish(Event{Type: EventNotificationRead, User: user, NotificationID: id})
+	return nil
+}
+
+// Unsubscribe turns emails off for the user the token was issued for.
+func (s *storage) Unsubscribe(token string) error {
+	user, err := parseUnsubscribeToken(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.UpdatePreferences(user, func(prefs *UserPreferences) {
+		if prefs.Email != nil {
+			prefs.Email.Enabled = false
+		}
+	})
+	return err
+}
+
+func (s *storage) AddUnread(id, user string) error {
+	return s.update(func(tx Tx) error {
+		return tx.Bucket(unreadBucket).Put([]byte(id), []byte(user))
+	})
+}
+
+// MarkRead records that the user has read the notification, it returns
+// false if the notification wasn't being tracked as unread for the user.
+func (s *storage) MarkRead(id, user string) (bool, error) {
+	found := false
+	err := s.update(func(tx Tx) error {
+		found = false
+		b := tx.Bucket(unreadBucket)
+		v := b.Get([]byte(id))
+		if v == nil || string(v) != user {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(id))
+	})
+
+	return found, err
+}
+
+// IsUnread reports whether the notification is still tracked as unread.
+func (s *storage) IsUnread(id string) (bool, error) {
+	found := false
+	err := s.view(func(tx Tx) error {
+		found = tx.Bucket(unreadBucket).Get([]byte(id)) != nil
+		return nil
+	})
+
+	return found, err
+}
+
+// TakeUnread removes the notification from the unread ones, reporting
+// whether it was still unread.
+func (s *storage) TakeUnread(id string) (bool, error) {
+	found := false
+	err := s.update(func(tx Tx) error {
+		found = false
+		b := tx.Bucket(unreadBucket)
+		if b.Get([]byte(id)) == nil {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(id))
+	})
+
+	return found, err
+}
+
+func unsubscribePage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html><html><body style=\"font-family: sans-serif;\"><p>%s</p></body></html>", htmltemplate.HTMLEscapeString(message))
+}
+
+var unsubscribeConfirmTemplate = htmltemplate.Must(htmltemplate.New("unsubscribe").Parse(`<!DOCTYPE html><html><body style="font-family: sans-serif;">
+<p>Stop receiving notification emails?</p>
+<form method="post" action="/unsubscribe?token={{.}}"><button type="submit">Unsubscribe</button></form>
+</body></html>`))
+
+// unsubscribeConfirmPage asks the user to confirm with a form which posts
+// the token back.
+func unsubscribeConfirmPage(w http.ResponseWriter, token string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	unsubscribeConfirmTemplate.Execute(w, token)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	token, err := unsubscribeToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, "alice") {
+		t.Errorf("token %q contains the user", token)
+	}
+	user, err := parseUnsubscribeToken(token)
+	if err != nil || user != "alice" {
+		t.Errorf("parseUnsubscribeToken = %q, %v, want alice", user, err)
+	}
+
+	for _, invalid := range []string{"", "not base64!", token[:len(token)-2] + "AA"} {
+		if _, err := parseUnsubscribeToken(invalid); err != errInvalidUnsubscribeToken {
+			t.Errorf("parseUnsubscribeToken(%q) = %v, want errInvalidUnsubscribeToken", invalid, err)
+		}
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storage.SetPreferences("alice", UserPreferences{
+		Locale: "en",
+		Email:  &EmailPreferences{Address: "alice@example.com", Enabled: true},
+	})
+
+	token, _ := unsubscribeToken("alice")
+	if err := storage.Unsubscribe(token); err != nil {
+		t.Fatal(err)
+	}
+	prefs, _ := storage.GetPreferences("alice")
+	if prefs.Email == nil || prefs.Email.Enabled || prefs.Locale != "en" {
+		t.Errorf("preferences after unsubscribing = %+v", prefs)
+	}
+}
+
+// the confirmation page must not unsubscribe by itself, its form posts the
+// token back
+func TestUnsubscribeConfirmPage(t *testing.T) {
+	token, _ := unsubscribeToken("alice")
+	w := httptest.NewRecorder()
+	unsubscribeConfirmPage(w, token)
+
+	body := w.Body.String()
+	if !strings.Contains(body, `method="post"`) || !strings.Contains(body, "/unsubscribe?token="+token) {
+		t.Errorf("confirmation page = %s", body)
+	}
+}
+
+// fakeSMTPServer accepts one mail per connection and sends what it received
+// on the channel, it answers nothing at all when silent is set.
+func fakeSMTPServer(t *testing.T, silent bool) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, silent, received)
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func serveFakeSMTP(conn net.Conn, silent bool, received chan<- string) {
+	defer conn.Close()
+	if silent {
+		// hold the connection open without a greeting
+		conn.Read(make([]byte, 1))
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+
+	var mail strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		mail.WriteString(line)
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250 localhost")
+		case command == "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				mail.WriteString(line)
+			}
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			received <- mail.String()
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func newTestEmailSender(t *testing.T, addr string) *emailSender {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	conf := config.EmailConfig{
+		Host:      host,
+		From:      "notifications@everynyan.test",
+		Timeout:   time.Second,
+		PublicURL: "https://notifications.everynyan.test",
+		SiteURL:   &url.URL{Scheme: "https", Host: "everynyan.test"},
+	}
+	conf.Port, _ = strconv.Atoi(port)
+	return newEmailSender(conf)
+}
+
+func TestEmailSend(t *testing.T) {
+	addr, received := fakeSMTPServer(t, false)
+	sender := newTestEmailSender(t, addr)
+
+	result := sender.Send("alice", "alice@example.com", NotificationRequest{Title: "New reply", Description: "someone replied", Link: "/posts/1"})
+	if !result.Delivered {
+		t.Fatalf("Send = %+v, want delivered", result)
+	}
+
+	mail := <-received
+	for _, want := range []string{
+		"MAIL FROM:<notifications@everynyan.test>",
+		"RCPT TO:<alice@example.com>",
+		"List-Unsubscribe: <https://notifications.everynyan.test/unsubscribe?token=",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+		"https://everynyan.test/posts/1",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail does not contain %q:\n%s", want, mail)
+		}
+	}
+}
+
+func TestEmailSendTimeout(t *testing.T) {
+	addr, _ := fakeSMTPServer(t, true)
+	sender := newTestEmailSender(t, addr)
+
+	start := time.Now()
+	result := sender.Send("alice", "alice@example.com", NotificationRequest{Title: "New reply"})
+	if result.Delivered || result.Error == "" {
+		t.Errorf("Send to a server which doesn't answer = %+v, want an error", result)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send took %v, want it to give up after the timeout", elapsed)
+	}
+}
+
+// rejectingSMTPServer answers every recipient with reply.
+func rejectingSMTPServer(t *testing.T, reply string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("220 localhost ESMTP\r\n"))
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(line); {
+					case strings.HasPrefix(command, "RCPT"):
+						conn.Write([]byte(reply + "\r\n"))
+					case strings.HasPrefix(command, "QUIT"):
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("250 ok\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// emailOutboxEntries decodes the entries of the email outbox.
+func emailOutboxEntries(t *testing.T, storage *storage) []outboxEntry {
+	t.Helper()
+	entries := []outboxEntry{}
+	err := storage.view(func(tx Tx) error {
+		return tx.Bucket(emailOutboxBucket).ForEach(func(k, v []byte) error {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestEmailIfUnread(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storage.SetPreferences("alice", UserPreferences{Email: &EmailPreferences{Address: "alice@example.com", Enabled: true}})
+	emailOutbox := NewOutbox(storage, emailOutboxBucket, nil)
+	ctx := context.Background()
+	notif := NotificationRequest{ID: "n1", User: "alice", Title: "New reply"}
+	storage.AddUnread(notif.ID, notif.User)
+
+	// a temporary failure keeps the notification unread and retries it
+	sender := newTestEmailSender(t, rejectingSMTPServer(t, "451 try again later"))
+	start := time.Now()
+	emailIfUnread(ctx, storage, emailOutbox, sender, notif)
+	if unread, _ := storage.IsUnread(notif.ID); !unread {
+		t.Error("notification no longer unread after a temporary failure")
+	}
+	entries := emailOutboxEntries(t, storage)
+	if len(entries) != 1 || entries[0].Notification.EmailAttempts != 1 {
+		t.Fatalf("email outbox = %+v, want a retry", entries)
+	}
+	if retryIn := entries[0].DueAt.Sub(start); retryIn < emailRetryBackoff || retryIn > emailRetryBackoff+time.Second {
+		t.Errorf("retried in %v, want %v", retryIn, emailRetryBackoff)
+	}
+
+	// the last attempt gives up
+	notif.EmailAttempts = emailMaxAttempts - 1
+	emailIfUnread(ctx, storage, emailOutbox, sender, notif)
+	if unread, _ := storage.IsUnread(notif.ID); unread {
+		t.Error("notification still unread after the last attempt")
+	}
+	if entries := emailOutboxEntries(t, storage); len(entries) != 1 {
+		t.Errorf("%d emails in the outbox, want no further retry", len(entries))
+	}
+
+	// permanent failures aren't retried
+	storage.AddUnread(notif.ID, notif.User)
+	notif.EmailAttempts = 0
+	emailIfUnread(ctx, storage, emailOutbox, newTestEmailSender(t, rejectingSMTPServer(t, "550 no such user")), notif)
+	if unread, _ := storage.IsUnread(notif.ID); unread {
+		t.Error("notification still unread after a permanent failure")
+	}
+	if entries := emailOutboxEntries(t, storage); len(entries) != 1 {
+		t.Errorf("%d emails in the outbox, want no retry of a permanent failure", len(entries))
+	}
+
+	storage.AddUnread(notif.ID, notif.User)
+	addr, received := fakeSMTPServer(t, false)
+	emailIfUnread(ctx, storage, emailOutbox, newTestEmailSender(t, addr), notif)
+	<-received
+	if unread, _ := storage.IsUnread(notif.ID); unread {
+		t.Error("notification still unread after it was emailed")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// event types published on the event hub
+const (
+	EventNotificationDelivered = "notification.delivered"
+	EventNotificationRead      = "notification.read"
+	EventPushFailed            = "push.failed"
+	EventSubscriptionPruned    = "subscription.pruned"
+	EventUserConnected         = "user.connected"
+	EventUserDisconnected      = "user.disconnected"
+)
+
+var eventTypes = []string{
+	EventNotificationDelivered,
+	EventNotificationRead,
+	EventPushFailed,
+	EventSubscriptionPruned,
+	EventUserConnected,
+	EventUserDisconnected,
+}
+
+// Event is something which happened to a user's notifications or
+// connections, it is passed on to the webhooks.
+type Event struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	User           string    `json:"user"`
+	NotificationID string    `json:"notificationId,omitempty"`
+	Channel        string    `json:"channel,omitempty"`
+	StatusCode     int       `json:"statusCode,omitempty"`
+	Error          string    `json:"error,omitempty"`
+
+	// Remote events happened on another instance and came over the bus
+	Remote bool `json:"-"`
+}
+
+// EventHub fans events out to its subscribers. Publishing never blocks, a
+// subscriber which doesn't keep up misses events.
+type EventHub struct {
+	subscribers map[chan Event]struct{}
+	mu          sync.Mutex
+}
+
+var events = NewEventHub()
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on
+// and a function which unsubscribes and closes it.
+func (hub *EventHub) Subscribe(buffer int) (<-chan Event, func()) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ch := make(chan Event, buffer)
+	hub.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			hub.mu.Lock()
+			defer hub.mu.Unlock()
+
+			delete(hub.subscribers, ch)
+			close(ch)
+		})
+	}
+}
+
+// Publish stamps the event with an ID and the time and hands it to the
+// subscribers, it returns the stamped event.
+func (hub *EventHub) Publish(event Event) Event {
+	event.ID = newID()
+	event.Time = time.Now().UTC()
+	hub.Forward(event)
+	return event
+}
+
+// Forward hands an event which has already been published elsewhere to the
+// subscribers as is.
+func (hub *EventHub) Forward(event Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("event subscriber is falling behind, dropping event", "type", event.Type)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+	// the dispatcher is considered saturated, and the instance not ready
+	// for more work, above this many queued jobs
+	dispatcherSaturation = 50000
+)
+
+// shuttingDown is set as soon as a graceful shutdown starts, from then on
+// the instance reports not ready
+var shuttingDown atomic.Bool
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// runHealthChecks runs the checks concurrently, each with its own timeout,
+// and returns the outcome of each of them.
+func runHealthChecks(ctx context.Context, checks []healthCheck) (bool, map[string]string) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	healthy := true
+	results := make(map[string]string, len(checks))
+
+	for _, hc := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			errCh := make(chan error, 1)
+			go func() { errCh <- hc.check(ctx) }()
+
+			var err error
+			select {
+			case err = <-errCh:
+			case <-ctx.Done():
+				err = fmt.Errorf("timed out after %v", healthCheckTimeout)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				healthy = false
+				results[hc.name] = err.Error()
+			} else {
+				results[hc.name] = "ok"
+			}
+		}()
+	}
+
+	wg.Wait()
+	return healthy, results
+}
+
+// Ping checks that the database answers.
+func (s *storage) Ping(ctx context.Context) error {
+	return s.backend.Ping(ctx)
+}
+
+// pingTokenStore checks that firestore answers, the document doesn't exist
+// so not found is the expected answer.
+func pingTokenStore(ctx context.Context) error {
+	_, err := firestoreClient.Collection("tokens").Doc("__readyz__").Get(ctx)
+	if err != nil && status.Code(err) != grpccodes.NotFound {
+		return err
+	}
+	return nil
+}
+
+func readinessChecks(storage *storage, dispatcher *Dispatcher) []healthCheck {
+	return []healthCheck{
+		{"shutdown", func(context.Context) error {
+			if shuttingDown.Load() {
+				return fmt.Errorf("shutting down")
+			}
+			return nil
+		}},
+		{"storage", storage.Ping},
+		{"token_store", pingTokenStore},
+		{"dispatcher", func(context.Context) error {
+			if queued := dispatcher.Len(); queued > dispatcherSaturation {
+				return fmt.Errorf("saturated, %d jobs queued", queued)
+			}
+			return nil
+		}},
+	}
+}
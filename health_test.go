@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	healthy, results := runHealthChecks(context.Background(), []healthCheck{
+		{"ok", func(context.Context) error { return nil }},
+		{"failing", func(context.Context) error { return errors.New("unreachable") }},
+		{"hanging", func(context.Context) error { <-hang; return nil }},
+	})
+	if healthy {
+		t.Error("healthy with failing checks")
+	}
+	if results["ok"] != "ok" || results["failing"] != "unreachable" || results["hanging"] != "timed out after 2s" {
+		t.Errorf("results = %v", results)
+	}
+
+	healthy, results = runHealthChecks(context.Background(), []healthCheck{
+		{"ok", func(context.Context) error { return nil }},
+	})
+	if !healthy || results["ok"] != "ok" {
+		t.Errorf("healthy = %v, results = %v", healthy, results)
+	}
+}
+
+// localReadinessChecks are the readiness checks which don't need firestore.
+func localReadinessChecks(storage *storage, dispatcher *Dispatcher) []healthCheck {
+	checks := []healthCheck{}
+	for _, hc := range readinessChecks(storage, dispatcher) {
+		if hc.name != "token_store" {
+			checks = append(checks, hc)
+		}
+	}
+	return checks
+}
+
+func TestReadinessChecks(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	dispatcher := NewDispatcher(1, dispatcherCapacity)
+	defer dispatcher.Close()
+
+	ready, results := runHealthChecks(context.Background(), localReadinessChecks(storage, dispatcher))
+	if !ready {
+		t.Fatalf("not ready: %v", results)
+	}
+
+	release := blockWorkers(t, dispatcher, 1)
+	for range dispatcherSaturation + 1 {
+		dispatcher.Submit(PriorityLow, func() {})
+	}
+	ready, results = runHealthChecks(context.Background(), localReadinessChecks(storage, dispatcher))
+	release()
+	if ready || results["dispatcher"] == "ok" {
+		t.Errorf("ready with a saturated dispatcher: %v", results)
+	}
+
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	ready, results = runHealthChecks(context.Background(), localReadinessChecks(storage, dispatcher))
+	if ready || results["shutdown"] != "shutting down" {
+		t.Errorf("ready while shutting down: %v", results)
+	}
+	if results["storage"] != "ok" {
+		t.Errorf("storage check = %s", results["storage"])
+	}
+}
@@ -0,0 +1,24 @@
+// Package testenv sets the env vars which the service reads while its
+// packages are initialized, so that tests run without a .env file. Tests
+// import it for its side effects, it is initialized before the packages
+// which load the config as it imports nothing of the service.
+package testenv
+
+import "os"
+
+// the VAPID pair is only ever used by tests
+var defaults = map[string]string{
+	"API_KEY":           "test-api-key",
+	"SECRET_KEY":        "test-secret-key",
+	"SALT":              "test-salt",
+	"VAPID_PUBLIC_KEY":  "BHgl143n-M7Z4jw9fX4KD1drytRvoViLv81bJzT3kCzz0ewAfLZbYaqqZ4Q843OCQmyo3QAiCTAnBHbEM6Rc1So",
+	"VAPID_PRIVATE_KEY": "u1Xcr7uASVHb__tFlplsb9GYhVzsAavrnbDrHtQb3ZI",
+}
+
+func init() {
+	for key, value := range defaults {
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+}
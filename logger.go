@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	"github.com/shravanasati/everynyan-notification-service/middleware"
+)
+
+const redacted = "[redacted]"
+
+// attributes holding session tokens, which double as user IDs, are logged
+// as a fingerprint so that the lines of a user can still be correlated
+var fingerprintedKeys = map[string]bool{
+	"user":  true,
+	"token": true,
+}
+
+// attributes which are never logged
+var redactedKeys = map[string]bool{
+	"secret":        true,
+	"password":      true,
+	"authorization": true,
+	"keys":          true,
+	"p256dh":        true,
+	"auth":          true,
+	"device_token":  true,
+	"payload":       true,
+}
+
+// firestore errors quote the path of the document, the token lookups would
+// log the token as part of it
+var documentPath = regexp.MustCompile(`documents/tokens/[^"\s]+`)
+
+func fingerprint(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:4])
+}
+
+// redactAttr keeps tokens, subscription keys and notification payloads out
+// of the logs, along with the tokens quoted in errors. Push endpoints
+// identify the subscription so only their host is kept.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch {
+	case fingerprintedKeys[a.Key]:
+		return slog.String(a.Key, fingerprint(a.Value.String()))
+	case redactedKeys[a.Key]:
+		return slog.String(a.Key, redacted)
+	case a.Key == "error":
+		return slog.String(a.Key, documentPath.ReplaceAllString(a.Value.String(), "documents/tokens/"+redacted))
+	case a.Key == "endpoint":
+		u, err := url.Parse(a.Value.String())
+		if err != nil {
+			return slog.String(a.Key, redacted)
+		}
+		return slog.String(a.Key, u.Host)
+	}
+	return a
+}
+
+// requestIDHandler adds the ID of the request which the work is done for to
+// every record logged with its context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := middleware.GetRequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+func newLogger(conf config.LogConfig) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       conf.Level,
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	if conf.Format == config.LogFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(requestIDHandler{handler})
+}
+
+// requestContext restores the request ID of a notification which is sent
+// later on, eg. from the outbox.
+func requestContext(notif NotificationRequest) context.Context {
+	return middleware.WithRequestID(context.Background(), notif.RequestID)
+}
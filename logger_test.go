@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testSessionToken = "3f9a1c0b8e7d6a5f4e3d2c1b0a9f8e7d"
+
+func testLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(requestIDHandler{slog.NewTextHandler(buf, &slog.HandlerOptions{ReplaceAttr: redactAttr})})
+}
+
+// firestoreNotFound is the error firestore returns for a missing document.
+func firestoreNotFound(token string) error {
+	return status.Errorf(codes.NotFound, `"projects/everynyan/databases/(default)/documents/tokens/%s" not found`, token)
+}
+
+func TestTokenLookupErrorHidesToken(t *testing.T) {
+	err := tokenLookupError(firestoreNotFound(testSessionToken))
+	if !errors.Is(err, errTokenNotFound) {
+		t.Errorf("tokenLookupError(NotFound) = %v, want errTokenNotFound", err)
+	}
+
+	err = tokenLookupError(status.Errorf(codes.PermissionDenied, "access to documents/tokens/%s denied", testSessionToken))
+	if strings.Contains(err.Error(), testSessionToken) {
+		t.Errorf("tokenLookupError leaks the token: %v", err)
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := testLogger(&buf)
+
+	// the way checkAuth and the audience role lookup log a failed lookup,
+	// with the error as returned by getToken and as firestore returns it
+	logger.Warn("unable to get session token", "token", testSessionToken, "error", tokenLookupError(firestoreNotFound(testSessionToken)))
+	logger.Warn("unable to get session token", "user", testSessionToken, "error", firestoreNotFound(testSessionToken))
+	logger.Info("registered", "secret", "webhook-secret", "device_token", "apns-device-token",
+		"endpoint", "https://fcm.googleapis.com/fcm/send/subscription-id")
+
+	out := buf.String()
+	for _, leaked := range []string{testSessionToken, "webhook-secret", "apns-device-token", "subscription-id"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log output contains %q:\n%s", leaked, out)
+		}
+	}
+	for _, kept := range []string{"token=" + fingerprint(testSessionToken), "endpoint=fcm.googleapis.com", "documents/tokens/" + redacted} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("log output is missing %q:\n%s", kept, out)
+		}
+	}
+}
@@ -6,22 +6,27 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"iter"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Oudwins/zog"
-	"github.com/SherClockHolmes/webpush-go"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/shravanasati/everynyan-notification-service/config"
 	"github.com/shravanasati/everynyan-notification-service/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var conf = config.MustConfig()
+
 var errNoRequestBody = errors.New("missing request body")
 var errInvalidJSON = errors.New("missing/invalid json in request body")
 
@@ -58,57 +63,117 @@ func failedZogValidation(errors map[string][]zog.ZogError, w http.ResponseWriter
 var MSG_PING = "__ping__"
 var MSG_PONG = []byte("__pong__")
 
-func BroadcastNotification(broadcastRequest BroadcastRequest, wsConns iter.Seq[net.Conn], subscriptions iter.Seq[webpush.Subscription]) {
-	title := broadcastRequest.Title
-	description := broadcastRequest.Description
-	link := broadcastRequest.Link
+// clients send MSG_READ_PREFIX followed by the notification id once it has
+// been read
+var MSG_READ_PREFIX = "__read__:"
 
-	go func() {
-		// websocket notifications
-		wsMessage := NotificationRequest{
-			Title:       title,
-			Description: description,
-			Link:        link,
-		}.TransmissionJSON()
-
-		for wsConn := range wsConns {
-			go func(c net.Conn) {
-				wsutil.WriteServerText(c, wsMessage)
-			}(wsConn)
+// recordWebsocketWrite records the outcome of a websocket write, broadcasts
+// pass no user and publish no event.
+func recordWebsocketWrite(ctx context.Context, user, notificationID string, err error) {
+	if err != nil {
+		if user != "" {
+			slog.WarnContext(ctx, "error sending message to client", "user", user, "error", err)
 		}
-	}()
-
-	go func() {
-		// push notifications
-		pushMessage := jsonify(PushNotificationEvent{
-			Title: title,
-			Body:  description,
-			URL:   link,
-			Icon:  "/android-192x192.png",
-			Badge: "/logo.png",
-			Image: "/logo.png",
+		notificationsTotal.Inc(ChannelWebsocket, OutcomeFailed)
+		return
+	}
+	notificationsTotal.Inc(ChannelWebsocket, OutcomeDelivered)
+	if user != "" {
+		events.Publish(Event{
+			Type:           EventNotificationDelivered,
+			User:           user,
+			NotificationID: notificationID,
+			Channel:        ChannelWebsocket,
 		})
-
-		for sub := range subscriptions {
-			go _sendPushNotificationBytes(pushMessage, sub)
-		}
-	}()
+	}
 }
 
 // todo broadcast a notification per day - trending post
 
 func main() {
+	slog.SetDefault(newLogger(conf.Log))
+	setupFirebase()
+
+	shutdownTracing, err := setupTracing(conf.Tracing)
+	if err != nil {
+		slog.Error("unable to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
 	addr := "localhost:7924"
-	storage := NewStorage("./subscriptions.db", "subscriptions")
-	defer storage.db.Close()
+	storage := NewStorage(conf.Storage, "subscriptions")
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		code := migrateCommand(storage, os.Args[2:])
+		storage.backend.Close()
+		os.Exit(code)
+	}
+
+	if _, err := storage.Migrate(false); err != nil {
+		slog.Error("unable to migrate storage", "error", err)
+		os.Exit(1)
+	}
 
 	router := http.NewServeMux()
 	adminRouter := http.NewServeMux()
 
 	connManager := NewWebsocketConnectionsManager()
-	defer connManager.Close()
+	dispatcher := NewDispatcher(dispatcherWorkers, dispatcherCapacity)
+
+	NewGaugeFunc("everynyan_websocket_connections", "Open websocket connections.", func() float64 {
+		return float64(connManager.Count())
+	})
+	NewGaugeFunc("everynyan_dispatcher_queue_depth", "Delivery jobs waiting for a dispatcher worker.", func() float64 {
+		return float64(dispatcher.Len())
+	})
+
+	var outbox *Outbox
+	outbox = NewOutbox(storage, outboxBucket, func(notif NotificationRequest, done func()) bool {
+		return dispatcher.Submit(notif.Priority, func() {
+			deliverPush(requestContext(notif), storage, outbox, nil, notif)
+			done()
+		})
+	})
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	go outbox.Run(outboxCtx)
+	go notificationThrottle.Run(outboxCtx)
+
+	// the bus carries deliveries and presence between the instances
+	cluster, err := NewCluster(outboxCtx, conf.Bus, connManager, dispatcher, storage)
+	if err != nil {
+		slog.Error("unable to connect to the bus", "backend", conf.Bus.Backend, "error", err)
+		os.Exit(1)
+	}
+	if err := cluster.Run(outboxCtx); err != nil {
+		slog.Error("unable to subscribe to the bus", "backend", conf.Bus.Backend, "error", err)
+		os.Exit(1)
+	}
+
+	// broadcasts left running by an instance which went away are resumed
+	broadcasts := NewBroadcastRunner(outboxCtx, storage, outbox, dispatcher, cluster, connManager, conf.Bus.InstanceID)
+	go broadcasts.Run()
+
+	// notifications which stay unread are emailed, if the email channel is
+	// configured
+	var emailOutbox *Outbox
+	if conf.Email != nil {
+		sender := newEmailSender(*conf.Email)
+		emailOutbox = NewOutbox(storage, emailOutboxBucket, func(notif NotificationRequest, done func()) bool {
+			return dispatcher.Submit(PriorityLow, func() {
+				emailIfUnread(requestContext(notif), storage, emailOutbox, sender, notif)
+				done()
+			})
+		})
+		go emailOutbox.Run(outboxCtx)
+	}
 
 	router.HandleFunc("/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("server is shutting down"))
+			return
+		}
+
 		token, err := authorizeUserRequest(r, w)
 		if err != nil {
 			return
@@ -116,18 +181,23 @@ func main() {
 
 		conn, _, _, err := ws.UpgradeHTTP(r, w)
 		if err != nil {
-			log.Println("unable to upgrade the http connection to websocket", err)
+			slog.WarnContext(r.Context(), "unable to upgrade the http connection to websocket", "error", err)
 			// w.WriteHeader(http.StatusInternalServerError)
 			// w.Write([]byte("unable to upgrade the http connection to websocket"))
 			return
 		}
 
 		connManager.Add(token, conn)
+		websocketConnectsTotal.Inc()
+		cluster.Connected(context.WithoutCancel(r.Context()), token)
 
 		go func() {
 			defer func(conn net.Conn, author string) {
 				conn.Close()
-				connManager.Delete(author)
+				websocketDisconnectsTotal.Inc()
+				if connManager.Remove(author, conn) {
+					cluster.Disconnected(context.Background(), author)
+				}
 			}(conn, token)
 
 			for {
@@ -138,24 +208,203 @@ func main() {
 					break
 				}
 				if err != nil && err != io.EOF {
-					fmt.Println("error in reading client data:", err)
+					slog.Warn("error in reading client data", "user", token, "error", err)
 					break
 				}
 				// handle ping-pong
 				if string(msg) == MSG_PING {
 					wsutil.WriteServerMessage(conn, op, MSG_PONG)
 				}
+				if id, found := strings.CutPrefix(string(msg), MSG_READ_PREFIX); found {
+					markRead(context.Background(), storage, id, token)
+				}
 				// fmt.Println(op, string(msg))
 				// wsutil.WriteServerMessage(conn, op, msg)
 			}
 		}()
 	})
 
+	// webhooks receive the delivery events
+	webhookEvents, stopWebhookEvents := events.Subscribe(1024)
+	webhookSender := NewWebhookSender(storage)
+	go webhookSender.Run(outboxCtx, webhookEvents)
+
+	// streaming responses are ended when the server shuts down, it would
+	// otherwise wait for them until the shutdown timeout
+	streamsCtx, stopStreams := context.WithCancel(context.Background())
+
+	// the health endpoints are for the orchestrator and don't need the api key
+	router.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	router.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, checks := runHealthChecks(r.Context(), readinessChecks(storage, dispatcher))
+		if !ready {
+			slog.WarnContext(r.Context(), "instance is not ready", "checks", checks)
+		}
+
+		statusCode := http.StatusOK
+		if !ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(jsonify(struct {
+			Ready  bool              `json:"ready"`
+			Checks map[string]string `json:"checks"`
+		}{ready, checks}))
+	})
+
+	// following the link only asks for a confirmation, mail scanners and
+	// link prefetchers open it too. The form and one-click unsubscribe of
+	// mail clients (RFC 8058) send a POST.
+	router.HandleFunc("GET /unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if _, err := parseUnsubscribeToken(token); err != nil {
+			unsubscribePage(w, http.StatusBadRequest, "This unsubscribe link is invalid.")
+			return
+		}
+		unsubscribeConfirmPage(w, token)
+	})
+
+	router.HandleFunc("POST /unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		err := storage.Unsubscribe(r.URL.Query().Get("token"))
+		if err == errInvalidUnsubscribeToken {
+			unsubscribePage(w, http.StatusBadRequest, "This unsubscribe link is invalid.")
+			return
+		}
+		if err != nil {
+			unsubscribePage(w, http.StatusInternalServerError, "Something went wrong, try again later.")
+			return
+		}
+
+		unsubscribePage(w, http.StatusOK, "You will no longer receive notification emails.")
+	})
+
+	adminRouter.HandleFunc("POST /notifications/{id}/read", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing token in url query"))
+			return
+		}
+
+		err := markRead(r.Context(), storage, r.PathValue("id"), token)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("notification marked as read"))
+	})
+
+	adminRouter.HandleFunc("DELETE /sessions", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing token in url query"))
+			return
+		}
+
+		if err := cluster.RevokeToken(r.Context(), token); err != nil {
+			slog.ErrorContext(r.Context(), "unable to publish token revocation on the bus", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("session revoked"))
+	})
+
+	adminRouter.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		writeMetrics(w)
+	})
+
 	adminRouter.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(fmt.Sprintf("%v", connManager.Count())))
 	})
 
+	adminRouter.HandleFunc("POST /presence", func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := readRequestBody(r, w)
+		if err != nil {
+			return
+		}
+
+		reqMap, err := getRequestBodyJSON[map[string]any](reqBody, w)
+		if err != nil {
+			return
+		}
+
+		var presenceRequest PresenceRequest
+		errors := presenceRequestSchema.Parse(reqMap, &presenceRequest)
+		if errors != nil {
+			failedZogValidation(errors, w)
+			return
+		}
+
+		online, err := cluster.Online(r.Context(), presenceRequest.Users)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to look up presence", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("unable to look up presence"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(online))
+	})
+
+	adminRouter.HandleFunc("GET /presence/stream", func(w http.ResponseWriter, r *http.Request) {
+		presenceEvents, unsubscribe := events.Subscribe(256)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			slog.ErrorContext(r.Context(), "unable to stream presence", "error", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(presenceHeartbeatPeriod)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-streamsCtx.Done():
+				return
+			case <-heartbeat.C:
+				// a comment line keeps idle proxies from closing the stream
+				w.Write([]byte(": heartbeat\n\n"))
+				if err := http.NewResponseController(w).Flush(); err != nil {
+					return
+				}
+			case event, ok := <-presenceEvents:
+				if !ok {
+					return
+				}
+				if !isPresenceEvent(event) {
+					continue
+				}
+				if err := writePresenceEvent(w, event); err != nil {
+					return
+				}
+			}
+		}
+	})
+
 	adminRouter.HandleFunc("POST /push-subscription", func(w http.ResponseWriter, r *http.Request) {
 		reqBody, err := readRequestBody(r, w)
 		if err != nil {
@@ -167,13 +416,34 @@ func main() {
 			return
 		}
 
-		var subscription webpush.Subscription
+		var subscription StoredSubscription
 		errors := pushSubscriptionSchema.Parse(reqMap, &subscription)
 		if errors != nil {
 			failedZogValidation(errors, w)
 			return
 		}
 
+		if _, ok := pushProviders[subscription.Provider]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("push provider is not configured"))
+			return
+		}
+
+		if subscription.Provider == ProviderWebPush {
+			// subscriptions are created under the active key unless the
+			// client tells us otherwise
+			if subscription.VAPIDPublicKey == "" {
+				subscription.VAPIDPublicKey = vapidKeys.Active.PublicKey
+			}
+			if _, ok := vapidKeys.Lookup(subscription.VAPIDPublicKey); !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("unknown VAPID public key"))
+				return
+			}
+		} else {
+			subscription.VAPIDPublicKey = ""
+		}
+
 		token := r.URL.Query().Get("token")
 		if token == "" {
 			w.WriteHeader(http.StatusBadRequest)
@@ -192,6 +462,30 @@ func main() {
 		w.Write([]byte("subscription added"))
 	})
 
+	adminRouter.HandleFunc("GET /push-subscriptions/legacy", func(w http.ResponseWriter, r *http.Request) {
+		type legacySubscription struct {
+			User           string `json:"user"`
+			Endpoint       string `json:"endpoint"`
+			VAPIDPublicKey string `json:"vapidPublicKey"`
+		}
+
+		legacy := []legacySubscription{}
+		for user, sub := range storage.GetAllSubscriptions() {
+			if sub.ProviderName() != ProviderWebPush || sub.VAPIDPublicKey == vapidKeys.Active.PublicKey {
+				continue
+			}
+			legacy = append(legacy, legacySubscription{
+				User:           user,
+				Endpoint:       sub.Endpoint,
+				VAPIDPublicKey: sub.VAPIDPublicKey,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(legacy))
+	})
+
 	adminRouter.HandleFunc("POST /send", func(w http.ResponseWriter, r *http.Request) {
 		reqBody, err := readRequestBody(r, w)
 		if err != nil {
@@ -210,38 +504,88 @@ func main() {
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("notification request accepted"))
+		err = parseTemplateVariables(reqMap, notifReqs)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = checkTemplates(storage, notifReqs)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// deliveries outlive the request but are still logged with its ID
+		ctx := context.WithoutCancel(r.Context())
+		for i := range notifReqs {
+			notifReqs[i].ID = newID()
+			notifReqs[i].RequestID = middleware.GetRequestID(ctx)
+		}
 
-		// todo send to a worker pool
+		jobs := make([]DispatchJob, 0, len(notifReqs))
 		for _, notif := range notifReqs {
-			go func(notif NotificationRequest) {
-				tokenConn, ok := connManager.Get(notif.User)
-				if !ok {
+			jobs = append(jobs, DispatchJob{Priority: notif.Priority, Run: func() {
+				ctx, span := tracer.Start(ctx, "notification.deliver", trace.WithAttributes(
+					attribute.String("notification.id", notif.ID),
+					attribute.String("notification.priority", notif.Priority),
+				))
+				defer span.End()
+
+				notif, err := renderNotification(storage, notif)
+				if err != nil {
+					slog.ErrorContext(ctx, "unable to render notification template", "template", notif.Template, "error", err)
+					span.SetStatus(codes.Error, err.Error())
 					return
 				}
 
-				err = wsutil.WriteServerText(tokenConn, notif.TransmissionJSON())
-				if err != nil {
-					log.Println("error sending message to client:", err)
+				// in-app notifications are never held back by quiet hours
+				deliverWebsocket := func(notif NotificationRequest) {
+					tokenConn, ok := connManager.Get(notif.User)
+					if ok {
+						recordWebsocketWrite(ctx, notif.User, notif.ID, writeWebsocketMessage(ctx, tokenConn, notif.TransmissionJSON()))
+					} else {
+						// the user may be connected to another instance
+						cluster.DeliverRemote(ctx, notif, notif.TransmissionJSON())
+					}
+				}
+				admitted := notificationThrottle.Admit(ctx, ChannelWebsocket, notif, func(notif NotificationRequest, at time.Time) {
+					time.AfterFunc(time.Until(at), func() {
+						accepted := dispatcher.Submit(notif.Priority, func() {
+							deliverWebsocket(notif)
+						})
+						if !accepted {
+							slog.WarnContext(ctx, "dispatcher queue full, dropping deferred websocket notification", "notification_id", notif.ID)
+						}
+					})
+				})
+				if admitted {
+					deliverWebsocket(notif)
 				}
 
 				// push notifications
-				sub, err := storage.GetSubscription(notif.User)
-				if err != nil {
-					log.Println("unable to get user subscription")
-					return
+				deliverPush(ctx, storage, outbox, notificationThrottle, notif)
+
+				if emailOutbox != nil {
+					scheduleEmail(ctx, storage, emailOutbox, notificationThrottle, notif)
 				}
-				sendPushNotification(PushNotificationEvent{
-					Title: notif.Title,
-					Body:  notif.Description,
-					URL:   notif.Link,
-					Icon:  "/android-192x192.png",
-					Badge: "/logo.png",
-					Image: "/logo.png",
-				}, sub)
-			}(notif)
+			}})
 		}
+
+		// the whole request is refused when the queue is full, a partly sent
+		// one couldn't be retried without duplicates
+		if !dispatcher.SubmitAll(jobs) {
+			slog.WarnContext(ctx, "dispatcher queue full, refusing notification request", "notifications", len(jobs))
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("too many notifications queued, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("notification request accepted"))
 	})
 
 	adminRouter.HandleFunc("POST /broadcast", func(w http.ResponseWriter, r *http.Request) {
@@ -262,46 +606,446 @@ func main() {
 			return
 		}
 
+		job, err := broadcasts.Start(r.Context(), broadcastRequest)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to start broadcast", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(jsonify(job))
+	})
+
+	adminRouter.HandleFunc("POST /broadcasts/dry-run", func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := readRequestBody(r, w)
+		if err != nil {
+			return
+		}
+
+		reqMap, err := getRequestBodyJSON[map[string]any](reqBody, w)
+		if err != nil {
+			return
+		}
+
+		var audienceRequest struct {
+			Audience *Audience
+		}
+		errors := audienceRequestSchema.Parse(reqMap, &audienceRequest)
+		if errors != nil {
+			failedZogValidation(errors, w)
+			return
+		}
+
+		size, err := broadcasts.DryRun(r.Context(), audienceRequest.Audience)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to size broadcast audience", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("notification request accepted"))
+		w.Write(jsonify(size))
+	})
 
-		BroadcastNotification(broadcastRequest, connManager.All(), storage.GetAllSubscriptions())
+	adminRouter.HandleFunc("GET /broadcasts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		job, err := broadcasts.Get(r.PathValue("id"))
+		if err == errBroadcastNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to get broadcast", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(job))
+	})
+
+	adminRouter.HandleFunc("POST /broadcasts/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		job, err := broadcasts.Cancel(r.PathValue("id"))
+		if err == errBroadcastNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err == errBroadcastFinished {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to cancel broadcast", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(job))
+	})
+
+	adminRouter.HandleFunc("GET /preferences", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing token in url query"))
+			return
+		}
+
+		prefs, err := storage.GetPreferences(token)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(prefs))
+	})
+
+	adminRouter.HandleFunc("PUT /preferences", func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := readRequestBody(r, w)
+		if err != nil {
+			return
+		}
+
+		reqMap, err := getRequestBodyJSON[map[string]any](reqBody, w)
+		if err != nil {
+			return
+		}
+
+		var update UserPreferences
+		errors := preferencesSchema.Parse(reqMap, &update)
+		if errors != nil {
+			failedZogValidation(errors, w)
+			return
+		}
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("missing token in url query"))
+			return
+		}
+
+		// only the fields in the body change, clients which know about some
+		// of the preferences don't wipe the others
+		_, err = storage.UpdatePreferences(token, func(prefs *UserPreferences) {
+			prefs.Merge(reqMap, update)
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("preferences updated"))
+	})
+
+	adminRouter.HandleFunc("GET /templates", func(w http.ResponseWriter, r *http.Request) {
+		templates := []NotificationTemplate{}
+		for tmpl := range storage.GetAllTemplates() {
+			templates = append(templates, tmpl)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(templates))
+	})
+
+	adminRouter.HandleFunc("GET /templates/{id}", func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := storage.GetTemplate(r.PathValue("id"))
+		if err == errTemplateNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(tmpl))
 	})
 
-	router.Handle("/", middleware.EnsureAdmin(adminRouter))
-	mwStack := middleware.CreateStack(middleware.Logging)
+	adminRouter.HandleFunc("PUT /templates/{id}", func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := readRequestBody(r, w)
+		if err != nil {
+			return
+		}
+
+		reqMap, err := getRequestBodyJSON[map[string]any](reqBody, w)
+		if err != nil {
+			return
+		}
+
+		var tmpl NotificationTemplate
+		errors := parseTemplate(reqMap, &tmpl)
+		if errors != nil {
+			failedZogValidation(errors, w)
+			return
+		}
+
+		tmpl.ID = r.PathValue("id")
+		if err := tmpl.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		err = storage.PutTemplate(tmpl)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("template saved"))
+	})
+
+	adminRouter.HandleFunc("DELETE /templates/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := storage.DeleteTemplate(r.PathValue("id"))
+		if err == errTemplateNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("template deleted"))
+	})
+
+	adminRouter.HandleFunc("GET /webhooks", func(w http.ResponseWriter, r *http.Request) {
+		webhooks := storage.GetAllWebhooks()
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(webhooks))
+	})
+
+	adminRouter.HandleFunc("POST /webhooks", func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := readRequestBody(r, w)
+		if err != nil {
+			return
+		}
+
+		reqMap, err := getRequestBodyJSON[map[string]any](reqBody, w)
+		if err != nil {
+			return
+		}
+
+		var webhook Webhook
+		errors := webhookSchema.Parse(reqMap, &webhook)
+		if errors != nil {
+			failedZogValidation(errors, w)
+			return
+		}
+
+		webhook.ID = newID()
+		webhook.CreatedAt = time.Now().UTC()
+		if webhook.Secret == "" {
+			webhook.Secret = newID()
+		}
+
+		err = storage.PutWebhook(webhook)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+		webhookSender.Refresh()
+
+		// the secret is only ever returned here
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(jsonify(webhook))
+	})
+
+	adminRouter.HandleFunc("DELETE /webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := storage.DeleteWebhook(r.PathValue("id"))
+		if err == errWebhookNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		webhookSender.Refresh()
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("webhook deleted"))
+	})
+
+	adminRouter.HandleFunc("GET /webhooks/{id}/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		deliveries, err := storage.GetWebhookDeliveries(r.PathValue("id"))
+		if err == errWebhookNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(deliveries))
+	})
+
+	adminRouter.HandleFunc("GET /quarantine", func(w http.ResponseWriter, r *http.Request) {
+		records, err := storage.GetQuarantinedRecords()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to get quarantined records", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonify(records))
+	})
+
+	adminRouter.HandleFunc("DELETE /quarantine", func(w http.ResponseWriter, r *http.Request) {
+		purged, err := storage.PurgeQuarantinedRecords()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to purge quarantined records", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("%d quarantined records purged", purged)))
+	})
+
+	adminRouter.HandleFunc("DELETE /quarantine/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := storage.PurgeQuarantinedRecord(r.PathValue("id"))
+		if err == errQuarantinedRecordNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to purge quarantined record", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error, try again later"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("quarantined record purged"))
+	})
+
+	adminStack := middleware.CreateStack(middleware.EnsureAdmin, middleware.RateLimit(func(r *http.Request) {
+		adminRequestsThrottledTotal.Inc()
+		slog.WarnContext(r.Context(), "admin request over the API key's rate limit", "path", r.URL.Path)
+	}))
+	router.Handle("/", adminStack(adminRouter))
+	mwStack := middleware.CreateStack(middleware.RequestID, middleware.Tracing, middleware.Logging)
 	server := &http.Server{
 		Addr:           addr,
 		Handler:        mwStack(router),
 		MaxHeaderBytes: 1 << 20, // 1MB
 	}
+	server.RegisterOnShutdown(stopStreams)
 
 	// initializing the server in a goroutine so that
 	// it wont block the graceful shutdown handling below
 	go func() {
-		log.Println("Ready to accept connections at", addr)
+		slog.Info("ready to accept connections", "addr", addr)
 		err := server.ListenAndServe()
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("unable to start a server: %v \n", err)
+			slog.Error("unable to start a server", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
+	// Wait for interrupt signal to gracefully shutdown the server.
 	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be caught, so don't need to add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	slog.Info("shutting down server")
+
+	// report not ready and keep serving for a while, so that load balancers
+	// stop routing new requests here before the listener goes away
+	shuttingDown.Store(true)
+	time.Sleep(conf.Server.ShutdownDrainDelay)
 
-	// The context is used to inform the server it has 5 seconds to finish
-	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// The context bounds the whole shutdown below, from finishing the
+	// requests being handled to draining the queued deliveries
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		slog.Error("server forced to shutdown", "error", err)
+	}
+
+	// websocket connections are hijacked so the server doesn't know about
+	// them, tell the clients to reconnect to another instance
+	connManager.GoAway(ctx, conf.Server.ReconnectWindow)
+
+	// stop polling the outboxes and hand over whatever is due right now
+	stopOutbox()
+	stopWebhookEvents()
+	outbox.flush()
+	if emailOutbox != nil {
+		emailOutbox.flush()
+	}
+
+	// outbox entries whose delivery is abandoned stay in the outbox, the
+	// next instance sends them once their lease runs out
+	if abandoned := dispatcher.Drain(ctx); abandoned > 0 {
+		slog.Warn("shutdown timed out before all deliveries were made", "abandoned", abandoned)
+	}
+	// the broadcasts save how far they got once their batch is through
+	broadcasts.Wait(ctx)
+
+	// the deliveries above may still have gone to users on other instances
+	if err := cluster.Close(); err != nil {
+		slog.Warn("unable to close the bus", "error", err)
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("unable to flush traces", "error", err)
+	}
+
+	if err := storage.backend.Close(); err != nil {
+		slog.Error("unable to close storage", "error", err)
 	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small implementation of the Prometheus text exposition format, the
+// service only needs counters, gauges and histograms.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsRegistry []metric
+)
+
+func registerMetric[M metric](m M) M {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// writeMetrics writes every registered metric in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	registry := slices.Clone(metricsRegistry)
+	metricsMu.Unlock()
+
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders the label pairs as {name="value",...}, extra is
+// appended as is and is used for the histogram le label.
+func formatLabels(names, values []string, extra string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// seriesKey identifies a combination of label values.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a monotonically increasing value per combination of its
+// labels.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return registerMetric(&Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*counterSeries),
+	})
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: slices.Clone(labelValues)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range slices.Sorted(maps.Keys(c.series)) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labelValues, ""), formatFloat(s.value))
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are scraped.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	return registerMetric(&GaugeFunc{name: name, help: help, value: value})
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histograms
+var defaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into cumulative buckets per combination of
+// its labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return registerMetric(&Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	})
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: slices.Clone(labelValues), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range slices.Sorted(maps.Keys(h.series)) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf(`le="%s"`, formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, le), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues, ""), s.count)
+	}
+}
+
+// delivery outcomes of the notifications_total metric
+const (
+	OutcomeDelivered = "delivered"
+	OutcomeFailed    = "failed"
+	OutcomeDropped   = "dropped"
+	OutcomeDeferred  = "deferred"
+	OutcomeCollapsed = "collapsed"
+)
+
+var (
+	websocketConnectsTotal = NewCounter("everynyan_websocket_connects_total",
+		"Websocket connections opened.")
+	websocketDisconnectsTotal = NewCounter("everynyan_websocket_disconnects_total",
+		"Websocket connections closed.")
+	notificationsTotal = NewCounter("everynyan_notifications_total",
+		"Notifications handled per channel and outcome.", "channel", "outcome")
+	throttledNotificationsTotal = NewCounter("everynyan_notifications_throttled_total",
+		"Notifications over their user's rate limit per channel and outcome, dropped, deferred or collapsed.", "channel", "outcome")
+	adminRequestsThrottledTotal = NewCounter("everynyan_admin_requests_throttled_total",
+		"Admin API requests refused for going over the API key's rate limit.")
+	pushDuration = NewHistogram("everynyan_push_duration_seconds",
+		"Time taken by the push provider to accept a push notification.", defaultLatencyBuckets, "provider")
+	tokenLookupDuration = NewHistogram("everynyan_token_lookup_duration_seconds",
+		"Time taken to look up a session token in firestore.", defaultLatencyBuckets)
+	tokenCacheRequestsTotal = NewCounter("everynyan_token_cache_requests_total",
+		"Session token cache lookups by result, hit or miss.", "result")
+	webhookEventsDroppedTotal = NewCounter("everynyan_webhook_events_dropped_total",
+		"Webhook deliveries dropped because the webhook had too many deliveries queued or waiting for a retry.")
+	quarantinedRecordsTotal = NewCounter("everynyan_quarantined_records_total",
+		"Corrupt records moved to the quarantine bucket, per bucket they were in.", "bucket")
+	storageTxDuration = NewHistogram("everynyan_storage_transaction_duration_seconds",
+		"Duration of storage transactions by type, read or write.", defaultLatencyBuckets, "type")
+)
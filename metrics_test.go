@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func metricText(m metric) string {
+	var buf strings.Builder
+	m.write(&buf)
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	unlabelled := NewCounter("test_unlabelled_total", "An unlabelled counter.")
+	if got, want := metricText(unlabelled), "# HELP test_unlabelled_total An unlabelled counter.\n# TYPE test_unlabelled_total counter\ntest_unlabelled_total 0\n"; got != want {
+		t.Errorf("unused counter:\n%s\nwant:\n%s", got, want)
+	}
+
+	c := NewCounter("test_total", "A counter.", "channel", "outcome")
+	c.Inc("push", "delivered")
+	c.Add(2, "push", "delivered")
+	c.Inc("email", `say "hi"`+"\n")
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{channel="email",outcome="say \"hi\"\n"} 1
+test_total{channel="push",outcome="delivered"} 3
+`
+	if got := metricText(c); got != want {
+		t.Errorf("counter:\n%s\nwant:\n%s", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic with the wrong number of labels")
+		}
+	}()
+	c.Inc("push")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_seconds", "A histogram.", []float64{0.1, 1}, "provider")
+	h.Observe(0.05, "fcm")
+	h.Observe(0.5, "fcm")
+	h.Observe(3, "fcm")
+	want := `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{provider="fcm",le="0.1"} 1
+test_seconds_bucket{provider="fcm",le="1"} 2
+test_seconds_bucket{provider="fcm",le="+Inf"} 3
+test_seconds_sum{provider="fcm"} 3.55
+test_seconds_count{provider="fcm"} 3
+`
+	if got := metricText(h); got != want {
+		t.Errorf("histogram:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	value := 3.0
+	g := NewGaugeFunc("test_depth", "A gauge.", func() float64 { return value })
+	if got := metricText(g); !strings.HasSuffix(got, "test_depth 3\n") {
+		t.Errorf("gauge:\n%s", got)
+	}
+	value = math.Inf(1)
+	if got := metricText(g); !strings.HasSuffix(got, "test_depth +Inf\n") {
+		t.Errorf("gauge:\n%s", got)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	notificationsTotal.Inc(ChannelPush, OutcomeDelivered)
+	var buf strings.Builder
+	writeMetrics(&buf)
+	for _, line := range []string{
+		"# TYPE everynyan_notifications_total counter\n",
+		"# TYPE everynyan_push_duration_seconds histogram\n",
+		`everynyan_notifications_total{channel="push",outcome="delivered"} `,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("metrics are missing %q", line)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	apiLimitersMu sync.Mutex
+	// the limiters are keyed by a hash of the API key so that it isn't kept
+	// around in another place
+	apiLimiters = make(map[[sha256.Size]byte]*rate.Limiter)
+)
+
+func apiLimiter(apiKey string) *rate.Limiter {
+	apiLimitersMu.Lock()
+	defer apiLimitersMu.Unlock()
+
+	key := sha256.Sum256([]byte(apiKey))
+	limiter, ok := apiLimiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(config_.RateLimit.APIRate), config_.RateLimit.APIBurst)
+		apiLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// RateLimit limits the requests of every API key with a token bucket and
+// reports the limit in the X-RateLimit-* headers. Requests over the limit
+// are answered with 429 and a Retry-After, after calling onThrottled. It
+// goes after EnsureAdmin, which has checked the key.
+func RateLimit(onThrottled func(r *http.Request)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey := r.Header.Get("Authorization")
+			if _, key, found := strings.Cut(apiKey, " "); found {
+				apiKey = key
+			}
+			limiter := apiLimiter(apiKey)
+
+			now := time.Now()
+			reservation := limiter.ReserveN(now, 1)
+			delay := reservation.DelayFrom(now)
+			if delay > 0 {
+				// the request isn't served, it doesn't use up the token
+				reservation.CancelAt(now)
+			}
+
+			tokens := limiter.TokensAt(now)
+			// seconds until the bucket is full again
+			reset := math.Ceil((float64(limiter.Burst()) - tokens) / float64(limiter.Limit()))
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.Burst()))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(int(tokens), 0)))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(max(int(reset), 0)))
+
+			if delay > 0 {
+				onThrottled(r)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("rate limit exceeded"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
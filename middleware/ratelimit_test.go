@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestRateLimit(t *testing.T) {
+	throttled := 0
+	handler := RateLimit(func(r *http.Request) { throttled++ })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	burst := config_.RateLimit.APIBurst
+	for i := range burst {
+		w := request("rate-limited-key")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i, w.Code)
+		}
+	}
+	if limit := request("other-key").Header().Get("X-RateLimit-Limit"); limit != strconv.Itoa(burst) {
+		t.Errorf("X-RateLimit-Limit = %s, want %d", limit, burst)
+	}
+
+	w := request("rate-limited-key")
+	if w.Code != http.StatusTooManyRequests || throttled != 1 {
+		t.Fatalf("request over the limit = %d, %d throttled", w.Code, throttled)
+	}
+	if w.Header().Get("Retry-After") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("headers of a throttled request = %v", w.Header())
+	}
+
+	// every API key has a bucket of its own
+	if w := request("other-key"); w.Code != http.StatusOK {
+		t.Errorf("request with another key = %d, want 200", w.Code)
+	}
+}
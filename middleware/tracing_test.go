@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	handler := Tracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !trace.SpanContextFromContext(r.Context()).IsValid() {
+			t.Error("handler called without a span")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/send", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans ended, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "POST /send" || span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span %s of kind %s", span.Name(), span.SpanKind())
+	}
+	if span.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.SpanContext().TraceID() != span.Parent().TraceID() {
+		t.Errorf("span doesn't continue the caller's trace, parent %v", span.Parent())
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("span status = %v, want an error", span.Status())
+	}
+	found := false
+	for _, attr := range span.Attributes() {
+		if attr == attribute.Int("http.response.status_code", http.StatusServiceUnavailable) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("span attributes %v have no status code", span.Attributes())
+	}
+}
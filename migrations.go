@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var metaBucket = []byte("meta")
+var schemaVersionKey = []byte("schema_version")
+
+// errMigrationDryRun rolls back the transaction of a dry run
+var errMigrationDryRun = errors.New("dry run")
+
+// migration upgrades the stored records to version, apply returns how many
+// records it changed.
+type migration struct {
+	version     int
+	description string
+	apply       func(s *storage, tx Tx) (int, error)
+}
+
+// migrations are applied in order, each in its own transaction along with
+// the schema version it brings the database to. Append new ones at the end
+// and never change one which has been released.
+var migrations = []migration{
+	{1, "record the VAPID key of web push subscriptions stored before key rotation", backfillVAPIDKey},
+}
+
+// MigrationResult is a migration which was applied, or would be in a dry
+// run.
+type MigrationResult struct {
+	Version     int
+	Description string
+	Changed     int
+}
+
+func getSchemaVersion(tx Tx) int {
+	v := tx.Bucket(metaBucket).Get(schemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func putSchemaVersion(tx Tx, version int) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(version))
+	return tx.Bucket(metaBucket).Put(schemaVersionKey, v)
+}
+
+// SchemaVersion returns the version of the last migration applied.
+func (s *storage) SchemaVersion() (int, error) {
+	version := 0
+	err := s.view(func(tx Tx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// PendingMigrations returns the migrations which haven't been applied.
+func (s *storage) PendingMigrations() ([]migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []migration{}
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations. A dry run applies them all in a
+// single transaction which is rolled back, and reports what they would
+// change.
+func (s *storage) Migrate(dryRun bool) ([]MigrationResult, error) {
+	if dryRun {
+		var results []MigrationResult
+		err := s.update(func(tx Tx) error {
+			results = []MigrationResult{}
+			version := getSchemaVersion(tx)
+			for _, m := range migrations {
+				if m.version <= version {
+					continue
+				}
+				changed, err := m.apply(s, tx)
+				if err != nil {
+					return fmt.Errorf("migration %d: %w", m.version, err)
+				}
+				results = append(results, MigrationResult{m.version, m.description, changed})
+			}
+			return errMigrationDryRun
+		})
+		if err != errMigrationDryRun {
+			return nil, err
+		}
+		return results, nil
+	}
+
+	results := []MigrationResult{}
+	for _, m := range migrations {
+		applied := false
+		changed := 0
+		// the version is read again in the transaction, another instance
+		// may have applied the migration in the meantime
+		err := s.update(func(tx Tx) error {
+			applied = false
+			if getSchemaVersion(tx) >= m.version {
+				return nil
+			}
+
+			var err error
+			changed, err = m.apply(s, tx)
+			if err != nil {
+				return err
+			}
+			applied = true
+			return putSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return results, fmt.Errorf("migration %d: %w", m.version, err)
+		}
+		if applied {
+			slog.Info("applied migration", "version", m.version, "description", m.description, "changed", changed)
+			results = append(results, MigrationResult{m.version, m.description, changed})
+		}
+	}
+	return results, nil
+}
+
+// backfillVAPIDKey records the public key on the subscriptions which were
+// stored before subscriptions tracked their VAPID key, back then there was
+// only a single key pair so they were all created under it. Which pair that
+// was is only known for sure until the keys are rotated, see BackfillKey.
+func backfillVAPIDKey(s *storage, tx Tx) (int, error) {
+	changed := 0
+	b := tx.Bucket(s.bucketName)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		sub, err := getSubscriptionFromBytes(v)
+		if err != nil {
+			// left for the reads to quarantine, moving it here would
+			// change the bucket under the cursor
+			continue
+		}
+		if sub.ProviderName() != ProviderWebPush || sub.VAPIDPublicKey != "" {
+			continue
+		}
+		publicKey, err := vapidKeys.BackfillKey()
+		if err != nil {
+			return changed, err
+		}
+		sub.VAPIDPublicKey = publicKey
+		if err := b.Put(k, jsonify(sub)); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// migrateCommand implements `migrate status` and `migrate up [-dry-run]`,
+// it returns the exit code.
+func migrateCommand(storage *storage, args []string) int {
+	usage := "usage: migrate status | migrate up [-dry-run]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "status":
+		version, err := storage.SchemaVersion()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to read the schema version:", err)
+			return 1
+		}
+		pending, err := storage.PendingMigrations()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to read the pending migrations:", err)
+			return 1
+		}
+
+		fmt.Printf("schema version %d, %d pending migrations\n", version, len(pending))
+		for _, m := range pending {
+			fmt.Printf("  %d  %s\n", m.version, m.description)
+		}
+		return 0
+
+	case "up":
+		flags := flag.NewFlagSet("migrate up", flag.ContinueOnError)
+		dryRun := flags.Bool("dry-run", false, "report what the pending migrations would change without applying them")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		results, err := storage.Migrate(*dryRun)
+		for _, result := range results {
+			fmt.Printf("  %d  %s, %d records changed\n", result.Version, result.Description, result.Changed)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migration failed:", err)
+			return 1
+		}
+		if *dryRun {
+			fmt.Printf("dry run, %d migrations not applied\n", len(results))
+		} else {
+			fmt.Printf("%d migrations applied\n", len(results))
+		}
+		return 0
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// storePreKeySubscriptions stores subscriptions the way they were before
+// they recorded their VAPID key.
+func storePreKeySubscriptions(t *testing.T, storage *storage) {
+	t.Helper()
+	storage.AddSubscription("alice", StoredSubscription{Subscription: webpush.Subscription{Endpoint: "https://push.example/alice"}})
+	storage.AddSubscription("bob", StoredSubscription{Subscription: webpush.Subscription{Endpoint: "https://push.example/bob"}, VAPIDPublicKey: "bob-key"})
+	storage.AddSubscription("carol", StoredSubscription{Provider: ProviderFCM, DeviceToken: "carol-device"})
+}
+
+func useVAPIDKeys(t *testing.T, keys config.VAPIDKeys) {
+	t.Helper()
+	saved := vapidKeys
+	vapidKeys = keys
+	t.Cleanup(func() { vapidKeys = saved })
+}
+
+func TestMigrate(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storePreKeySubscriptions(t, storage)
+	useVAPIDKeys(t, config.VAPIDKeys{Active: config.VAPIDKeyPair{PublicKey: "active-key"}})
+
+	results, err := storage.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) || results[0].Changed != 1 {
+		t.Errorf("dry run = %+v", results)
+	}
+	if version, _ := storage.SchemaVersion(); version != 0 {
+		t.Errorf("schema version after a dry run = %d, want 0", version)
+	}
+	if sub, _ := storage.GetSubscription("alice"); sub.VAPIDPublicKey != "" {
+		t.Errorf("a dry run changed the subscription: %+v", sub)
+	}
+
+	results, err = storage.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) || results[0].Changed != 1 {
+		t.Errorf("Migrate = %+v", results)
+	}
+	if version, _ := storage.SchemaVersion(); version != migrations[len(migrations)-1].version {
+		t.Errorf("schema version = %d, want %d", version, migrations[len(migrations)-1].version)
+	}
+	if pending, _ := storage.PendingMigrations(); len(pending) != 0 {
+		t.Errorf("pending migrations after Migrate = %v", pending)
+	}
+	for user, want := range map[string]string{"alice": "active-key", "bob": "bob-key", "carol": ""} {
+		if sub, _ := storage.GetSubscription(user); sub.VAPIDPublicKey != want {
+			t.Errorf("%s's VAPID key = %q, want %q", user, sub.VAPIDPublicKey, want)
+		}
+	}
+
+	if results, err := storage.Migrate(false); err != nil || len(results) != 0 {
+		t.Errorf("Migrate again = %+v, %v, want nothing applied", results, err)
+	}
+}
+
+// after a rotation the active key may not be the one the old subscriptions
+// were created under
+func TestBackfillVAPIDKeyAfterRotation(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storePreKeySubscriptions(t, storage)
+	keys := config.VAPIDKeys{
+		Active: config.VAPIDKeyPair{PublicKey: "new-key"},
+		Legacy: []config.VAPIDKeyPair{{PublicKey: "original-key"}},
+	}
+	useVAPIDKeys(t, keys)
+
+	_, err := storage.Migrate(false)
+	if err == nil || !strings.Contains(err.Error(), "VAPID_BACKFILL_PUBLIC_KEY") {
+		t.Fatalf("Migrate after a rotation = %v, want an error asking for the key", err)
+	}
+	if version, _ := storage.SchemaVersion(); version != 0 {
+		t.Errorf("schema version after a refused migration = %d, want 0", version)
+	}
+
+	keys.BackfillPublicKey = "original-key"
+	useVAPIDKeys(t, keys)
+	if _, err := storage.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ := storage.GetSubscription("alice"); sub.VAPIDPublicKey != "original-key" {
+		t.Errorf("alice's VAPID key = %q, want original-key", sub.VAPIDPublicKey)
+	}
+}
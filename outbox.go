@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var outboxBucket = []byte("outbox")
+
+const outboxPollInterval = 30 * time.Second
+
+// outboxLease is how long a claimed entry stays in the outbox before it is
+// due again, in case the instance which claimed it stopped before sending
+// it
+const outboxLease = 10 * time.Minute
+
+// outboxEntry is a notification that has been held back and is due to be
+// sent at DueAt.
+type outboxEntry struct {
+	DueAt        time.Time           `json:"dueAt"`
+	Notification NotificationRequest `json:"notification"`
+}
+
+// claimedEntry is a due entry which has been leased to this instance, key
+// is where it is kept until it has been sent.
+type claimedEntry struct {
+	outboxEntry
+	key []byte
+}
+
+// Outbox persists deferred notifications in a storage bucket so that they
+// survive restarts, and sends them once they are due. Each channel which
+// defers notifications has its own bucket.
+//
+// send hands a notification over for delivery and reports whether it was
+// accepted, done must be called once it has been delivered. Entries stay
+// in the outbox until then, so that those left over by a shutdown or a
+// crash are sent by the next instance.
+type Outbox struct {
+	storage *storage
+	bucket  []byte
+	send    func(notif NotificationRequest, done func()) bool
+}
+
+func NewOutbox(storage *storage, bucket []byte, send func(notif NotificationRequest, done func()) bool) *Outbox {
+	return &Outbox{storage: storage, bucket: bucket, send: send}
+}
+
+// outboxKey orders entries by their due time, the bucket sequence keeps
+// keys unique when two entries are due at the same instant.
+func outboxKey(dueAt time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(dueAt.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func (o *Outbox) Defer(notif NotificationRequest, dueAt time.Time) error {
+	return o.storage.update(func(tx Tx) error {
+		b := tx.Bucket(o.bucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(dueAt, seq), jsonify(outboxEntry{
+			DueAt:        dueAt,
+			Notification: notif,
+		}))
+	})
+}
+
+// claimDue leases the entries which are due at now to this instance, they
+// are moved outboxLease ahead so that no other instance sends them in the
+// meantime.
+func (o *Outbox) claimDue(now time.Time) ([]claimedEntry, error) {
+	var due []claimedEntry
+	limit := outboxKey(now, 1<<64-1)
+
+	err := o.storage.update(func(tx Tx) error {
+		due = []claimedEntry{}
+		b := tx.Bucket(o.bucket)
+		c := b.Cursor()
+		claimed := [][]byte{}
+		for k, v := c.First(); k != nil && bytes.Compare(k, limit) <= 0; k, v = c.First() {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				slog.Error("dropping unreadable outbox entry", "bucket", string(o.bucket), "key", fmt.Sprintf("%x", k), "error", err)
+			} else {
+				due = append(due, claimedEntry{outboxEntry: entry})
+				claimed = append(claimed, append([]byte{}, v...))
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		// put back once the cursor is done with the bucket
+		for i := range due {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			due[i].key = outboxKey(now.Add(outboxLease), seq)
+			if err := b.Put(due[i].key, claimed[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return due, err
+}
+
+// remove deletes a claimed entry once it has been sent.
+func (o *Outbox) remove(key []byte) {
+	err := o.storage.update(func(tx Tx) error {
+		return tx.Bucket(o.bucket).Delete(key)
+	})
+	if err != nil {
+		slog.Error("unable to remove sent outbox entry", "bucket", string(o.bucket), "key", fmt.Sprintf("%x", key), "error", err)
+	}
+}
+
+// release makes a claimed entry which wasn't sent due again right away.
+func (o *Outbox) release(entry claimedEntry) {
+	err := o.storage.update(func(tx Tx) error {
+		b := tx.Bucket(o.bucket)
+		v := b.Get(entry.key)
+		if v == nil {
+			return nil
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(outboxKey(entry.DueAt, seq), v); err != nil {
+			return err
+		}
+		return b.Delete(entry.key)
+	})
+	if err != nil {
+		slog.Error("unable to release outbox entry", "bucket", string(o.bucket), "key", fmt.Sprintf("%x", entry.key), "error", err)
+	}
+}
+
+func (o *Outbox) flush() {
+	due, err := o.claimDue(time.Now())
+	if err != nil {
+		slog.Error("unable to read due outbox entries", "bucket", string(o.bucket), "error", err)
+		return
+	}
+
+	for _, entry := range due {
+		accepted := o.send(entry.Notification, func() {
+			o.remove(entry.key)
+		})
+		if !accepted {
+			o.release(entry)
+		}
+	}
+}
+
+// Run sends due entries every outboxPollInterval until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	o.flush()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.flush()
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func newTestBoltStorage(t *testing.T) *storage {
+	t.Helper()
+	backend, err := openBoltBackend(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return newTestStorage(t, backend)
+}
+
+func TestOutboxKeyOrder(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	keys := [][]byte{
+		outboxKey(base, 2),
+		outboxKey(base, 10),
+		outboxKey(base.Add(time.Nanosecond), 1),
+		outboxKey(base.Add(time.Hour), 0),
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Errorf("key %d doesn't sort before key %d", i-1, i)
+		}
+	}
+	if len(keys[0]) != 16 {
+		t.Errorf("key length = %d, want 16", len(keys[0]))
+	}
+}
+
+// outboxIDs returns the IDs of the entries due at now, without claiming
+// them.
+func outboxIDs(t *testing.T, s *storage, now time.Time) []string {
+	t.Helper()
+	ids := []string{}
+	limit := outboxKey(now, 1<<64-1)
+	s.view(func(tx Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, limit) <= 0; k, v = c.Next() {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, entry.Notification.ID)
+		}
+		return nil
+	})
+	return ids
+}
+
+func TestOutboxFlush(t *testing.T) {
+	s := newTestBoltStorage(t)
+	now := time.Now()
+
+	accept := true
+	sent := []string{}
+	dones := map[string]func(){}
+	outbox := NewOutbox(s, outboxBucket, func(notif NotificationRequest, done func()) bool {
+		if !accept {
+			return false
+		}
+		sent = append(sent, notif.ID)
+		dones[notif.ID] = done
+		return true
+	})
+
+	outbox.Defer(NotificationRequest{ID: "later"}, now.Add(time.Hour))
+	outbox.Defer(NotificationRequest{ID: "second"}, now.Add(-time.Minute))
+	outbox.Defer(NotificationRequest{ID: "first"}, now.Add(-time.Hour))
+
+	// a draining dispatcher refuses them, they stay due
+	accept = false
+	outbox.flush()
+	if got := outboxIDs(t, s, now); !equalKeys(got, []string{"first", "second"}) {
+		t.Fatalf("due after a refused flush = %q, want [first second]", got)
+	}
+
+	accept = true
+	outbox.flush()
+	if !equalKeys(sent, []string{"first", "second"}) {
+		t.Fatalf("sent = %q, want [first second]", sent)
+	}
+	// claimed but not delivered yet, no other flush picks them up
+	if got := outboxIDs(t, s, time.Now()); len(got) != 0 {
+		t.Errorf("due after the flush = %q, want none", got)
+	}
+
+	dones["first"]()
+	// second was never delivered, eg. the shutdown timed out, it is due
+	// again once the lease runs out
+	if got := outboxIDs(t, s, time.Now().Add(outboxLease+time.Second)); !equalKeys(got, []string{"second"}) {
+		t.Errorf("due after the lease = %q, want [second]", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/rivo/uniseg"
+)
+
+// A web push message is sent as a single aes128gcm record, push services
+// reject records larger than webpush.MaxRecordSize. The record is made of
+// a header (16 byte salt, 4 byte record size, 1 byte key id length and the
+// 65 byte public key) followed by the ciphertext, which is the payload, a
+// padding delimiter byte and a 16 byte authentication tag.
+const (
+	pushRecordHeaderSize = 16 + 4 + 1 + 65
+	pushPaddingDelimiter = 1
+	pushAuthTagSize      = 16
+)
+
+const ellipsis = "…"
+
+// truncation stops shortening the description and title at these many
+// graphemes and drops the optional fields instead
+const (
+	minDescriptionGraphemes = 64
+	minTitleGraphemes       = 32
+)
+
+var errPayloadTooLarge = errors.New("push payload is too large even after truncation")
+
+// PayloadTruncation describes what had to be cut from a push payload to fit
+// it in a single record.
+type PayloadTruncation struct {
+	Title         bool     `json:"title,omitempty"`
+	Description   bool     `json:"description,omitempty"`
+	DroppedFields []string `json:"droppedFields,omitempty"`
+}
+
+func (t PayloadTruncation) Truncated() bool {
+	return t.Title || t.Description || len(t.DroppedFields) > 0
+}
+
+func encryptedPushSize(payload []byte) int {
+	return pushRecordHeaderSize + len(payload) + pushPaddingDelimiter + pushAuthTagSize
+}
+
+// pushPayloadExcess returns by how many bytes the encrypted payload exceeds
+// the record size, zero or negative if it fits.
+func pushPayloadExcess(payload []byte) int {
+	return encryptedPushSize(payload) - int(webpush.MaxRecordSize)
+}
+
+// graphemeEnds returns the byte offset at which each grapheme cluster of s
+// ends.
+func graphemeEnds(s string) []int {
+	ends := []int{}
+	state := -1
+	offset := 0
+	rest := s
+	for len(rest) > 0 {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		offset += len(cluster)
+		ends = append(ends, offset)
+	}
+	return ends
+}
+
+// fitText shortens *text, on a grapheme boundary and with a trailing
+// ellipsis, to the longest prefix for which the payload of event fits. It
+// never keeps fewer than minGraphemes clusters and reports whether *text was
+// changed.
+func fitText(event *PushNotificationEvent, text *string, minGraphemes int) bool {
+	original := *text
+	ends := graphemeEnds(original)
+	if len(ends) <= minGraphemes {
+		return false
+	}
+
+	cut := func(n int) string {
+		if n == 0 {
+			return ellipsis
+		}
+		return original[:ends[n-1]] + ellipsis
+	}
+
+	// binary search for the most clusters that can be kept, json escaping
+	// makes the payload size non-linear in the text length
+	best := minGraphemes
+	lo, hi := minGraphemes+1, len(ends)-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		*text = cut(mid)
+		if pushPayloadExcess(jsonify(event)) <= 0 {
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	*text = cut(best)
+	return true
+}
+
+// optionalPushFields are dropped in this order, least important first, when
+// truncating the text is not enough.
+var optionalPushFields = []struct {
+	name string
+	drop func(*PushNotificationEvent)
+}{
+	{"image", func(e *PushNotificationEvent) { e.Image = "" }},
+	{"actions", func(e *PushNotificationEvent) { e.Actions = nil }},
+	{"badge", func(e *PushNotificationEvent) { e.Badge = "" }},
+	{"icon", func(e *PushNotificationEvent) { e.Icon = "" }},
+	{"tag", func(e *PushNotificationEvent) { e.Tag = ""; e.Renotify = false }},
+}
+
+// buildPushPayload serializes event, shortening the description and the
+// title on grapheme boundaries and then dropping optional fields until the
+// encrypted payload fits in a single web push record.
+func buildPushPayload(event PushNotificationEvent) ([]byte, PayloadTruncation, error) {
+	var truncation PayloadTruncation
+	description := event.Body
+
+	payload := jsonify(event)
+	if pushPayloadExcess(payload) > 0 {
+		truncation.Description = fitText(&event, &event.Body, minDescriptionGraphemes)
+		payload = jsonify(event)
+	}
+	if pushPayloadExcess(payload) > 0 {
+		truncation.Title = fitText(&event, &event.Title, minTitleGraphemes)
+		payload = jsonify(event)
+	}
+
+	for _, field := range optionalPushFields {
+		if pushPayloadExcess(payload) <= 0 {
+			break
+		}
+		field.drop(&event)
+		truncation.DroppedFields = append(truncation.DroppedFields, field.name)
+		payload = jsonify(event)
+	}
+
+	// dropping fields may have made room for more of the description
+	if len(truncation.DroppedFields) > 0 && truncation.Description && !truncation.Title {
+		event.Body = description
+		truncation.Description = pushPayloadExcess(jsonify(event)) > 0 && fitText(&event, &event.Body, minDescriptionGraphemes)
+		payload = jsonify(event)
+	}
+
+	if pushPayloadExcess(payload) > 0 {
+		return nil, truncation, errPayloadTooLarge
+	}
+	return payload, truncation, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+var testPushEvent = PushNotificationEvent{
+	Title: "New reply",
+	Body:  "someone replied to your post",
+	URL:   "/posts/1",
+	NotificationDisplay: NotificationDisplay{
+		Tag: "post-1",
+	},
+}
+
+func TestBuildPushPayloadFits(t *testing.T) {
+	payload, truncation, err := buildPushPayload(testPushEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncation.Truncated() {
+		t.Errorf("a small payload was truncated: %+v", truncation)
+	}
+	if string(payload) != string(jsonify(testPushEvent)) {
+		t.Errorf("payload = %s", payload)
+	}
+}
+
+func TestBuildPushPayloadTruncatesDescription(t *testing.T) {
+	event := testPushEvent
+	// family emojis are one grapheme of several code points, a cut inside
+	// one would leave half a family behind
+	event.Body = strings.Repeat("👨‍👩‍👧 ", 1000)
+
+	payload, truncation, err := buildPushPayload(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncation.Description || truncation.Title || len(truncation.DroppedFields) > 0 {
+		t.Errorf("truncation = %+v, want only the description", truncation)
+	}
+	if pushPayloadExcess(payload) > 0 {
+		t.Errorf("payload of %d bytes doesn't fit", len(payload))
+	}
+
+	var sent PushNotificationEvent
+	if err := json.Unmarshal(payload, &sent); err != nil {
+		t.Fatal(err)
+	}
+	body, found := strings.CutSuffix(sent.Body, ellipsis)
+	if !found || !utf8.ValidString(body) || !strings.HasSuffix(body, "👨‍👩‍👧") && !strings.HasSuffix(body, " ") {
+		t.Errorf("description cut inside a grapheme: %q", sent.Body[len(sent.Body)-32:])
+	}
+	// the cut keeps as much as fits, one more grapheme doesn't
+	if pushPayloadExcess(payload) < -len(" 👨‍👩‍👧")*2 {
+		t.Errorf("payload is %d bytes short of the limit, more of the description fits", -pushPayloadExcess(payload))
+	}
+}
+
+func TestBuildPushPayloadDropsFields(t *testing.T) {
+	event := testPushEvent
+	event.Title = strings.Repeat("t", 2000)
+	event.Body = strings.Repeat("d", 2000)
+	event.Image = "https://example.com/" + strings.Repeat("i", 3900)
+	event.Icon = "/icon.png"
+
+	payload, truncation, err := buildPushPayload(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncation.Title || !truncation.Description || !slices.Equal(truncation.DroppedFields, []string{"image"}) {
+		t.Errorf("truncation = %+v, want the title and description cut and the image dropped", truncation)
+	}
+
+	var sent PushNotificationEvent
+	json.Unmarshal(payload, &sent)
+	if sent.Image != "" || sent.Icon != "/icon.png" || sent.Tag != "post-1" {
+		t.Errorf("sent fields = image %q, icon %q, tag %q", sent.Image, sent.Icon, sent.Tag)
+	}
+}
+
+// once a dropped field makes room, the description gets it back
+func TestBuildPushPayloadRefitsDescription(t *testing.T) {
+	event := testPushEvent
+	event.Body = strings.Repeat("d", 3000)
+	event.Image = "https://example.com/" + strings.Repeat("i", 3950)
+
+	payload, truncation, err := buildPushPayload(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(truncation.DroppedFields, []string{"image"}) {
+		t.Errorf("truncation = %+v, want the image dropped", truncation)
+	}
+
+	var sent PushNotificationEvent
+	json.Unmarshal(payload, &sent)
+	if truncation.Description || sent.Body != event.Body {
+		t.Errorf("description of %d bytes sent, want all of it", len(sent.Body))
+	}
+}
+
+func TestBuildPushPayloadTooLarge(t *testing.T) {
+	event := testPushEvent
+	event.URL = "https://example.com/" + strings.Repeat("u", 5000)
+	if _, _, err := buildPushPayload(event); err != errPayloadTooLarge {
+		t.Errorf("buildPushPayload with a huge URL = %v, want errPayloadTooLarge", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+var preferencesBucket = []byte("preferences")
+
+// QuietHours is a daily window, in the user's own timezone, during which
+// push notifications are held back. Start and End are "HH:MM" clock times;
+// a window whose start is after its end wraps past midnight.
+type QuietHours struct {
+	Timezone string `json:"timezone"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+}
+
+type UserPreferences struct {
+	QuietHours *QuietHours `json:"quietHours,omitempty"`
+	// Locale picks the template variant, eg. "en" or "pt-BR"
+	Locale string `json:"locale,omitempty"`
+	// Email is where notifications left unread are sent
+	Email *EmailPreferences `json:"email,omitempty"`
+	// Topics are what the user follows, broadcasts can be sent to the
+	// followers of a topic
+	Topics []string `json:"topics,omitempty"`
+}
+
+func parseClock(clock string) (int, int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid clock time %q: %v", clock, err)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// Window reports whether now falls inside the quiet hours and, if it does,
+// the instant at which the window ends.
+func (q QuietHours) Window(now time.Time) (bool, time.Time, error) {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	startH, startM, err := parseClock(q.Start)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	endH, endM, err := parseClock(q.End)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	local := now.In(loc)
+	y, m, d := local.Date()
+	start := startH*60 + startM
+	end := endH*60 + endM
+	current := local.Hour()*60 + local.Minute()
+
+	switch {
+	case start == end:
+		// an empty window, quiet hours are effectively disabled
+		return false, time.Time{}, nil
+
+	case start < end:
+		if current >= start && current < end {
+			return true, time.Date(y, m, d, endH, endM, 0, 0, loc), nil
+		}
+
+	default:
+		// the window wraps past midnight, eg. 22:00 - 07:00
+		if current >= start {
+			return true, time.Date(y, m, d+1, endH, endM, 0, 0, loc), nil
+		}
+		if current < end {
+			return true, time.Date(y, m, d, endH, endM, 0, 0, loc), nil
+		}
+	}
+
+	return false, time.Time{}, nil
+}
+
+func (s *storage) GetPreferences(user string) (UserPreferences, error) {
+	var prefs UserPreferences
+	err := s.view(func(tx Tx) error {
+		b := tx.Bucket(preferencesBucket)
+		v := b.Get([]byte(user))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &prefs)
+	})
+
+	return prefs, err
+}
+
+// UpdatePreferences changes the stored preferences of the user with fn in
+// one transaction and returns the result.
+func (s *storage) UpdatePreferences(user string, fn func(prefs *UserPreferences)) (UserPreferences, error) {
+	var prefs UserPreferences
+	err := s.update(func(tx Tx) error {
+		prefs = UserPreferences{}
+		b := tx.Bucket(preferencesBucket)
+		if v := b.Get([]byte(user)); v != nil {
+			if err := json.Unmarshal(v, &prefs); err != nil {
+				return err
+			}
+		}
+		fn(&prefs)
+		return b.Put([]byte(user), jsonify(prefs))
+	})
+
+	return prefs, err
+}
+
+// Merge sets the fields of update which are present in the request body
+// reqMap, a field set to null is cleared. Leaving out the "enabled" flag of
+// the email keeps the stored one, so that changing the address doesn't
+// subscribe an unsubscribed user again.
+func (prefs *UserPreferences) Merge(reqMap map[string]any, update UserPreferences) {
+	if _, ok := reqMap["locale"]; ok {
+		prefs.Locale = update.Locale
+	}
+	if _, ok := reqMap["quietHours"]; ok {
+		prefs.QuietHours = update.QuietHours
+	}
+	if email, ok := reqMap["email"]; ok {
+		emailMap, _ := email.(map[string]any)
+		if _, ok := emailMap["enabled"]; !ok && update.Email != nil && prefs.Email != nil {
+			update.Email.Enabled = prefs.Email.Enabled
+		}
+		prefs.Email = update.Email
+	}
+	if _, ok := reqMap["topics"]; ok {
+		prefs.Topics = update.Topics
+	}
+}
+
+func (s *storage) SetPreferences(user string, prefs UserPreferences) error {
+	return s.update(func(tx Tx) error {
+		b := tx.Bucket(preferencesBucket)
+		return b.Put([]byte(user), jsonify(prefs))
+	})
+}
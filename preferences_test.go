@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestQuietHoursWindow(t *testing.T) {
+	kolkata, _ := time.LoadLocation("Asia/Kolkata")
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.March, day, hour, minute, 0, 0, kolkata)
+	}
+
+	tests := []struct {
+		name   string
+		quiet  QuietHours
+		now    time.Time
+		inside bool
+		end    time.Time
+	}{
+		{"same day, inside", QuietHours{"Asia/Kolkata", "13:00", "15:00"}, at(10, 14, 0), true, at(10, 15, 0)},
+		{"same day, at the end", QuietHours{"Asia/Kolkata", "13:00", "15:00"}, at(10, 15, 0), false, time.Time{}},
+		{"same day, before", QuietHours{"Asia/Kolkata", "13:00", "15:00"}, at(10, 12, 59), false, time.Time{}},
+		{"overnight, before midnight", QuietHours{"Asia/Kolkata", "22:00", "07:00"}, at(10, 23, 30), true, at(11, 7, 0)},
+		{"overnight, after midnight", QuietHours{"Asia/Kolkata", "22:00", "07:00"}, at(11, 6, 59), true, at(11, 7, 0)},
+		{"overnight, outside", QuietHours{"Asia/Kolkata", "22:00", "07:00"}, at(10, 12, 0), false, time.Time{}},
+		{"empty window", QuietHours{"Asia/Kolkata", "09:00", "09:00"}, at(10, 9, 0), false, time.Time{}},
+		// the window is in the user's timezone, not in the one of now
+		{"other timezone", QuietHours{"Asia/Kolkata", "22:00", "07:00"}, at(10, 23, 0).UTC(), true, at(11, 7, 0)},
+	}
+	for _, test := range tests {
+		inside, end, err := test.quiet.Window(test.now)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if inside != test.inside || !end.Equal(test.end) {
+			t.Errorf("%s: Window = %v, %v, want %v, %v", test.name, inside, end, test.inside, test.end)
+		}
+	}
+
+	if _, _, err := (QuietHours{"Nowhere/City", "22:00", "07:00"}).Window(time.Now()); err == nil {
+		t.Error("Window with an unknown timezone succeeded")
+	}
+}
+
+// updatePreferences applies a request body like PUT /preferences does.
+func updatePreferences(t *testing.T, storage *storage, user, body string) UserPreferences {
+	t.Helper()
+	var reqMap map[string]any
+	if err := json.Unmarshal([]byte(body), &reqMap); err != nil {
+		t.Fatal(err)
+	}
+	var update UserPreferences
+	if errs := preferencesSchema.Parse(reqMap, &update); errs != nil {
+		t.Fatalf("%s: %v", body, errs)
+	}
+	prefs, err := storage.UpdatePreferences(user, func(prefs *UserPreferences) {
+		prefs.Merge(reqMap, update)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefs
+}
+
+func TestUpdatePreferences(t *testing.T) {
+	storage := newTestBoltStorage(t)
+
+	updatePreferences(t, storage, "alice", `{"locale": "pt-BR", "topics": ["events"], "email": {"address": "alice@example.com", "enabled": true}}`)
+	prefs := updatePreferences(t, storage, "alice", `{"quietHours": {"timezone": "UTC", "start": "22:00", "end": "07:00"}}`)
+	if prefs.Locale != "pt-BR" || !slices.Equal(prefs.Topics, []string{"events"}) || prefs.Email == nil || !prefs.Email.Enabled || prefs.QuietHours == nil {
+		t.Errorf("preferences after setting the quiet hours = %+v", prefs)
+	}
+
+	prefs = updatePreferences(t, storage, "alice", `{"quietHours": null, "topics": []}`)
+	if prefs.QuietHours != nil || len(prefs.Topics) != 0 || prefs.Locale != "pt-BR" {
+		t.Errorf("preferences after clearing the quiet hours and topics = %+v", prefs)
+	}
+
+	// changing the address of an unsubscribed user keeps them unsubscribed
+	token, _ := unsubscribeToken("alice")
+	if err := storage.Unsubscribe(token); err != nil {
+		t.Fatal(err)
+	}
+	prefs = updatePreferences(t, storage, "alice", `{"email": {"address": "alice@example.org"}}`)
+	if prefs.Email == nil || prefs.Email.Address != "alice@example.org" || prefs.Email.Enabled {
+		t.Errorf("preferences after changing the address = %+v", prefs.Email)
+	}
+
+	stored, _ := storage.GetPreferences("alice")
+	if stored.Email == nil || stored.Email.Address != "alice@example.org" {
+		t.Errorf("stored preferences = %+v", stored)
+	}
+}
+
+func TestPreferencesSchema(t *testing.T) {
+	for body, valid := range map[string]bool{
+		`{"topics": ["news"], "quietHours": {"timezone": "Asia/Kolkata", "start": "22:00", "end": "07:00"}}`: true,
+		`{"topics": [""]}`: false,
+		`{"quietHours": {"timezone": "Mars/Olympus", "start": "22:00", "end": "07:00"}}`: false,
+		`{"quietHours": {"timezone": "UTC", "start": "24:00", "end": "07:00"}}`:          false,
+		`{"email": {"address": "not an address"}}`:                                       false,
+	} {
+		var reqMap map[string]any
+		if err := json.Unmarshal([]byte(body), &reqMap); err != nil {
+			t.Fatal(err)
+		}
+		var update UserPreferences
+		if got := preferencesSchema.Parse(reqMap, &update) == nil; got != valid {
+			t.Errorf("%s: valid = %v, want %v", body, got, valid)
+		}
+	}
+}
+
+// quietNow are quiet hours which are active at the time of the test.
+func quietNow() *QuietHours {
+	now := time.Now().UTC()
+	return &QuietHours{"UTC", now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")}
+}
+
+func TestHoldForQuietHours(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storage.SetPreferences("alice", UserPreferences{QuietHours: quietNow()})
+	outbox := NewOutbox(storage, outboxBucket, nil)
+	ctx := context.Background()
+
+	notif := NotificationRequest{User: "alice", Title: "t", Priority: PriorityNormal}
+	if !holdForQuietHours(ctx, storage, outbox, notif) {
+		t.Error("notification sent during quiet hours")
+	}
+	notif.Priority = PriorityCritical
+	if holdForQuietHours(ctx, storage, outbox, notif) {
+		t.Error("critical notification held during quiet hours")
+	}
+	notif.User = "bob"
+	notif.Priority = PriorityNormal
+	if holdForQuietHours(ctx, storage, outbox, notif) {
+		t.Error("notification held for a user without quiet hours")
+	}
+
+	entries := 0
+	storage.view(func(tx Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			entries++
+			return nil
+		})
+	})
+	if entries != 1 {
+		t.Errorf("%d notifications deferred, want 1", entries)
+	}
+}
+
+func TestHoldForQuietHoursFailedDefer(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storage.SetPreferences("alice", UserPreferences{QuietHours: quietNow()})
+
+	// an outbox whose database has gone away
+	backend, err := openBoltBackend(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outboxStorage := newTestStorage(t, backend)
+	backend.Close()
+	outbox := NewOutbox(outboxStorage, outboxBucket, nil)
+
+	notif := NotificationRequest{User: "alice", Title: "t", Priority: PriorityNormal}
+	if holdForQuietHours(context.Background(), storage, outbox, notif) {
+		t.Error("notification held although it couldn't be deferred")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	maxPresenceLookup       = 1000
+	presenceHeartbeatPeriod = 30 * time.Second
+)
+
+type PresenceRequest struct {
+	Users []string `json:"users"`
+}
+
+// isPresenceEvent reports whether the event belongs on the presence stream.
+func isPresenceEvent(event Event) bool {
+	return event.Type == EventUserConnected || event.Type == EventUserDisconnected
+}
+
+// writePresenceEvent writes the event as a server-sent event and flushes it
+// to the client.
+func writePresenceEvent(w http.ResponseWriter, event Event) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, jsonify(struct {
+		User string    `json:"user"`
+		Time time.Time `json:"time"`
+	}{event.User, event.Time}))
+	if err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
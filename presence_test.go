@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestIsPresenceEvent(t *testing.T) {
+	for eventType, want := range map[string]bool{
+		EventUserConnected:    true,
+		EventUserDisconnected: true,
+		EventNotificationRead: false,
+	} {
+		if got := isPresenceEvent(Event{Type: eventType}); got != want {
+			t.Errorf("isPresenceEvent(%s) = %v, want %v", eventType, got, want)
+		}
+	}
+}
+
+func TestWritePresenceEvent(t *testing.T) {
+	w := httptest.NewRecorder()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	event := Event{ID: "1", Type: EventUserConnected, User: "alice", Time: now, Channel: "websocket"}
+	if err := writePresenceEvent(w, event); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Flushed {
+		t.Error("presence event not flushed")
+	}
+
+	lines := strings.Split(w.Body.String(), "\n")
+	if len(lines) != 5 || lines[0] != "id: 1" || lines[1] != "event: "+EventUserConnected || lines[3] != "" || lines[4] != "" {
+		t.Fatalf("wrote %q", w.Body.String())
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data["user"] != "alice" || data["time"] != "2024-01-02T03:04:05Z" {
+		t.Errorf("data = %v", data)
+	}
+}
+
+func TestPresenceRequestSchema(t *testing.T) {
+	tooMany := make([]any, maxPresenceLookup+1)
+	for i := range tooMany {
+		tooMany[i] = "user"
+	}
+	for name, tc := range map[string]struct {
+		users any
+		valid bool
+	}{
+		"users":      {[]any{"alice", "bob"}, true},
+		"missing":    {nil, false},
+		"empty":      {[]any{}, false},
+		"empty user": {[]any{""}, false},
+		"too many":   {tooMany, false},
+	} {
+		reqMap := map[string]any{}
+		if tc.users != nil {
+			reqMap["users"] = tc.users
+		}
+		var req PresenceRequest
+		if valid := presenceRequestSchema.Parse(reqMap, &req) == nil; valid != tc.valid {
+			t.Errorf("%s: valid = %v, want %v", name, valid, tc.valid)
+		}
+	}
+}
@@ -1,57 +1,258 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
-	_ "github.com/joho/godotenv/autoload"
 )
 
-var vapidPublicKey string
-var vapidPrivateKey string
+var vapidKeys = conf.Push.VAPIDKeys
 
-func init() {
-	var found bool
-	vapidPublicKey, found = os.LookupEnv("VAPID_PUBLIC_KEY")
-	if !found {
-		fmt.Println(webpush.GenerateVAPIDKeys())
-		panic("VAPID PUBLIC KEY NOT SET")
-	}
-	vapidPrivateKey, found = os.LookupEnv("VAPID_PRIVATE_KEY")
-	if !found {
-		fmt.Println(webpush.GenerateVAPIDKeys())
-		panic("VAPID PRIVATE KEY NOT SET")
+var pushHTTPClient = newPushClient(conf.Push)
+
+// StoredSubscription is a push subscription of one of the push providers.
+// Web push subscriptions carry the VAPID public key they were created
+// under, pushes to them must be signed with the matching pair. FCM and APNs
+// subscriptions are identified by the device token of the app instead.
+type StoredSubscription struct {
+	Provider string `json:"provider,omitempty"`
+
+	webpush.Subscription
+	VAPIDPublicKey string `json:"vapidPublicKey,omitempty" zog:"vapidPublicKey"`
+
+	DeviceToken string `json:"deviceToken,omitempty"`
+}
+
+// ProviderName returns the subscription's provider, subscriptions stored
+// before there were several providers are all web push ones.
+func (sub StoredSubscription) ProviderName() string {
+	if sub.Provider == "" {
+		return ProviderWebPush
 	}
+	return sub.Provider
 }
 
 type PushNotificationEvent struct {
 	Body  string `json:"body"`
-	Icon  string `json:"icon"`
-	Image string `json:"image"`
-	Badge string `json:"badge"`
 	URL   string `json:"url"`
 	Title string `json:"title"`
+	NotificationDisplay
+}
+
+// pushDelivery is how a notification priority translates to the web push
+// Urgency and TTL headers.
+type pushDelivery struct {
+	Urgency webpush.Urgency
+	TTL     time.Duration
 }
 
-func sendPushNotification(notif PushNotificationEvent, subscription webpush.Subscription) {
-	_sendPushNotificationBytes(jsonify(notif), subscription)
+// normal priority notifications use the configured urgency and TTL
+var pushDeliveries = map[string]pushDelivery{
+	PriorityLow:      {Urgency: webpush.UrgencyLow, TTL: 12 * time.Hour},
+	PriorityNormal:   {Urgency: conf.Push.Urgency, TTL: conf.Push.DefaultTTL},
+	PriorityHigh:     {Urgency: webpush.UrgencyHigh, TTL: 3 * 24 * time.Hour},
+	PriorityCritical: {Urgency: webpush.UrgencyHigh, TTL: 7 * 24 * time.Hour},
+}
+
+func pushDeliveryFor(priority string) pushDelivery {
+	delivery, ok := pushDeliveries[priority]
+	if !ok {
+		return pushDeliveries[PriorityNormal]
+	}
+	return delivery
+}
+
+// maxPushTopicLength is the longest Topic header RFC 8030 allows.
+const maxPushTopicLength = 32
+
+var pushTopicRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// pushTopic derives the Topic header from the notification tag, so that the
+// push service only collapses the pending messages which would replace each
+// other on the device anyway. Tags which aren't valid topics are hashed.
+func pushTopic(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	if len(tag) <= maxPushTopicLength && pushTopicRegex.MatchString(tag) {
+		return tag
+	}
+	sum := sha256.Sum256([]byte(tag))
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:maxPushTopicLength]
 }
 
-func _sendPushNotificationBytes(message []byte, subscription webpush.Subscription) {
-	fmt.Println("sending this push notification:", string(message))
-	resp, err := webpush.SendNotification(message, &subscription, &webpush.Options{
-		Subscriber: "dev.shravan@proton.me",
-		VAPIDPublicKey: vapidPublicKey,
-		VAPIDPrivateKey: vapidPrivateKey,
-		Urgency: webpush.UrgencyNormal,
+func _sendPushNotificationBytes(ctx context.Context, message []byte, subscription StoredSubscription, priority, topic string) DeliveryResult {
+	result := DeliveryResult{Channel: ChannelPush}
+	delivery := pushDeliveryFor(priority)
+
+	keyPair, ok := vapidKeys.Lookup(subscription.VAPIDPublicKey)
+	if !ok {
+		slog.ErrorContext(ctx, "no VAPID key pair for the subscription's public key", "vapid_public_key", subscription.VAPIDPublicKey)
+		result.Error = "unknown VAPID public key"
+		return result
+	}
+
+	slog.DebugContext(ctx, "sending web push notification", "endpoint", subscription.Endpoint, "size", len(message))
+	resp, err := webpush.SendNotificationWithContext(ctx, message, &subscription.Subscription, &webpush.Options{
+		HTTPClient:      pushHTTPClient,
+		Subscriber:      conf.Push.Subscriber,
+		VAPIDPublicKey:  keyPair.PublicKey,
+		VAPIDPrivateKey: keyPair.PrivateKey,
+		Urgency:         delivery.Urgency,
+		TTL:             int(delivery.TTL.Seconds()),
+		Topic:           topic,
 	})
 
 	if err != nil {
-		log.Println("unable to send push notification", err)
-		return
+		slog.WarnContext(ctx, "unable to send push notification", "endpoint", subscription.Endpoint, "error", err)
+		result.Error = err.Error()
+		return result
 	}
 
 	defer resp.Body.Close()
-}
\ No newline at end of file
+	result.StatusCode = resp.StatusCode
+	result.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !result.Delivered {
+		result.Error = resp.Status
+	}
+	return result
+}
+
+// holdForQuietHours checks the user's quiet hours and, if they are active,
+// drops or defers the push notification according to its priority.
+// It returns true if the notification must not be sent right now.
+func holdForQuietHours(ctx context.Context, storage Storage, outbox *Outbox, notif NotificationRequest) bool {
+	if notif.Priority == PriorityCritical {
+		return false
+	}
+
+	prefs, err := storage.GetPreferences(notif.User)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to get user preferences", "user", notif.User, "error", err)
+		return false
+	}
+	if prefs.QuietHours == nil {
+		return false
+	}
+
+	quiet, windowEnd, err := prefs.QuietHours.Window(time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "invalid quiet hours in user preferences", "user", notif.User, "error", err)
+		return false
+	}
+	if !quiet {
+		return false
+	}
+
+	if notif.Priority == PriorityLow {
+		notificationsTotal.Inc(ChannelPush, OutcomeDropped)
+		slog.DebugContext(ctx, "dropped low priority push during quiet hours", "user", notif.User)
+		return true
+	}
+
+	if err := outbox.Defer(notif, windowEnd); err != nil {
+		// sending it now beats losing it
+		slog.ErrorContext(ctx, "unable to defer push notification, sending it now", "user", notif.User, "error", err)
+		return false
+	}
+	slog.DebugContext(ctx, "deferred push until the end of quiet hours", "user", notif.User, "due_at", windowEnd)
+	notificationsTotal.Inc(ChannelPush, OutcomeDeferred)
+	return true
+}
+
+// subscriptionGone reports whether the push service says the subscription
+// has expired or was unsubscribed, it will never accept pushes again.
+func subscriptionGone(result DeliveryResult) bool {
+	return result.StatusCode == http.StatusNotFound || result.StatusCode == http.StatusGone
+}
+
+// recordPushResult publishes the outcome of a push and prunes the
+// subscription if the push service no longer knows it.
+func recordPushResult(ctx context.Context, storage Storage, notificationID string, sub StoredSubscription, result DeliveryResult) {
+	if result.Delivered {
+		notificationsTotal.Inc(ChannelPush, OutcomeDelivered)
+		events.Publish(Event{
+			Type:           EventNotificationDelivered,
+			User:           result.User,
+			NotificationID: notificationID,
+			Channel:        ChannelPush,
+			StatusCode:     result.StatusCode,
+		})
+		return
+	}
+
+	slog.WarnContext(ctx, "push notification not delivered",
+		"user", result.User,
+		"provider", sub.ProviderName(),
+		"status", result.StatusCode,
+		"error", result.Error,
+	)
+	notificationsTotal.Inc(ChannelPush, OutcomeFailed)
+	events.Publish(Event{
+		Type:           EventPushFailed,
+		User:           result.User,
+		NotificationID: notificationID,
+		Channel:        ChannelPush,
+		StatusCode:     result.StatusCode,
+		Error:          result.Error,
+	})
+
+	if !subscriptionGone(result) {
+		return
+	}
+	removed, err := storage.RemoveSubscription(result.User, sub)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to prune push subscription", "user", result.User, "error", err)
+		return
+	}
+	if removed {
+		slog.InfoContext(ctx, "pruned expired push subscription", "user", result.User, "provider", sub.ProviderName())
+		events.Publish(Event{
+			Type:       EventSubscriptionPruned,
+			User:       result.User,
+			Channel:    ChannelPush,
+			StatusCode: result.StatusCode,
+		})
+	}
+}
+
+// deliverPush sends the notification to the user's push subscription, the
+// throttle is nil for the notifications which were already admitted.
+func deliverPush(ctx context.Context, storage Storage, outbox *Outbox, throttle *Throttle, notif NotificationRequest) {
+	sub, err := storage.GetSubscription(notif.User)
+	if errors.Is(err, errSubscriptionNotFound) {
+		slog.DebugContext(ctx, "no push subscription for user", "user", notif.User)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to get push subscription", "user", notif.User, "error", err)
+		notificationsTotal.Inc(ChannelPush, OutcomeFailed)
+		return
+	}
+
+	if throttle != nil {
+		admitted := throttle.Admit(ctx, ChannelPush, notif, func(notif NotificationRequest, at time.Time) {
+			if err := outbox.Defer(notif, at); err != nil {
+				slog.ErrorContext(ctx, "unable to defer throttled push notification", "user", notif.User, "error", err)
+			}
+		})
+		if !admitted {
+			return
+		}
+	}
+
+	if holdForQuietHours(ctx, storage, outbox, notif) {
+		return
+	}
+
+	result := sendPushNotification(ctx, notif.PushEvent(), sub, notif.Priority)
+	result.User = notif.User
+	recordPushResult(ctx, storage, notif.ID, sub, result)
+}
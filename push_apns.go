@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/shravanasati/everynyan-notification-service/config"
+)
+
+// APNs rejects provider tokens older than an hour and throttles the ones
+// refreshed more often than every 20 minutes
+const apnsTokenLifetime = 50 * time.Minute
+
+// apnsProvider sends notifications to the iOS app over APNs, authenticating
+// with a provider token signed by the team's .p8 key.
+type apnsProvider struct {
+	client webpush.HTTPClient
+	conf   config.APNsConfig
+	key    *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	token       string
+	tokenIssued time.Time
+}
+
+func newAPNsProvider(conf config.APNsConfig, client webpush.HTTPClient) (*apnsProvider, error) {
+	keyPEM, err := os.ReadFile(conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("APNs key file is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not an ECDSA key")
+	}
+
+	return &apnsProvider{client: client, conf: conf, key: key}, nil
+}
+
+// providerToken returns the ES256 signed JWT APNs expects, reusing it for
+// apnsTokenLifetime.
+func (p *apnsProvider) providerToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && time.Since(p.tokenIssued) < apnsTokenLifetime {
+		return p.token, nil
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString(jsonify(map[string]string{
+		"alg": "ES256",
+		"kid": p.conf.KeyID,
+	}))
+	claims := base64.RawURLEncoding.EncodeToString(jsonify(map[string]any{
+		"iss": p.conf.TeamID,
+		"iat": now.Unix(),
+	}))
+	signingInput := header + "." + claims
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants the raw 32 byte r and s, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	p.token = signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	p.tokenIssued = now
+	return p.token, nil
+}
+
+type apnsAlert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type apnsAps struct {
+	Alert             apnsAlert `json:"alert"`
+	Sound             string    `json:"sound,omitempty"`
+	ThreadID          string    `json:"thread-id,omitempty"`
+	MutableContent    int       `json:"mutable-content,omitempty"`
+	InterruptionLevel string    `json:"interruption-level,omitempty"`
+}
+
+type apnsPayload struct {
+	Aps     apnsAps              `json:"aps"`
+	URL     string               `json:"url,omitempty"`
+	Image   string               `json:"image,omitempty"`
+	Actions []NotificationAction `json:"actions,omitempty"`
+}
+
+func (p *apnsProvider) Send(ctx context.Context, sub StoredSubscription, event PushNotificationEvent, priority string) DeliveryResult {
+	result := DeliveryResult{Channel: ChannelPush}
+
+	token, err := p.providerToken()
+	if err != nil {
+		result.Error = "unable to sign APNs provider token: " + err.Error()
+		return result
+	}
+
+	payload := apnsPayload{
+		Aps: apnsAps{
+			Alert:    apnsAlert{Title: event.Title, Body: event.Body},
+			Sound:    "default",
+			ThreadID: event.Tag,
+		},
+		URL:     event.URL,
+		Image:   absoluteURL(event.Image),
+		Actions: event.Actions,
+	}
+	if event.Silent {
+		payload.Aps.Sound = ""
+	}
+	if payload.Image != "" {
+		// lets the notification service extension attach the image
+		payload.Aps.MutableContent = 1
+	}
+	if priority == PriorityCritical {
+		payload.Aps.InterruptionLevel = "time-sensitive"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.conf.Endpoint+"/3/device/"+sub.DeviceToken, bytes.NewReader(jsonify(payload)))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	delivery := pushDeliveryFor(priority)
+	apnsPriority := "10"
+	if priority == PriorityLow {
+		apnsPriority = "5"
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", p.conf.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", apnsPriority)
+	req.Header.Set("apns-expiration", strconv.FormatInt(time.Now().Add(delivery.TTL).Unix(), 10))
+	if event.Tag != "" {
+		req.Header.Set("apns-collapse-id", event.Tag)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.Delivered = resp.StatusCode == http.StatusOK
+	if !result.Delivered {
+		var reason struct {
+			Reason string `json:"reason"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		json.Unmarshal(body, &reason)
+		result.Error = fmt.Sprintf("%s: %s", resp.Status, reason.Reason)
+	}
+	return result
+}
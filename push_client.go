@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// pushClient is the HTTP client shared by every request to the push
+// services. It reuses connections through a single tuned transport and
+// limits, per push service host, both how many requests are in flight and
+// how many are started per second, so that a broadcast does not get us
+// throttled by FCM, Mozilla autopush or Apple.
+type pushClient struct {
+	client *http.Client
+	// slots caps the number of requests in flight across all hosts
+	slots chan struct{}
+
+	perHostConcurrency int
+	perHostRate        rate.Limit
+	perHostBurst       int
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+type hostLimit struct {
+	slots   chan struct{}
+	limiter *rate.Limiter
+}
+
+func newPushTransport(pushConfig config.PushConfig) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   pushConfig.MaxConcurrentPerHost,
+		MaxConnsPerHost:       pushConfig.MaxConcurrentPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: pushConfig.HTTPTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if pushConfig.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(pushConfig.ProxyURL)
+	}
+
+	return transport
+}
+
+func newPushClient(pushConfig config.PushConfig) *pushClient {
+	return &pushClient{
+		client: &http.Client{
+			Timeout:   pushConfig.HTTPTimeout,
+			Transport: newPushTransport(pushConfig),
+		},
+		slots:              make(chan struct{}, pushConfig.MaxConcurrentRequests),
+		perHostConcurrency: pushConfig.MaxConcurrentPerHost,
+		perHostRate:        rate.Limit(pushConfig.RateLimitPerHost),
+		perHostBurst:       pushConfig.RateBurstPerHost,
+		hosts:              make(map[string]*hostLimit),
+	}
+}
+
+func (c *pushClient) hostLimit(host string) *hostLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit, ok := c.hosts[host]
+	if !ok {
+		limit = &hostLimit{
+			slots:   make(chan struct{}, c.perHostConcurrency),
+			limiter: rate.NewLimiter(c.perHostRate, c.perHostBurst),
+		}
+		c.hosts[host] = limit
+	}
+	return limit
+}
+
+// Do implements webpush.HTTPClient, it waits for a free slot and for the
+// host's rate limit before sending the request.
+func (c *pushClient) Do(req *http.Request) (resp *http.Response, err error) {
+	ctx, span := tracer.Start(req.Context(), req.Method+" "+req.URL.Host, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+	))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		endSpan(span, err)
+	}()
+	req = req.WithContext(ctx)
+	limit := c.hostLimit(req.URL.Host)
+
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.slots }()
+
+	select {
+	case limit.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-limit.slots }()
+
+	if err := limit.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	span.AddEvent("acquired push service slot")
+
+	return c.client.Do(req)
+}
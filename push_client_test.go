@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func testPushConfig() config.PushConfig {
+	return config.PushConfig{
+		HTTPTimeout:           5 * time.Second,
+		MaxConcurrentRequests: 64,
+		MaxConcurrentPerHost:  2,
+		RateLimitPerHost:      1000,
+		RateBurstPerHost:      1000,
+	}
+}
+
+func TestPushClientPerHostConcurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			highest := maxInFlight.Load()
+			if n <= highest || maxInFlight.CompareAndSwap(highest, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := newPushClient(testPushConfig())
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := maxInFlight.Load(); got != 2 {
+		t.Errorf("%d requests were in flight at once, want the per host limit of 2", got)
+	}
+}
+
+func TestPushClientPerHostRate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	pushConfig := testPushConfig()
+	pushConfig.RateLimitPerHost = 20
+	pushConfig.RateBurstPerHost = 1
+	client := newPushClient(pushConfig)
+
+	start := time.Now()
+	for range 5 {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// the first request uses the burst, the other four wait 50ms each
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("5 requests at 20 per second took %v", elapsed)
+	}
+
+	// a request waiting for the limit gives up with its context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, nil)
+	if _, err := client.Do(req); err == nil {
+		t.Error("a request with a cancelled context was sent")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/api/option"
+)
+
+// fcmProvider sends notifications to the mobile apps over FCM HTTP v1,
+// using the firebase app which is already set up for firestore.
+type fcmProvider struct {
+	// endpoint overrides the FCM endpoint, eg. for a local fake, the app
+	// for it is created from config and credentials
+	endpoint    string
+	config      *firebase.Config
+	credentials option.ClientOption
+
+	once   sync.Once
+	client *messaging.Client
+	err    error
+}
+
+func newFCMProvider(endpoint string) *fcmProvider {
+	return &fcmProvider{endpoint: endpoint, credentials: firebaseCredentials}
+}
+
+// messagingClient creates the client on first use, the firebase app is only
+// set up once main runs.
+func (p *fcmProvider) messagingClient(ctx context.Context) (*messaging.Client, error) {
+	p.once.Do(func() {
+		app := firebaseApp
+		if p.endpoint != "" {
+			app, p.err = firebase.NewApp(ctx, p.config, p.credentials, option.WithEndpoint(p.endpoint))
+			if p.err != nil {
+				return
+			}
+		}
+		p.client, p.err = app.Messaging(ctx)
+	})
+
+	return p.client, p.err
+}
+
+// absoluteURL filters out the site relative defaults, FCM only accepts
+// absolute image URLs.
+func absoluteURL(u string) string {
+	if strings.HasPrefix(u, "https://") {
+		return u
+	}
+	return ""
+}
+
+func (p *fcmProvider) Send(ctx context.Context, sub StoredSubscription, event PushNotificationEvent, priority string) DeliveryResult {
+	result := DeliveryResult{Channel: ChannelPush}
+	client, err := p.messagingClient(ctx)
+	if err != nil {
+		result.Error = "unable to initialize FCM: " + err.Error()
+		return result
+	}
+
+	delivery := pushDeliveryFor(priority)
+	androidPriority := "normal"
+	if priority == PriorityHigh || priority == PriorityCritical {
+		androidPriority = "high"
+	}
+	data := map[string]string{"url": event.URL}
+	if len(event.Actions) > 0 {
+		data["actions"] = string(jsonify(event.Actions))
+	}
+
+	_, err = client.Send(ctx, &messaging.Message{
+		Token: sub.DeviceToken,
+		Notification: &messaging.Notification{
+			Title:    event.Title,
+			Body:     event.Body,
+			ImageURL: absoluteURL(event.Image),
+		},
+		Data: data,
+		Android: &messaging.AndroidConfig{
+			Priority:    androidPriority,
+			TTL:         &delivery.TTL,
+			CollapseKey: event.Tag,
+			Notification: &messaging.AndroidNotification{
+				Tag: event.Tag,
+			},
+		},
+	})
+	if err != nil {
+		result.Error = err.Error()
+		if messaging.IsUnregistered(err) {
+			// same as a web push service telling us the subscription is gone
+			result.StatusCode = http.StatusGone
+		}
+		return result
+	}
+
+	result.Delivered = true
+	result.StatusCode = http.StatusOK
+	return result
+}
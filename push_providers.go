@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ProviderWebPush = "webpush"
+	ProviderFCM     = "fcm"
+	ProviderAPNs    = "apns"
+)
+
+var providerNames = []string{ProviderWebPush, ProviderFCM, ProviderAPNs}
+
+// PushProvider delivers a push notification to a subscription of its kind,
+// browser subscriptions go over Web Push (which also covers Safari through
+// Apple's web push service) and the mobile apps over FCM or APNs.
+type PushProvider interface {
+	Send(ctx context.Context, sub StoredSubscription, event PushNotificationEvent, priority string) DeliveryResult
+}
+
+var pushProviders = newPushProviders()
+
+func newPushProviders() map[string]PushProvider {
+	providers := map[string]PushProvider{
+		ProviderWebPush: webPushProvider{},
+		ProviderFCM:     newFCMProvider(conf.Push.FCMEndpoint),
+	}
+
+	if conf.Push.APNs != nil {
+		apns, err := newAPNsProvider(*conf.Push.APNs, pushHTTPClient)
+		if err != nil {
+			panic("unable to initialize APNs: " + err.Error())
+		}
+		providers[ProviderAPNs] = apns
+	}
+
+	return providers
+}
+
+type webPushProvider struct{}
+
+func (webPushProvider) Send(ctx context.Context, sub StoredSubscription, event PushNotificationEvent, priority string) DeliveryResult {
+	message, truncation, err := buildPushPayload(event)
+	if err != nil {
+		return DeliveryResult{Channel: ChannelPush, Error: err.Error(), Truncation: truncation}
+	}
+
+	result := _sendPushNotificationBytes(ctx, message, sub, priority, pushTopic(event.Tag))
+	result.Truncation = truncation
+	return result
+}
+
+func sendPushNotification(ctx context.Context, notif PushNotificationEvent, subscription StoredSubscription, priority string) DeliveryResult {
+	provider, ok := pushProviders[subscription.ProviderName()]
+	if !ok {
+		slog.ErrorContext(ctx, "no push provider configured", "provider", subscription.ProviderName())
+		return DeliveryResult{
+			Channel: ChannelPush,
+			Error:   fmt.Sprintf("push provider %s is not configured", subscription.ProviderName()),
+		}
+	}
+
+	ctx, span := tracer.Start(ctx, "push.send", trace.WithAttributes(
+		attribute.String("push.provider", subscription.ProviderName()),
+		attribute.String("notification.priority", priority),
+	))
+	start := time.Now()
+	result := provider.Send(ctx, subscription, notif, priority)
+	pushDuration.ObserveSince(start, subscription.ProviderName())
+	endDeliverySpan(span, result)
+	if result.Truncation.Truncated() {
+		slog.InfoContext(ctx, "push payload truncated",
+			"title", result.Truncation.Title,
+			"description", result.Truncation.Description,
+			"dropped_fields", result.Truncation.DroppedFields,
+		)
+	}
+	return result
+}
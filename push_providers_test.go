@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	firebase "firebase.google.com/go/v4"
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+	"google.golang.org/api/option"
+)
+
+// verifyES256 checks the signature of a JWT signed by the APNs provider.
+func verifyES256(t *testing.T, token string, key *ecdsa.PublicKey) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("provider token %q is not a JWT", token)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("invalid JWT signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		t.Fatal("provider token signature does not verify")
+	}
+
+	claims := map[string]any{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+	return claims
+}
+
+func newTestAPNsProvider(t *testing.T, endpoint string, client *http.Client) (*apnsProvider, *ecdsa.PublicKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "AuthKey.p8")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := newAPNsProvider(config.APNsConfig{
+		KeyFile:  keyFile,
+		KeyID:    "KEYID12345",
+		TeamID:   "TEAMID1234",
+		Topic:    "com.everynyan.app",
+		Endpoint: endpoint,
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider, &key.PublicKey
+}
+
+func TestAPNsProvider(t *testing.T) {
+	var publicKey *ecdsa.PublicKey
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		token, found := strings.CutPrefix(r.Header.Get("authorization"), "bearer ")
+		if !found {
+			t.Errorf("authorization = %q, want a bearer token", r.Header.Get("authorization"))
+		}
+		claims := verifyES256(t, token, publicKey)
+		if claims["iss"] != "TEAMID1234" {
+			t.Errorf("token issuer = %v, want the team ID", claims["iss"])
+		}
+		if r.Header.Get("apns-topic") != "com.everynyan.app" || r.Header.Get("apns-collapse-id") != "post-1" {
+			t.Errorf("headers = %v", r.Header)
+		}
+
+		var payload apnsPayload
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("payload %s: %v", body, err)
+		}
+		if payload.Aps.Alert.Title != testPushEvent.Title || payload.URL != testPushEvent.URL {
+			t.Errorf("payload = %s", body)
+		}
+
+		switch r.URL.Path {
+		case "/3/device/valid-token":
+			w.WriteHeader(http.StatusOK)
+		case "/3/device/expired-token":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		}
+	}))
+	defer server.Close()
+
+	provider, key := newTestAPNsProvider(t, server.URL, server.Client())
+	publicKey = key
+
+	result := provider.Send(context.Background(), StoredSubscription{Provider: ProviderAPNs, DeviceToken: "valid-token"}, testPushEvent, PriorityNormal)
+	if !result.Delivered || result.StatusCode != http.StatusOK {
+		t.Errorf("Send = %+v, want delivered", result)
+	}
+
+	result = provider.Send(context.Background(), StoredSubscription{Provider: ProviderAPNs, DeviceToken: "expired-token"}, testPushEvent, PriorityNormal)
+	if result.Delivered || !subscriptionGone(result) || !strings.Contains(result.Error, "Unregistered") {
+		t.Errorf("Send to an expired token = %+v, want the subscription gone", result)
+	}
+}
+
+func newTestFCMProvider(endpoint string) *fcmProvider {
+	return &fcmProvider{
+		endpoint:    endpoint,
+		config:      &firebase.Config{ProjectID: "everynyan-test"},
+		credentials: option.WithoutAuthentication(),
+	}
+}
+
+func TestFCMProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/everynyan-test/messages:send" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		var req struct {
+			Message struct {
+				Token        string            `json:"token"`
+				Notification map[string]string `json:"notification"`
+				Data         map[string]string `json:"data"`
+				Android      struct {
+					CollapseKey string `json:"collapse_key"`
+				} `json:"android"`
+			} `json:"message"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("request %s: %v", body, err)
+		}
+		if req.Message.Notification["title"] != testPushEvent.Title || req.Message.Data["url"] != testPushEvent.URL || req.Message.Android.CollapseKey != "post-1" {
+			t.Errorf("request = %s", body)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if req.Message.Token == "expired-token" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "Requested entity was not found.", "status": "NOT_FOUND",
+				"details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`))
+			return
+		}
+		w.Write([]byte(`{"name": "projects/everynyan-test/messages/1"}`))
+	}))
+	defer server.Close()
+
+	provider := newTestFCMProvider(server.URL)
+
+	result := provider.Send(context.Background(), StoredSubscription{Provider: ProviderFCM, DeviceToken: "valid-token"}, testPushEvent, PriorityHigh)
+	if !result.Delivered {
+		t.Errorf("Send = %+v, want delivered", result)
+	}
+
+	result = provider.Send(context.Background(), StoredSubscription{Provider: ProviderFCM, DeviceToken: "expired-token"}, testPushEvent, PriorityHigh)
+	if result.Delivered || !subscriptionGone(result) {
+		t.Errorf("Send to an unregistered token = %+v, want the subscription gone", result)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/SherClockHolmes/webpush-go"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestPushTopic(t *testing.T) {
+	valid := regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	for _, tag := range []string{"post-1", "comment:42", "a tag with spaces", "a-tag-which-is-much-longer-than-thirty-two-characters"} {
+		topic := pushTopic(tag)
+		if !valid.MatchString(topic) {
+			t.Errorf("pushTopic(%q) = %q, not a valid topic", tag, topic)
+		}
+		if pushTopic(tag) != topic {
+			t.Errorf("pushTopic(%q) is not stable", tag)
+		}
+	}
+	if pushTopic("post-1") != "post-1" {
+		t.Errorf("pushTopic(post-1) = %q, valid topics are used as they are", pushTopic("post-1"))
+	}
+	if pushTopic("comment:1") == pushTopic("comment:2") {
+		t.Error("different tags give the same topic")
+	}
+	if pushTopic("") != "" {
+		t.Error("a notification without a tag has a topic")
+	}
+}
+
+// testWebPushSubscription creates a subscription with browser keys, for an
+// endpoint on the test server.
+func testWebPushSubscription(t *testing.T, endpoint string) StoredSubscription {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	return StoredSubscription{
+		Subscription: webpush.Subscription{
+			Endpoint: endpoint,
+			Keys: webpush.Keys{
+				P256dh: base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+				Auth:   base64.RawURLEncoding.EncodeToString(auth),
+			},
+		},
+		VAPIDPublicKey: vapidKeys.Active.PublicKey,
+	}
+}
+
+func TestWebPushHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sub := testWebPushSubscription(t, server.URL+"/push/1")
+	for _, test := range []struct {
+		tag, priority, urgency, topic string
+	}{
+		{"post-1", PriorityLow, "low", "post-1"},
+		// low priority notifications without a tag aren't collapsed
+		{"", PriorityLow, "low", ""},
+		{"", PriorityHigh, "high", ""},
+	} {
+		event := testPushEvent
+		event.Tag = test.tag
+		result := webPushProvider{}.Send(context.Background(), sub, event, test.priority)
+		if !result.Delivered {
+			t.Fatalf("Send = %+v, want delivered", result)
+		}
+
+		h := <-headers
+		if h.Get("Urgency") != test.urgency || h.Get("Topic") != test.topic {
+			t.Errorf("tag %q, priority %s: Urgency %q, Topic %q, want %q, %q", test.tag, test.priority, h.Get("Urgency"), h.Get("Topic"), test.urgency, test.topic)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var quarantineBucket = []byte("quarantine")
+
+var errQuarantinedRecordNotFound = errors.New("quarantined record not found")
+
+// errCorruptRecord is returned by reads which found a record that doesn't
+// decode, the record is moved to the quarantine bucket.
+var errCorruptRecord = errors.New("corrupt record")
+
+// QuarantinedRecord is a record which couldn't be decoded, it is kept as is
+// so that it can be inspected and repaired by hand.
+type QuarantinedRecord struct {
+	ID     string    `json:"id"`
+	Bucket string    `json:"bucket"`
+	Key    string    `json:"key"`
+	Value  []byte    `json:"value"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// corruptRecord is a record found by a read transaction, it is quarantined
+// once the transaction has ended.
+type corruptRecord struct {
+	bucket, key, value []byte
+	reason             string
+}
+
+func newCorruptRecord(bucket, key, value []byte, reason error) corruptRecord {
+	return corruptRecord{
+		bucket: bytes.Clone(bucket),
+		key:    bytes.Clone(key),
+		value:  bytes.Clone(value),
+		reason: reason.Error(),
+	}
+}
+
+// quarantineTx moves the record out of its bucket within tx.
+func quarantineTx(tx Tx, record corruptRecord) error {
+	q := tx.Bucket(quarantineBucket)
+	seq, err := q.NextSequence()
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, seq)
+
+	err = q.Put(id, jsonify(QuarantinedRecord{
+		ID:     hex.EncodeToString(id),
+		Bucket: string(record.bucket),
+		Key:    string(record.key),
+		Value:  record.value,
+		Reason: record.reason,
+		Time:   time.Now().UTC(),
+	}))
+	if err != nil {
+		return err
+	}
+
+	slog.Error("quarantined corrupt record", "bucket", string(record.bucket), "key", string(record.key), "reason", record.reason)
+	quarantinedRecordsTotal.Inc(string(record.bucket))
+	return tx.Bucket(record.bucket).Delete(record.key)
+}
+
+// quarantine moves the records found by a read transaction, unless they
+// have been overwritten in the meantime.
+func (s *storage) quarantine(records ...corruptRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	err := s.update(func(tx Tx) error {
+		for _, record := range records {
+			if !bytes.Equal(tx.Bucket(record.bucket).Get(record.key), record.value) {
+				continue
+			}
+			if err := quarantineTx(tx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("unable to quarantine corrupt records", "error", err)
+	}
+}
+
+func (s *storage) GetQuarantinedRecords() ([]QuarantinedRecord, error) {
+	records := []QuarantinedRecord{}
+	err := s.view(func(tx Tx) error {
+		return tx.Bucket(quarantineBucket).ForEach(func(k, v []byte) error {
+			var record QuarantinedRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("quarantined record %x: %w", k, err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+
+	return records, err
+}
+
+// PurgeQuarantinedRecord deletes a quarantined record for good.
+func (s *storage) PurgeQuarantinedRecord(id string) error {
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		return errQuarantinedRecordNotFound
+	}
+
+	return s.update(func(tx Tx) error {
+		b := tx.Bucket(quarantineBucket)
+		if b.Get(key) == nil {
+			return errQuarantinedRecordNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+// PurgeQuarantinedRecords deletes every quarantined record, it returns how
+// many were deleted.
+func (s *storage) PurgeQuarantinedRecords() (int, error) {
+	purged := 0
+	err := s.update(func(tx Tx) error {
+		purged = 0
+		c := tx.Bucket(quarantineBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+
+	return purged, err
+}
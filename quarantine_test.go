@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// putCorruptSubscription stores a subscription which doesn't decode.
+func putCorruptSubscription(t *testing.T, s *storage, user string) {
+	t.Helper()
+	err := s.update(func(tx Tx) error {
+		return tx.Bucket(s.bucketName).Put([]byte(user), []byte("{not json"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuarantineOnRead(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		s := newTestStorage(t, backend)
+		putCorruptSubscription(t, s, "alice")
+
+		if _, err := s.GetSubscription("alice"); !errors.Is(err, errCorruptRecord) {
+			t.Fatalf("GetSubscription of a corrupt record = %v", err)
+		}
+		if _, err := s.GetSubscription("alice"); err != errSubscriptionNotFound {
+			t.Errorf("GetSubscription after the quarantine = %v", err)
+		}
+
+		records, err := s.GetQuarantinedRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("%d quarantined records, want 1", len(records))
+		}
+		record := records[0]
+		if record.Bucket != "subscriptions" || record.Key != "alice" || string(record.Value) != "{not json" || record.Reason == "" || record.ID == "" {
+			t.Errorf("quarantined record = %+v", record)
+		}
+
+		if err := s.PurgeQuarantinedRecord(record.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PurgeQuarantinedRecord(record.ID); err != errQuarantinedRecordNotFound {
+			t.Errorf("purging a purged record = %v", err)
+		}
+		if err := s.PurgeQuarantinedRecord("not hex"); err != errQuarantinedRecordNotFound {
+			t.Errorf("purging an invalid id = %v", err)
+		}
+	})
+}
+
+func TestQuarantineOnRemove(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		s := newTestStorage(t, backend)
+		putCorruptSubscription(t, s, "alice")
+
+		removed, err := s.RemoveSubscription("alice", StoredSubscription{Provider: ProviderFCM, DeviceToken: "alice-device"})
+		if err != nil || removed {
+			t.Fatalf("RemoveSubscription = %v, %v", removed, err)
+		}
+		records, _ := s.GetQuarantinedRecords()
+		if len(records) != 1 || records[0].Key != "alice" {
+			t.Errorf("quarantined records = %+v", records)
+		}
+	})
+}
+
+func TestQuarantineKeepsOverwrittenRecords(t *testing.T) {
+	s := newTestBoltStorage(t)
+	putCorruptSubscription(t, s, "alice")
+	record := newCorruptRecord(s.bucketName, []byte("alice"), []byte("{not json"), errors.New("invalid"))
+
+	// the user subscribed again after the corrupt record was read
+	s.AddSubscription("alice", StoredSubscription{Provider: ProviderFCM, DeviceToken: "alice-device"})
+	s.quarantine(record)
+
+	if _, err := s.GetSubscription("alice"); err != nil {
+		t.Errorf("GetSubscription of the new subscription = %v", err)
+	}
+	if records, _ := s.GetQuarantinedRecords(); len(records) != 0 {
+		t.Errorf("quarantined records = %+v", records)
+	}
+}
+
+func TestPurgeQuarantinedRecords(t *testing.T) {
+	s := newTestBoltStorage(t)
+	for _, user := range []string{"alice", "bob", "carol"} {
+		putCorruptSubscription(t, s, user)
+		s.GetSubscription(user)
+	}
+
+	purged, err := s.PurgeQuarantinedRecords()
+	if err != nil || purged != 3 {
+		t.Errorf("PurgeQuarantinedRecords = %d, %v, want 3", purged, err)
+	}
+	if records, _ := s.GetQuarantinedRecords(); len(records) != 0 {
+		t.Errorf("quarantined records after the purge = %+v", records)
+	}
+}
@@ -5,18 +5,100 @@ import (
 	"log"
 )
 
+// notification priorities, they decide the push urgency and TTL, the order
+// in which the dispatcher picks up work and what happens to a push
+// notification which arrives during the user's quiet hours
+const (
+	PriorityLow      = "low"      // dropped
+	PriorityNormal   = "normal"   // deferred to the end of the window
+	PriorityHigh     = "high"     // deferred to the end of the window
+	PriorityCritical = "critical" // delivered immediately
+)
+
+var priorities = []string{PriorityLow, PriorityNormal, PriorityHigh, PriorityCritical}
+
 type NotificationRequest struct {
 	User        string `json:"user,omitempty"`
 	Title       string `json:"title,omitempty"`
 	Description string `json:"description,omitempty"`
 	Link        string `json:"link,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+
+	// ID is assigned when the notification is accepted, clients send it
+	// back to mark the notification as read. RequestID is the ID of the
+	// admin request which sent it, so that deferred deliveries are logged
+	// with it.
+	ID        string `json:"id,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+
+	// EmailAttempts counts the failed attempts at emailing the notification
+	EmailAttempts int `json:"emailAttempts,omitempty"`
+
+	// Template names a stored template which, when set, is rendered with
+	// Variables to fill in the title, description, link, icon and image.
+	Template  string            `json:"template,omitempty"`
+	Variables map[string]string `json:"variables,omitempty"`
+
+	NotificationDisplay
+}
+
+const (
+	defaultIcon  = "/android-192x192.png"
+	defaultBadge = "/logo.png"
+	defaultImage = "/logo.png"
+)
+
+// NotificationAction is a button shown on the push notification, URL is
+// opened when it is clicked.
+type NotificationAction struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	Icon   string `json:"icon,omitempty"`
+	URL    string `json:"url,omitempty" zog:"url"`
+}
+
+// NotificationDisplay holds the optional presentation fields of a
+// notification. They are passed as is to the push payload and the websocket
+// message and mirror the options of the Notifications API.
+type NotificationDisplay struct {
+	Icon               string               `json:"icon,omitempty"`
+	Image              string               `json:"image,omitempty"`
+	Badge              string               `json:"badge,omitempty"`
+	Tag                string               `json:"tag,omitempty"`
+	Actions            []NotificationAction `json:"actions,omitempty"`
+	Renotify           bool                 `json:"renotify,omitempty"`
+	Silent             bool                 `json:"silent,omitempty"`
+	RequireInteraction bool                 `json:"requireInteraction,omitempty"`
+}
+
+// withDefaults fills in the icon, badge and image which were used for every
+// notification before they could be set per request.
+func (display NotificationDisplay) withDefaults() NotificationDisplay {
+	if display.Icon == "" {
+		display.Icon = defaultIcon
+	}
+	if display.Badge == "" {
+		display.Badge = defaultBadge
+	}
+	if display.Image == "" {
+		display.Image = defaultImage
+	}
+	return display
 }
 
 func (notif NotificationRequest) TransmissionJSON() []byte {
-	message, err := json.Marshal(map[string]string{
-		"title":       notif.Title,
-		"description": notif.Description,
-		"link":        notif.Link,
+	message, err := json.Marshal(struct {
+		ID          string `json:"id,omitempty"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Link        string `json:"link"`
+		NotificationDisplay
+	}{
+		ID:                  notif.ID,
+		Title:               notif.Title,
+		Description:         notif.Description,
+		Link:                notif.Link,
+		NotificationDisplay: notif.NotificationDisplay.withDefaults(),
 	})
 	if err != nil {
 		log.Panic("unable to jsonify notifiaction request in transmissionJSON")
@@ -25,9 +107,32 @@ func (notif NotificationRequest) TransmissionJSON() []byte {
 	return message
 }
 
+func (notif NotificationRequest) PushEvent() PushNotificationEvent {
+	return PushNotificationEvent{
+		Title:               notif.Title,
+		Body:                notif.Description,
+		URL:                 notif.Link,
+		NotificationDisplay: notif.NotificationDisplay.withDefaults(),
+	}
+}
+
 type BroadcastRequest struct {
 	Title       string `json:"title,omitempty"`
 	Description string `json:"description,omitempty"`
 	Link        string `json:"link,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	// Audience is who the broadcast goes to, everyone if it is nil
+	Audience *Audience `json:"audience,omitempty"`
+
+	NotificationDisplay
 }
 
+func (broadcastRequest BroadcastRequest) Notification() NotificationRequest {
+	return NotificationRequest{
+		Title:               broadcastRequest.Title,
+		Description:         broadcastRequest.Description,
+		Link:                broadcastRequest.Link,
+		Priority:            broadcastRequest.Priority,
+		NotificationDisplay: broadcastRequest.NotificationDisplay,
+	}
+}
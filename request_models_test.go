@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func parseNotificationRequests(t *testing.T, body string) ([]NotificationRequest, bool) {
+	t.Helper()
+	var reqMap []map[string]any
+	if err := json.Unmarshal([]byte(body), &reqMap); err != nil {
+		t.Fatal(err)
+	}
+	notifs := []NotificationRequest{}
+	return notifs, notificationRequestSchema.Parse(reqMap, &notifs) == nil
+}
+
+func TestNotificationRequestSchema(t *testing.T) {
+	notifs, ok := parseNotificationRequests(t, `[{"user": "alice", "title": "t", "description": "d", "link": "/",
+		"tag": "post-1", "renotify": true, "requireInteraction": true,
+		"actions": [{"action": "open", "title": "Open", "url": "/posts/1"}]}]`)
+	if !ok {
+		t.Fatal("a valid request was rejected")
+	}
+	notif := notifs[0]
+	if notif.Priority != PriorityNormal || notif.Icon != defaultIcon || !notif.Renotify || !notif.RequireInteraction {
+		t.Errorf("parsed request = %+v", notif)
+	}
+	if len(notif.Actions) != 1 || notif.Actions[0].URL != "/posts/1" {
+		t.Errorf("actions = %+v", notif.Actions)
+	}
+
+	for name, body := range map[string]string{
+		"renotify without a tag": `[{"user": "alice", "title": "t", "description": "d", "link": "/", "renotify": true}]`,
+		"action without a title": `[{"user": "alice", "title": "t", "description": "d", "link": "/", "actions": [{"action": "open"}]}]`,
+		"unknown priority":       `[{"user": "alice", "title": "t", "description": "d", "link": "/", "priority": "urgent"}]`,
+		"no content":             `[{"user": "alice", "title": "t"}]`,
+	} {
+		if _, ok := parseNotificationRequests(t, body); ok {
+			t.Errorf("%s: the request was accepted", name)
+		}
+	}
+
+	if _, ok := parseNotificationRequests(t, `[{"user": "alice", "template": "reply"}]`); !ok {
+		t.Error("a request naming a template was rejected without a title")
+	}
+}
+
+func TestNotificationDisplayDefaults(t *testing.T) {
+	notif := NotificationRequest{Title: "t", Description: "d", Link: "/", NotificationDisplay: NotificationDisplay{Icon: "/custom.png"}}
+
+	event := notif.PushEvent()
+	if event.Icon != "/custom.png" || event.Badge != defaultBadge || event.Image != defaultImage {
+		t.Errorf("push event display = %+v", event.NotificationDisplay)
+	}
+
+	var message map[string]any
+	json.Unmarshal(notif.TransmissionJSON(), &message)
+	if message["icon"] != "/custom.png" || message["badge"] != defaultBadge || message["title"] != "t" {
+		t.Errorf("websocket message = %v", message)
+	}
+	if _, ok := message["renotify"]; ok {
+		t.Error("unset flags are sent")
+	}
+}
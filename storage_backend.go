@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+)
+
+var errBucketNotFound = errors.New("bucket not found")
+
+// Backend is an ordered key-value store with named buckets, the same model
+// as boltdb. storage keeps every record of the service in one, so that each
+// database only has to implement these few operations.
+type Backend interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(Tx) error) error
+	// Update runs fn in a read-write transaction which is committed if fn
+	// returns nil and rolled back otherwise. fn may be run again after a
+	// conflicting transaction, so it must reset whatever state outside the
+	// transaction it sets.
+	Update(fn func(Tx) error) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+type Tx interface {
+	// Bucket returns nil if the bucket doesn't exist.
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+}
+
+// Bucket holds keys in byte order, the values returned by Get and the
+// cursors are only valid until the transaction ends.
+type Bucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// NextSequence returns an integer which is unique within the bucket.
+	NextSequence() (uint64, error)
+	// Len returns the number of keys in the bucket.
+	Len() int
+	// ForEach stops at the first error returned by fn and returns it.
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() Cursor
+
+	// nested buckets, Bucket returns nil if the bucket doesn't exist
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// Cursor walks a bucket in key order, the methods return a nil key once
+// they move past either end.
+type Cursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+	// Delete removes the key the cursor is at.
+	Delete() error
+}
+
+func openBackend(conf config.StorageConfig) (Backend, error) {
+	switch conf.Backend {
+	case config.StorageBolt:
+		return openBoltBackend(conf.Path)
+	case config.StorageSQLite:
+		return openSQLiteBackend(conf.Path)
+	case config.StoragePostgres:
+		return openPostgresBackend(conf.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", conf.Backend)
+	}
+}
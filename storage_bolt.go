@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBackend keeps the records in a single bbolt file, it reads the files
+// written by the older boltdb/bolt module as they share the format.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func openBoltBackend(path string) (*boltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout: 1 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) View(fn func(Tx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltBackend) Update(fn func(Tx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltBackend) Ping(ctx context.Context) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return wrapBoltBucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+// wrapBoltBucket keeps a missing bucket nil, a nil *bolt.Bucket in the
+// interface wouldn't be.
+func wrapBoltBucket(b *bolt.Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltBucket) Get(key []byte) []byte         { return b.b.Get(key) }
+func (b boltBucket) Put(key, value []byte) error   { return b.b.Put(key, value) }
+func (b boltBucket) Delete(key []byte) error       { return b.b.Delete(key) }
+func (b boltBucket) NextSequence() (uint64, error) { return b.b.NextSequence() }
+func (b boltBucket) Cursor() Cursor                { return b.b.Cursor() }
+func (b boltBucket) Bucket(name []byte) Bucket     { return wrapBoltBucket(b.b.Bucket(name)) }
+
+// Len counts the keys, Stats doesn't see the changes of the transaction
+// which is still open.
+func (b boltBucket) Len() int {
+	n := 0
+	c := b.b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{nested}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	err := b.b.DeleteBucket(name)
+	if err == bolt.ErrBucketNotFound {
+		return errBucketNotFound
+	}
+	return err
+}
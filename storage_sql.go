@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// sqlForEachPage is how many rows ForEach reads at a time, no result set is
+// left open while fn runs since fn may use the transaction itself
+const sqlForEachPage = 256
+
+// sqlTxRetries bounds how often a postgres write transaction is retried
+// after a serialization failure
+const sqlTxRetries = 5
+
+// sqlBackend maps the buckets onto two tables, kv_buckets holds the buckets
+// with their sequence and kv their keys. Nested buckets are named after
+// their parents, eg. webhook_deliveries/<webhook id>.
+type sqlBackend struct {
+	// reads and writes may use separate pools, sqlite allows a single
+	// writer which has to take its lock upfront
+	readDB  *sql.DB
+	writeDB *sql.DB
+
+	readOpts  *sql.TxOptions
+	writeOpts *sql.TxOptions
+
+	// postgres uses $1, $2... instead of ?
+	numberedParams bool
+	// retryable reports whether a failed write transaction may be run again
+	retryable func(error) bool
+}
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS kv_buckets (name TEXT PRIMARY KEY, seq INTEGER NOT NULL DEFAULT 0)`,
+	`CREATE TABLE IF NOT EXISTS kv (bucket TEXT NOT NULL, key BLOB NOT NULL, value BLOB NOT NULL, PRIMARY KEY (bucket, key)) WITHOUT ROWID`,
+}
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS kv_buckets (name TEXT PRIMARY KEY, seq BIGINT NOT NULL DEFAULT 0)`,
+	`CREATE TABLE IF NOT EXISTS kv (bucket TEXT NOT NULL, key BYTEA NOT NULL, value BYTEA NOT NULL, PRIMARY KEY (bucket, key))`,
+}
+
+func openSQLiteBackend(path string) (*sqlBackend, error) {
+	pragmas := "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+
+	readDB, err := sql.Open("sqlite", "file:"+path+"?"+pragmas)
+	if err != nil {
+		return nil, err
+	}
+	writeDB, err := sql.Open("sqlite", "file:"+path+"?"+pragmas+"&_txlock=immediate")
+	if err != nil {
+		readDB.Close()
+		return nil, err
+	}
+	writeDB.SetMaxOpenConns(1)
+
+	backend := &sqlBackend{
+		readDB:    readDB,
+		writeDB:   writeDB,
+		retryable: func(error) bool { return false },
+	}
+	if err := backend.migrate(sqliteSchema); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+func openPostgresBackend(databaseURL string) (*sqlBackend, error) {
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// serializable writes behave like boltdb's single writer, two instances
+	// can't both act on a record they read
+	backend := &sqlBackend{
+		readDB:         db,
+		writeDB:        db,
+		readOpts:       &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+		writeOpts:      &sql.TxOptions{Isolation: sql.LevelSerializable},
+		numberedParams: true,
+		retryable:      postgresRetryable,
+	}
+	if err := backend.migrate(postgresSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return backend, nil
+}
+
+// postgresRetryable reports a serialization_failure or deadlock_detected,
+// the transaction succeeds if it is run again.
+func postgresRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+func (b *sqlBackend) migrate(schema []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, stmt := range schema {
+		if _, err := b.writeDB.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("create schema: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *sqlBackend) run(db *sql.DB, opts *sql.TxOptions, fn func(Tx) error) error {
+	tx, err := db.BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	t := &sqlTx{tx: tx, numberedParams: b.numberedParams}
+	if err := fn(t); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// a failed statement leaves the transaction unusable, the methods
+	// which can't return errors record it instead
+	if t.err != nil {
+		tx.Rollback()
+		return t.err
+	}
+	return tx.Commit()
+}
+
+func (b *sqlBackend) View(fn func(Tx) error) error {
+	return b.run(b.readDB, b.readOpts, fn)
+}
+
+// Update runs fn again when postgres aborts the transaction for conflicting
+// with another one.
+func (b *sqlBackend) Update(fn func(Tx) error) error {
+	var err error
+	for range sqlTxRetries {
+		err = b.run(b.writeDB, b.writeOpts, fn)
+		if err == nil || !b.retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (b *sqlBackend) Ping(ctx context.Context) error {
+	return b.readDB.PingContext(ctx)
+}
+
+func (b *sqlBackend) Close() error {
+	err := b.readDB.Close()
+	if b.writeDB != b.readDB {
+		err = errors.Join(err, b.writeDB.Close())
+	}
+	return err
+}
+
+type sqlTx struct {
+	tx             *sql.Tx
+	numberedParams bool
+	err            error
+}
+
+func (t *sqlTx) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// rebind rewrites the ? placeholders for postgres.
+func (t *sqlTx) rebind(query string) string {
+	if !t.numberedParams {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+func (t *sqlTx) exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.Exec(t.rebind(query), args...)
+}
+
+func (t *sqlTx) queryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(t.rebind(query), args...)
+}
+
+func (t *sqlTx) bucket(name string) Bucket {
+	var exists int
+	err := t.queryRow(`SELECT 1 FROM kv_buckets WHERE name = ?`, name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		t.fail(err)
+		return nil
+	}
+	return &sqlBucket{tx: t, name: name}
+}
+
+func (t *sqlTx) createBucket(name string) (Bucket, error) {
+	_, err := t.exec(`INSERT INTO kv_buckets (name) VALUES (?) ON CONFLICT (name) DO NOTHING`, name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlBucket{tx: t, name: name}, nil
+}
+
+func (t *sqlTx) Bucket(name []byte) Bucket {
+	return t.bucket(string(name))
+}
+
+func (t *sqlTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.createBucket(string(name))
+}
+
+type sqlBucket struct {
+	tx   *sqlTx
+	name string
+}
+
+func (b *sqlBucket) nested(name []byte) string {
+	return b.name + "/" + string(name)
+}
+
+func (b *sqlBucket) Get(key []byte) []byte {
+	var value []byte
+	err := b.tx.queryRow(`SELECT value FROM kv WHERE bucket = ? AND key = ?`, b.name, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		b.tx.fail(err)
+		return nil
+	}
+	return value
+}
+
+func (b *sqlBucket) Put(key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := b.tx.exec(`INSERT INTO kv (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`, b.name, key, value)
+	return err
+}
+
+func (b *sqlBucket) Delete(key []byte) error {
+	_, err := b.tx.exec(`DELETE FROM kv WHERE bucket = ? AND key = ?`, b.name, key)
+	return err
+}
+
+func (b *sqlBucket) NextSequence() (uint64, error) {
+	var seq uint64
+	err := b.tx.queryRow(`UPDATE kv_buckets SET seq = seq + 1 WHERE name = ? RETURNING seq`, b.name).Scan(&seq)
+	return seq, err
+}
+
+func (b *sqlBucket) Len() int {
+	var n int
+	if err := b.tx.queryRow(`SELECT count(*) FROM kv WHERE bucket = ?`, b.name).Scan(&n); err != nil {
+		b.tx.fail(err)
+	}
+	return n
+}
+
+func (b *sqlBucket) ForEach(fn func(k, v []byte) error) error {
+	var after []byte
+	for {
+		rows, err := b.tx.tx.Query(b.tx.rebind(`SELECT key, value FROM kv WHERE bucket = ? AND (? OR key > ?) ORDER BY key LIMIT ?`),
+			b.name, after == nil, after, sqlForEachPage)
+		if err != nil {
+			return err
+		}
+
+		type pair struct{ k, v []byte }
+		page := make([]pair, 0, sqlForEachPage)
+		for rows.Next() {
+			var p pair
+			if err := rows.Scan(&p.k, &p.v); err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, p := range page {
+			if err := fn(p.k, p.v); err != nil {
+				return err
+			}
+		}
+		if len(page) < sqlForEachPage {
+			return nil
+		}
+		after = page[len(page)-1].k
+	}
+}
+
+func (b *sqlBucket) Cursor() Cursor {
+	return &sqlCursor{bucket: b}
+}
+
+func (b *sqlBucket) Bucket(name []byte) Bucket {
+	return b.tx.bucket(b.nested(name))
+}
+
+func (b *sqlBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return b.tx.createBucket(b.nested(name))
+}
+
+// DeleteBucket deletes the nested bucket along with the buckets nested in
+// it.
+func (b *sqlBucket) DeleteBucket(name []byte) error {
+	path := b.nested(name)
+	prefix := path + "/"
+
+	res, err := b.tx.exec(`DELETE FROM kv_buckets WHERE name = ? OR substr(name, 1, ?) = ?`, path, len(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errBucketNotFound
+	}
+
+	_, err = b.tx.exec(`DELETE FROM kv WHERE bucket = ? OR substr(bucket, 1, ?) = ?`, path, len(prefix), prefix)
+	return err
+}
+
+// sqlCursor runs a query per move, starting from the key it is at.
+type sqlCursor struct {
+	bucket *sqlBucket
+	key    []byte
+}
+
+func (c *sqlCursor) move(query string, args ...any) ([]byte, []byte) {
+	var k, v []byte
+	args = append([]any{c.bucket.name}, args...)
+	err := c.bucket.tx.queryRow(query, args...).Scan(&k, &v)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.bucket.tx.fail(err)
+		}
+		// past the end, stay on the last key so that moving back works
+		return nil, nil
+	}
+	c.key = k
+	return k, v
+}
+
+func (c *sqlCursor) First() ([]byte, []byte) {
+	return c.move(`SELECT key, value FROM kv WHERE bucket = ? ORDER BY key LIMIT 1`)
+}
+
+func (c *sqlCursor) Last() ([]byte, []byte) {
+	return c.move(`SELECT key, value FROM kv WHERE bucket = ? ORDER BY key DESC LIMIT 1`)
+}
+
+func (c *sqlCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	return c.move(`SELECT key, value FROM kv WHERE bucket = ? AND key > ? ORDER BY key LIMIT 1`, c.key)
+}
+
+func (c *sqlCursor) Prev() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	return c.move(`SELECT key, value FROM kv WHERE bucket = ? AND key < ? ORDER BY key DESC LIMIT 1`, c.key)
+}
+
+func (c *sqlCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.move(`SELECT key, value FROM kv WHERE bucket = ? AND key >= ? ORDER BY key LIMIT 1`, seek)
+}
+
+func (c *sqlCursor) Delete() error {
+	if c.key == nil {
+		return nil
+	}
+	return c.bucket.Delete(bytes.Clone(c.key))
+}
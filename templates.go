@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"text/template"
+)
+
+var templatesBucket = []byte("templates")
+
+var errTemplateNotFound = errors.New("template not found")
+
+// TemplateVariant is the localized content of a template. Every field is a
+// text/template which is executed against the request variables.
+type TemplateVariant struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Link        string `json:"link,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+type NotificationTemplate struct {
+	ID            string                     `json:"id"`
+	DefaultLocale string                     `json:"defaultLocale"`
+	Locales       map[string]TemplateVariant `json:"locales"`
+}
+
+// variant picks the closest match for locale, eg. "pt-BR" falls back to
+// "pt" and then to the template's default locale.
+func (t NotificationTemplate) variant(locale string) TemplateVariant {
+	if v, ok := t.Locales[locale]; ok {
+		return v
+	}
+	if base, _, found := strings.Cut(locale, "-"); found {
+		if v, ok := t.Locales[base]; ok {
+			return v
+		}
+	}
+	return t.Locales[t.DefaultLocale]
+}
+
+func renderField(name, text string, vars map[string]string) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse %s: %v", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("render %s: %v", name, err)
+	}
+	return buf.String(), nil
+}
+
+// Validate checks that the template is complete and that all of its fields
+// parse.
+func (t NotificationTemplate) Validate() error {
+	if _, ok := t.Locales[t.DefaultLocale]; !ok {
+		return fmt.Errorf("default locale %q has no variant", t.DefaultLocale)
+	}
+
+	for locale, v := range t.Locales {
+		fields := map[string]string{
+			"title": v.Title, "description": v.Description, "link": v.Link, "icon": v.Icon, "image": v.Image,
+		}
+		for name, text := range fields {
+			if _, err := template.New(name).Parse(text); err != nil {
+				return fmt.Errorf("locale %s: invalid %s: %v", locale, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Render executes the variant for locale against vars.
+func (t NotificationTemplate) Render(locale string, vars map[string]string) (TemplateVariant, error) {
+	v := t.variant(locale)
+	var rendered TemplateVariant
+	var err error
+
+	fields := []struct {
+		name string
+		src  string
+		dst  *string
+	}{
+		{"title", v.Title, &rendered.Title},
+		{"description", v.Description, &rendered.Description},
+		{"link", v.Link, &rendered.Link},
+		{"icon", v.Icon, &rendered.Icon},
+		{"image", v.Image, &rendered.Image},
+	}
+	for _, f := range fields {
+		*f.dst, err = renderField(f.name, f.src, vars)
+		if err != nil {
+			return rendered, err
+		}
+	}
+
+	return rendered, nil
+}
+
+// CheckVariables renders every variant against vars, so that a request
+// missing a variable is rejected instead of failing at delivery time, when
+// the user's locale is known.
+func (t NotificationTemplate) CheckVariables(vars map[string]string) error {
+	for locale := range t.Locales {
+		if _, err := t.Render(locale, vars); err != nil {
+			return fmt.Errorf("template %s, locale %s: %v", t.ID, locale, err)
+		}
+	}
+	return nil
+}
+
+// checkTemplates verifies that the templates named by notifs exist and
+// render with their variables.
+func checkTemplates(storage *storage, notifs []NotificationRequest) error {
+	templates := map[string]NotificationTemplate{}
+	for i, notif := range notifs {
+		if notif.Template == "" {
+			continue
+		}
+		tmpl, ok := templates[notif.Template]
+		if !ok {
+			var err error
+			tmpl, err = storage.GetTemplate(notif.Template)
+			if err == errTemplateNotFound {
+				return fmt.Errorf("notification %d: unknown template %q", i, notif.Template)
+			}
+			if err != nil {
+				return err
+			}
+			templates[notif.Template] = tmpl
+		}
+		if err := tmpl.CheckVariables(notif.Variables); err != nil {
+			return fmt.Errorf("notification %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// renderNotification fills in the content of notif from its template, if it
+// names one, using the locale from the user's preferences.
+func renderNotification(storage *storage, notif NotificationRequest) (NotificationRequest, error) {
+	if notif.Template == "" {
+		return notif, nil
+	}
+
+	tmpl, err := storage.GetTemplate(notif.Template)
+	if err != nil {
+		return notif, err
+	}
+
+	prefs, err := storage.GetPreferences(notif.User)
+	if err != nil {
+		return notif, err
+	}
+
+	rendered, err := tmpl.Render(prefs.Locale, notif.Variables)
+	if err != nil {
+		return notif, fmt.Errorf("template %s: %v", tmpl.ID, err)
+	}
+
+	notif.Title = rendered.Title
+	notif.Description = rendered.Description
+	notif.Link = rendered.Link
+	if rendered.Icon != "" {
+		notif.Icon = rendered.Icon
+	}
+	if rendered.Image != "" {
+		notif.Image = rendered.Image
+	}
+	return notif, nil
+}
+
+func (s *storage) GetTemplate(id string) (NotificationTemplate, error) {
+	var tmpl NotificationTemplate
+	err := s.view(func(tx Tx) error {
+		v := tx.Bucket(templatesBucket).Get([]byte(id))
+		if v == nil {
+			return errTemplateNotFound
+		}
+		return json.Unmarshal(v, &tmpl)
+	})
+
+	return tmpl, err
+}
+
+func (s *storage) PutTemplate(tmpl NotificationTemplate) error {
+	return s.update(func(tx Tx) error {
+		return tx.Bucket(templatesBucket).Put([]byte(tmpl.ID), jsonify(tmpl))
+	})
+}
+
+func (s *storage) DeleteTemplate(id string) error {
+	return s.update(func(tx Tx) error {
+		b := tx.Bucket(templatesBucket)
+		if b.Get([]byte(id)) == nil {
+			return errTemplateNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (s *storage) GetAllTemplates() iter.Seq[NotificationTemplate] {
+	return func(yield func(NotificationTemplate) bool) {
+		s.view(func(tx Tx) error {
+			return tx.Bucket(templatesBucket).ForEach(func(k, v []byte) error {
+				var tmpl NotificationTemplate
+				if err := json.Unmarshal(v, &tmpl); err != nil {
+					return nil
+				}
+				if !yield(tmpl) {
+					return errIterationEnd
+				}
+				return nil
+			})
+		})
+	}
+}
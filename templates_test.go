@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+var testTemplate = NotificationTemplate{
+	ID:            "reply",
+	DefaultLocale: "en",
+	Locales: map[string]TemplateVariant{
+		"en": {Title: "New reply", Description: "{{.name}} replied to your post", Link: "/posts/{{.post}}"},
+		"pt": {Title: "Nova resposta", Description: "{{.name}} respondeu ao seu post", Link: "/posts/{{.post}}"},
+	},
+}
+
+func TestTemplateVariant(t *testing.T) {
+	for locale, want := range map[string]string{
+		"en":    "New reply",
+		"pt":    "Nova resposta",
+		"pt-BR": "Nova resposta",
+		"fr":    "New reply",
+		"":      "New reply",
+	} {
+		if got := testTemplate.variant(locale).Title; got != want {
+			t.Errorf("variant(%q) = %q, want %q", locale, got, want)
+		}
+	}
+}
+
+func TestTemplateRender(t *testing.T) {
+	rendered, err := testTemplate.Render("pt-BR", map[string]string{"name": "alice", "post": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Description != "alice respondeu ao seu post" || rendered.Link != "/posts/1" {
+		t.Errorf("Render = %+v", rendered)
+	}
+
+	if _, err := testTemplate.Render("en", map[string]string{"name": "alice"}); err == nil {
+		t.Error("Render with a missing variable succeeded")
+	}
+}
+
+func TestCheckTemplates(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	if err := storage.PutTemplate(testTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		notif NotificationRequest
+		err   string
+	}{
+		{NotificationRequest{Title: "no template"}, ""},
+		{NotificationRequest{Template: "reply", Variables: map[string]string{"name": "alice", "post": "1"}}, ""},
+		{NotificationRequest{Template: "missing"}, `unknown template "missing"`},
+		{NotificationRequest{Template: "reply", Variables: map[string]string{"name": "alice"}}, "post"},
+	}
+	for _, test := range tests {
+		err := checkTemplates(storage, []NotificationRequest{test.notif})
+		if test.err == "" && err != nil {
+			t.Errorf("checkTemplates(%+v) = %v, want nil", test.notif, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("checkTemplates(%+v) = %v, want an error about %s", test.notif, err, test.err)
+		}
+	}
+}
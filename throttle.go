@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	"golang.org/x/time/rate"
+)
+
+// notifications which would wait longer than maxThrottleDelay for a token
+// are dropped even if the policy defers them, a flood must not pile up
+// deliveries for hours
+const (
+	maxThrottleDelay      = time.Hour
+	throttleSweepInterval = time.Minute
+)
+
+type throttleBucket struct {
+	limiter *rate.Limiter
+	// pending is the latest of the collapsed notifications, it is sent once
+	// the bucket has a token again
+	pending *NotificationRequest
+}
+
+// Throttle rate limits the notifications of every user with a token bucket
+// per channel, the buckets are per instance.
+type Throttle struct {
+	conf    config.RateLimitConfig
+	mu      sync.Mutex
+	buckets map[string]*throttleBucket
+}
+
+var notificationThrottle = NewThrottle(conf.RateLimit)
+
+func NewThrottle(conf config.RateLimitConfig) *Throttle {
+	return &Throttle{
+		conf:    conf,
+		buckets: make(map[string]*throttleBucket),
+	}
+}
+
+func throttleKey(channel, user string) string {
+	return channel + "\xff" + user
+}
+
+func (t *Throttle) bucket(key string) *throttleBucket {
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &throttleBucket{limiter: rate.NewLimiter(rate.Limit(t.conf.UserRate/60), t.conf.UserBurst)}
+		t.buckets[key] = b
+	}
+	return b
+}
+
+// Admit takes a token for sending the notification to its user over the
+// channel and reports whether it can be sent right away. A notification
+// over the limit is dropped, or handed to later along with the time it can
+// be sent at, according to the policy. Deferred notifications are all
+// handed to later, collapsed ones only if no newer notification to the user
+// was throttled in the meantime.
+func (t *Throttle) Admit(ctx context.Context, channel string, notif NotificationRequest, later func(NotificationRequest, time.Time)) bool {
+	key := throttleKey(channel, notif.User)
+	now := time.Now()
+
+	t.mu.Lock()
+	b := t.bucket(key)
+	reservation := b.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if reservation.OK() && delay == 0 {
+		t.mu.Unlock()
+		return true
+	}
+
+	policy := t.conf.Policy
+	if !reservation.OK() || delay > maxThrottleDelay {
+		policy = config.RateLimitDrop
+	}
+	if policy != config.RateLimitDefer {
+		// the notification isn't sent with this token
+		reservation.CancelAt(now)
+	}
+
+	schedule := false
+	outcome := OutcomeDropped
+	switch policy {
+	case config.RateLimitDefer:
+		outcome = OutcomeDeferred
+		schedule = true
+	case config.RateLimitCollapse:
+		if b.pending != nil {
+			outcome = OutcomeCollapsed
+		} else {
+			outcome = OutcomeDeferred
+			time.AfterFunc(delay, func() {
+				t.flush(ctx, key, later)
+			})
+		}
+		b.pending = &notif
+	}
+	t.mu.Unlock()
+
+	throttledNotificationsTotal.Inc(channel, outcome)
+	slog.DebugContext(ctx, "notification over the user's rate limit", "user", notif.User, "channel", channel, "outcome", outcome, "delay", delay)
+	if schedule {
+		later(notif, now.Add(delay))
+	}
+	return false
+}
+
+// flush sends the pending notification of a bucket, it replaces every
+// notification collapsed into it.
+func (t *Throttle) flush(ctx context.Context, key string, later func(NotificationRequest, time.Time)) {
+	now := time.Now()
+
+	t.mu.Lock()
+	b := t.bucket(key)
+	notif := b.pending
+	b.pending = nil
+	if notif != nil {
+		// the token is taken even if a notification admitted in between got
+		// it first, the next one waits a little longer
+		b.limiter.ReserveN(now, 1)
+	}
+	t.mu.Unlock()
+
+	if notif != nil {
+		later(*notif, now)
+	}
+}
+
+// sweep forgets the buckets which have refilled and have nothing pending,
+// they are no different from new ones.
+func (t *Throttle) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range t.buckets {
+		if b.pending == nil && b.limiter.TokensAt(now) >= float64(b.limiter.Burst()) {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+func (t *Throttle) Run(ctx context.Context) {
+	ticker := time.NewTicker(throttleSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// laterRecorder records the notifications a throttle hands to later.
+type laterRecorder struct {
+	mu     sync.Mutex
+	notifs []NotificationRequest
+	times  []time.Time
+	called chan struct{}
+}
+
+func newLaterRecorder() *laterRecorder {
+	return &laterRecorder{called: make(chan struct{}, 10)}
+}
+
+func (l *laterRecorder) later(notif NotificationRequest, at time.Time) {
+	l.mu.Lock()
+	l.notifs = append(l.notifs, notif)
+	l.times = append(l.times, at)
+	l.mu.Unlock()
+	l.called <- struct{}{}
+}
+
+func (l *laterRecorder) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.notifs)
+}
+
+func testNotification(user, title string) NotificationRequest {
+	return NotificationRequest{User: user, Title: title}
+}
+
+// newTestThrottle has a burst of 2 and refills a token every 100ms.
+func newTestThrottle(policy string) *Throttle {
+	return NewThrottle(config.RateLimitConfig{UserRate: 600, UserBurst: 2, Policy: policy})
+}
+
+func TestThrottleDrop(t *testing.T) {
+	throttle := newTestThrottle(config.RateLimitDrop)
+	recorder := newLaterRecorder()
+	ctx := context.Background()
+
+	for i := range 2 {
+		if !throttle.Admit(ctx, ChannelPush, testNotification("alice", "burst"), recorder.later) {
+			t.Fatalf("notification %d of the burst throttled", i)
+		}
+	}
+	if throttle.Admit(ctx, ChannelPush, testNotification("alice", "over"), recorder.later) {
+		t.Error("notification over the limit admitted")
+	}
+	if !throttle.Admit(ctx, ChannelEmail, testNotification("alice", "email"), recorder.later) {
+		t.Error("notification over another channel throttled")
+	}
+	if !throttle.Admit(ctx, ChannelPush, testNotification("bob", "bob"), recorder.later) {
+		t.Error("notification to another user throttled")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !throttle.Admit(ctx, ChannelPush, testNotification("alice", "refilled"), recorder.later) {
+		t.Error("notification throttled after the bucket refilled")
+	}
+	if recorder.count() != 0 {
+		t.Errorf("%d dropped notifications handed to later", recorder.count())
+	}
+}
+
+func TestThrottleDefer(t *testing.T) {
+	throttle := newTestThrottle(config.RateLimitDefer)
+	recorder := newLaterRecorder()
+	ctx := context.Background()
+
+	throttle.Admit(ctx, ChannelPush, testNotification("alice", "1"), recorder.later)
+	throttle.Admit(ctx, ChannelPush, testNotification("alice", "2"), recorder.later)
+	start := time.Now()
+	for _, title := range []string{"3", "4"} {
+		if throttle.Admit(ctx, ChannelPush, testNotification("alice", title), recorder.later) {
+			t.Fatalf("notification %s over the limit admitted", title)
+		}
+	}
+
+	if recorder.count() != 2 {
+		t.Fatalf("%d notifications deferred, want 2", recorder.count())
+	}
+	// each deferred notification takes the next token
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if delay := recorder.times[i].Sub(start); delay < want-20*time.Millisecond || delay > want+20*time.Millisecond {
+			t.Errorf("notification %s deferred by %v, want %v", recorder.notifs[i].Title, delay, want)
+		}
+	}
+}
+
+func TestThrottleDeferTooLong(t *testing.T) {
+	// a token every two hours
+	throttle := NewThrottle(config.RateLimitConfig{UserRate: 0.5 / 60, UserBurst: 1, Policy: config.RateLimitDefer})
+	recorder := newLaterRecorder()
+	ctx := context.Background()
+
+	throttle.Admit(ctx, ChannelPush, testNotification("alice", "1"), recorder.later)
+	if throttle.Admit(ctx, ChannelPush, testNotification("alice", "2"), recorder.later) {
+		t.Error("notification over the limit admitted")
+	}
+	if recorder.count() != 0 {
+		t.Error("notification deferred past the maximum delay")
+	}
+}
+
+func TestThrottleCollapse(t *testing.T) {
+	throttle := newTestThrottle(config.RateLimitCollapse)
+	recorder := newLaterRecorder()
+	ctx := context.Background()
+
+	throttle.Admit(ctx, ChannelPush, testNotification("alice", "1"), recorder.later)
+	throttle.Admit(ctx, ChannelPush, testNotification("alice", "2"), recorder.later)
+	for _, title := range []string{"3", "4", "5"} {
+		if throttle.Admit(ctx, ChannelPush, testNotification("alice", title), recorder.later) {
+			t.Fatalf("notification %s over the limit admitted", title)
+		}
+	}
+
+	select {
+	case <-recorder.called:
+	case <-time.After(time.Second):
+		t.Fatal("collapsed notification not sent")
+	}
+	if recorder.count() != 1 || recorder.notifs[0].Title != "5" {
+		t.Fatalf("handed to later %+v, want only the latest notification", recorder.notifs)
+	}
+
+	// the flush took the refilled token, the next notification is collapsed
+	// again
+	if throttle.Admit(ctx, ChannelPush, testNotification("alice", "6"), recorder.later) {
+		t.Error("notification admitted with the token of the collapsed one")
+	}
+	select {
+	case <-recorder.called:
+	case <-time.After(time.Second):
+		t.Fatal("collapsed notification not sent")
+	}
+	if recorder.count() != 2 || recorder.notifs[1].Title != "6" {
+		t.Errorf("handed to later %+v", recorder.notifs)
+	}
+}
+
+func TestThrottleSweep(t *testing.T) {
+	throttle := newTestThrottle(config.RateLimitDrop)
+	ctx := context.Background()
+	throttle.Admit(ctx, ChannelPush, testNotification("alice", "1"), nil)
+	throttle.Admit(ctx, ChannelPush, testNotification("bob", "1"), nil)
+	throttle.Admit(ctx, ChannelPush, testNotification("bob", "2"), nil)
+
+	// alice's bucket has refilled after 100ms, bob's after 200ms
+	time.Sleep(150 * time.Millisecond)
+	throttle.sweep()
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	if _, ok := throttle.buckets[throttleKey(ChannelPush, "alice")]; ok {
+		t.Error("refilled bucket kept")
+	}
+	if _, ok := throttle.buckets[throttleKey(ChannelPush, "bob")]; !ok {
+		t.Error("bucket forgotten before it refilled")
+	}
+}
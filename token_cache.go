@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// session tokens are cached for a short while so that reconnecting clients
+// don't each cost a firestore read. Revoking a token through the admin API
+// drops it from the cache of every instance, one deleted from firestore
+// directly stays usable until its entry expires.
+const (
+	tokenCacheTTL        = 30 * time.Second
+	tokenCacheMaxEntries = 10000
+)
+
+type tokenCacheEntry struct {
+	session   SessionCookie
+	expiresAt time.Time
+}
+
+type TokenCache struct {
+	entries map[string]tokenCacheEntry
+	ttl     time.Duration
+	mu      sync.Mutex
+}
+
+var tokenCache = NewTokenCache(tokenCacheTTL)
+
+func NewTokenCache(ttl time.Duration) *TokenCache {
+	return &TokenCache{
+		entries: make(map[string]tokenCacheEntry),
+		ttl:     ttl,
+	}
+}
+
+func (cache *TokenCache) Get(token string) (SessionCookie, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[token]
+	if !ok || time.Now().After(entry.expiresAt) {
+		tokenCacheRequestsTotal.Inc("miss")
+		return SessionCookie{}, false
+	}
+	tokenCacheRequestsTotal.Inc("hit")
+	return entry.session, true
+}
+
+func (cache *TokenCache) Set(token string, session SessionCookie) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.entries) >= tokenCacheMaxEntries {
+		cache.evict()
+	}
+	cache.entries[token] = tokenCacheEntry{session: session, expiresAt: time.Now().Add(cache.ttl)}
+}
+
+// Delete drops the token, so that it is looked up again on its next use.
+func (cache *TokenCache) Delete(token string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	delete(cache.entries, token)
+}
+
+// evict drops the expired entries, and arbitrary ones if that isn't enough
+// to make room.
+func (cache *TokenCache) evict() {
+	now := time.Now()
+	for token, entry := range cache.entries {
+		if now.After(entry.expiresAt) {
+			delete(cache.entries, token)
+		}
+	}
+
+	for token := range cache.entries {
+		if len(cache.entries) < tokenCacheMaxEntries {
+			break
+		}
+		delete(cache.entries, token)
+	}
+}
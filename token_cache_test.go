@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestTokenCache(t *testing.T) {
+	cache := NewTokenCache(time.Hour)
+	session := SessionCookie{Token: "t1", Role: "user"}
+
+	if _, ok := cache.Get("t1"); ok {
+		t.Fatal("hit on an empty cache")
+	}
+	cache.Set("t1", session)
+	if got, ok := cache.Get("t1"); !ok || got != session {
+		t.Errorf("Get = %v, %v, want %v, true", got, ok, session)
+	}
+
+	cache.Delete("t1")
+	if _, ok := cache.Get("t1"); ok {
+		t.Error("hit on a deleted token")
+	}
+
+	expired := NewTokenCache(-time.Second)
+	expired.Set("t1", session)
+	if _, ok := expired.Get("t1"); ok {
+		t.Error("hit on an expired token")
+	}
+
+	text := metricText(tokenCacheRequestsTotal)
+	for _, result := range []string{"hit", "miss"} {
+		if !strings.Contains(text, `result="`+result+`"`) {
+			t.Errorf("token cache metrics don't count %ss:\n%s", result, text)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/gobwas/ws/wsutil"
+
+	"github.com/shravanasati/everynyan-notification-service/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "everynyan-notification-service"
+
+var tracer = otel.Tracer("github.com/shravanasati/everynyan-notification-service")
+
+// setupTracing installs the tracer provider and the W3C trace context
+// propagator, it returns a function which flushes the pending spans. With
+// the none exporter spans are still created, so that trace IDs propagate,
+// but they aren't recorded.
+func setupTracing(conf config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case config.TracesExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case config.TracesExporterOTLP:
+		exporter, err = otlptracehttp.New(context.Background())
+	case config.TracesExporterConsole:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s trace exporter: %v", conf.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// endSpan records err on the span, if there is one, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// writeWebsocketMessage sends message to the client in its own span.
+func writeWebsocketMessage(ctx context.Context, conn net.Conn, message []byte) error {
+	_, span := tracer.Start(ctx, "websocket.write")
+	err := wsutil.WriteServerText(conn, message)
+	endSpan(span, err)
+	return err
+}
+
+// endDeliverySpan records the outcome of a delivery on the span and ends it.
+func endDeliverySpan(span trace.Span, result DeliveryResult) {
+	span.SetAttributes(
+		attribute.Bool("delivery.delivered", result.Delivered),
+		attribute.Int("delivery.status_code", result.StatusCode),
+	)
+	if !result.Delivered {
+		span.SetStatus(codes.Error, result.Error)
+	}
+	span.End()
+}
@@ -1,6 +1,10 @@
 package main
 
-import "encoding/json"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
 
 func jsonify(v any) []byte {
 	output, err := json.Marshal(v)
@@ -8,4 +12,13 @@ func jsonify(v any) []byte {
 		panic("unable to jsonify: " + err.Error())
 	}
 	return output
-}
\ No newline at end of file
+}
+
+// newID returns a random 128 bit identifier, hex encoded.
+func newID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic("unable to generate id: " + err.Error())
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var webhooksBucket = []byte("webhooks")
+
+// webhookDeliveriesBucket holds a nested bucket per webhook with the log of
+// its most recent delivery attempts
+var webhookDeliveriesBucket = []byte("webhook_deliveries")
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+const (
+	webhookTimeout         = 10 * time.Second
+	webhookMaxAttempts     = 8
+	webhookInitialBackoff  = 5 * time.Second
+	webhookMaxBackoff      = 5 * time.Minute
+	webhookDeliveryLogSize = 100
+	webhookWorkers         = 16
+	// webhookQueueSize bounds the deliveries of a webhook which are queued
+	// or waiting for a retry
+	webhookQueueSize        = 1000
+	webhookRefreshInterval  = time.Minute
+	webhookLogFlushInterval = time.Second
+)
+
+// Webhook is a URL which receives a signed POST for every event of the
+// types it is registered for.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url" zog:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (webhook Webhook) Wants(eventType string) bool {
+	return slices.Contains(webhook.Events, eventType)
+}
+
+// WebhookDelivery is one attempt at delivering an event to a webhook.
+type WebhookDelivery struct {
+	EventID    string    `json:"eventId"`
+	EventType  string    `json:"eventType"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	Duration   string    `json:"duration"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256, keyed with the webhook
+// secret, of the timestamp and the body joined by a dot. Receivers should
+// recompute it and reject old timestamps to prevent replays.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSender delivers the events of the hub to the registered webhooks,
+// retrying failed deliveries with exponential backoff. The deliveries are
+// made by a fixed pool of workers, each webhook can have at most
+// webhookQueueSize of them queued or waiting for a retry, events past that
+// are dropped.
+type WebhookSender struct {
+	storage *storage
+	client  *http.Client
+	workers *Dispatcher
+
+	mu sync.Mutex
+	// webhooks is a copy of the stored webhooks, so that events aren't held
+	// up by a read of them
+	webhooks []Webhook
+	// queued counts the unfinished deliveries of every webhook, overflowing
+	// records the webhooks whose queue overflowed so that it is only logged
+	// once
+	queued      map[string]int
+	overflowing map[string]bool
+	// deliveries are the attempts not yet written to the delivery logs
+	deliveries map[string][]WebhookDelivery
+}
+
+type webhookJob struct {
+	webhook Webhook
+	event   Event
+	body    []byte
+	attempt int
+}
+
+func NewWebhookSender(storage *storage) *WebhookSender {
+	return &WebhookSender{
+		storage:     storage,
+		client:      &http.Client{Timeout: webhookTimeout},
+		workers:     NewDispatcher(webhookWorkers, dispatcherCapacity),
+		queued:      make(map[string]int),
+		overflowing: make(map[string]bool),
+		deliveries:  make(map[string][]WebhookDelivery),
+	}
+}
+
+// Refresh reloads the webhooks. It is called when they are changed through
+// this instance, and periodically for the changes made through the others.
+func (sender *WebhookSender) Refresh() {
+	webhooks := sender.storage.GetAllWebhooks()
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.webhooks = webhooks
+}
+
+// Run delivers the events received on ch until ctx is done or ch is closed.
+func (sender *WebhookSender) Run(ctx context.Context, ch <-chan Event) {
+	sender.Refresh()
+	refresh := time.NewTicker(webhookRefreshInterval)
+	defer refresh.Stop()
+
+	flushDone := make(chan struct{})
+	go func() {
+		defer close(flushDone)
+		sender.flushPeriodically(ctx)
+	}()
+	defer func() {
+		// the deliveries left run right away, they fail with ctx done
+		sender.workers.Close()
+		<-flushDone
+		sender.flushDeliveries(context.WithoutCancel(ctx))
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			sender.Refresh()
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			// the instance the event happened on sends it
+			if event.Remote {
+				continue
+			}
+
+			sender.mu.Lock()
+			webhooks := sender.webhooks
+			sender.mu.Unlock()
+
+			var body []byte
+			for _, webhook := range webhooks {
+				if !webhook.Wants(event.Type) {
+					continue
+				}
+				if body == nil {
+					body = jsonify(event)
+				}
+				sender.enqueue(ctx, webhookJob{webhook: webhook, event: event, body: body, attempt: 1})
+			}
+		}
+	}
+}
+
+// enqueue hands a new delivery to the workers, unless the webhook has too
+// many deliveries unfinished already.
+func (sender *WebhookSender) enqueue(ctx context.Context, job webhookJob) {
+	id := job.webhook.ID
+
+	sender.mu.Lock()
+	if sender.queued[id] >= webhookQueueSize {
+		logged := sender.overflowing[id]
+		sender.overflowing[id] = true
+		sender.mu.Unlock()
+
+		webhookEventsDroppedTotal.Inc()
+		if !logged {
+			slog.WarnContext(ctx, "webhook queue is full, dropping events until it drains", "webhook", id, "queued", webhookQueueSize)
+		}
+		return
+	}
+	sender.queued[id]++
+	sender.mu.Unlock()
+
+	sender.submit(ctx, job)
+}
+
+func (sender *WebhookSender) submit(ctx context.Context, job webhookJob) {
+	ok := sender.workers.Submit(PriorityNormal, func() {
+		sender.attempt(ctx, job)
+	})
+	if !ok {
+		webhookEventsDroppedTotal.Inc()
+		sender.finish(job.webhook.ID)
+	}
+}
+
+// finish accounts for a delivery which has succeeded or been given up on.
+func (sender *WebhookSender) finish(id string) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	sender.queued[id]--
+	if sender.queued[id] <= 0 {
+		delete(sender.queued, id)
+		delete(sender.overflowing, id)
+	}
+}
+
+// webhookBackoff is the wait after the given failed attempt.
+func webhookBackoff(attempt int) time.Duration {
+	return min(webhookInitialBackoff<<(attempt-1), webhookMaxBackoff)
+}
+
+// attempt posts the event once, a failed attempt is submitted again after
+// the backoff rather than holding a worker while it waits.
+func (sender *WebhookSender) attempt(ctx context.Context, job webhookJob) {
+	delivery := sender.post(ctx, job.webhook, job.event, job.body)
+	delivery.Attempt = job.attempt
+	sender.record(job.webhook.ID, delivery)
+
+	if delivery.Delivered || ctx.Err() != nil {
+		sender.finish(job.webhook.ID)
+		return
+	}
+	if job.attempt == webhookMaxAttempts {
+		slog.WarnContext(ctx, "giving up on delivering event to webhook", "event", job.event.ID, "webhook", job.webhook.ID)
+		sender.finish(job.webhook.ID)
+		return
+	}
+
+	backoff := webhookBackoff(job.attempt)
+	job.attempt++
+	time.AfterFunc(backoff, func() {
+		sender.submit(ctx, job)
+	})
+}
+
+// record adds the attempt to the deliveries written with the next flush.
+func (sender *WebhookSender) record(id string, delivery WebhookDelivery) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.deliveries[id] = append(sender.deliveries[id], delivery)
+}
+
+func (sender *WebhookSender) flushPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(webhookLogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sender.flushDeliveries(ctx)
+		}
+	}
+}
+
+// flushDeliveries writes the recorded attempts to the delivery logs in a
+// single transaction.
+func (sender *WebhookSender) flushDeliveries(ctx context.Context) {
+	sender.mu.Lock()
+	deliveries := sender.deliveries
+	sender.deliveries = make(map[string][]WebhookDelivery)
+	sender.mu.Unlock()
+
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := sender.storage.AddWebhookDeliveries(deliveries); err != nil {
+		slog.ErrorContext(ctx, "unable to record webhook deliveries", "webhooks", len(deliveries), "error", err)
+	}
+}
+
+func (sender *WebhookSender) post(ctx context.Context, webhook Webhook, event Event, body []byte) WebhookDelivery {
+	start := time.Now()
+	delivery := WebhookDelivery{EventID: event.ID, EventType: event.Type, Time: start.UTC()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Everynyan-Event", event.Type)
+	req.Header.Set("Everynyan-Delivery", event.ID)
+	req.Header.Set("Everynyan-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, signWebhook(webhook.Secret, timestamp, body)))
+
+	resp, err := sender.client.Do(req)
+	delivery.Duration = time.Since(start).String()
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Delivered {
+		delivery.Error = resp.Status
+	}
+	return delivery
+}
+
+func (s *storage) PutWebhook(webhook Webhook) error {
+	return s.update(func(tx Tx) error {
+		return tx.Bucket(webhooksBucket).Put([]byte(webhook.ID), jsonify(webhook))
+	})
+}
+
+func (s *storage) DeleteWebhook(id string) error {
+	return s.update(func(tx Tx) error {
+		b := tx.Bucket(webhooksBucket)
+		if b.Get([]byte(id)) == nil {
+			return errWebhookNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		err := tx.Bucket(webhookDeliveriesBucket).DeleteBucket([]byte(id))
+		if err != nil && err != errBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// GetAllWebhooks reads every webhook at once, so that no read transaction
+// is held while they are being delivered to.
+func (s *storage) GetAllWebhooks() []Webhook {
+	webhooks := []Webhook{}
+	s.view(func(tx Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(k, v []byte) error {
+			var webhook Webhook
+			if err := json.Unmarshal(v, &webhook); err != nil {
+				slog.Error("unable to unmarshal webhook", "webhook", string(k), "error", err)
+				return nil
+			}
+			webhooks = append(webhooks, webhook)
+			return nil
+		})
+	})
+
+	return webhooks
+}
+
+// AddWebhookDeliveries appends to the delivery logs of the webhooks, only
+// the last webhookDeliveryLogSize entries of each are kept.
+func (s *storage) AddWebhookDeliveries(deliveries map[string][]WebhookDelivery) error {
+	return s.update(func(tx Tx) error {
+		for id, logged := range deliveries {
+			if tx.Bucket(webhooksBucket).Get([]byte(id)) == nil {
+				// deleted while the deliveries were in flight
+				continue
+			}
+
+			b, err := tx.Bucket(webhookDeliveriesBucket).CreateBucketIfNotExists([]byte(id))
+			if err != nil {
+				return err
+			}
+
+			for _, delivery := range logged {
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				key := make([]byte, 8)
+				binary.BigEndian.PutUint64(key, seq)
+				if err := b.Put(key, jsonify(delivery)); err != nil {
+					return err
+				}
+			}
+
+			excess := b.Len() - webhookDeliveryLogSize
+			stale := [][]byte{}
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && len(stale) < excess; k, _ = c.Next() {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetWebhookDeliveries returns the delivery log of the webhook, most recent
+// first.
+func (s *storage) GetWebhookDeliveries(id string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := s.view(func(tx Tx) error {
+		if tx.Bucket(webhooksBucket).Get([]byte(id)) == nil {
+			return errWebhookNotFound
+		}
+
+		b := tx.Bucket(webhookDeliveriesBucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				continue
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+
+	return deliveries, err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+// verifyWebhookSignature checks the Everynyan-Signature header the way a
+// receiver would.
+func verifyWebhookSignature(secret, header string, body []byte) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.%s", timestamp, body)
+	expected, _ := hex.DecodeString(signature)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	signature := signWebhook("secret", 1700000000, body)
+	if !verifyWebhookSignature("secret", "t=1700000000,v1="+signature, body) {
+		t.Error("signature doesn't verify")
+	}
+	if verifyWebhookSignature("other", "t=1700000000,v1="+signature, body) {
+		t.Error("signature verifies with another secret")
+	}
+	if verifyWebhookSignature("secret", "t=1700000001,v1="+signature, body) {
+		t.Error("signature verifies with another timestamp")
+	}
+}
+
+func TestWebhookSender(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !verifyWebhookSignature("secret", r.Header.Get("Everynyan-Signature"), body) {
+			t.Errorf("invalid signature %q", r.Header.Get("Everynyan-Signature"))
+		}
+		timestamp, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(r.Header.Get("Everynyan-Signature"), ",")[0], "t="), 10, 64)
+		if time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			t.Errorf("signature timestamp %d is old", timestamp)
+		}
+		received <- r
+	}))
+	defer server.Close()
+
+	storage := newTestBoltStorage(t)
+	storage.PutWebhook(Webhook{ID: "hook", URL: server.URL, Secret: "secret", Events: []string{EventNotificationRead}})
+
+	events := make(chan Event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		NewWebhookSender(storage).Run(ctx, events)
+	}()
+
+	events <- Event{ID: "remote", Type: EventNotificationRead, Remote: true}
+	events <- Event{ID: "unwanted", Type: EventUserConnected}
+	events <- Event{ID: "read", Type: EventNotificationRead, User: "alice"}
+
+	select {
+	case r := <-received:
+		if r.Header.Get("Everynyan-Delivery") != "read" || r.Header.Get("Everynyan-Event") != EventNotificationRead {
+			t.Errorf("delivered %s %s, want the local read event", r.Header.Get("Everynyan-Event"), r.Header.Get("Everynyan-Delivery"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	select {
+	case r := <-received:
+		t.Errorf("unexpected delivery of %s", r.Header.Get("Everynyan-Delivery"))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the delivery log is written when the sender stops at the latest
+	cancel()
+	<-stopped
+	deliveries, err := storage.GetWebhookDeliveries("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || !deliveries[0].Delivered || deliveries[0].EventID != "read" {
+		t.Errorf("deliveries = %+v", deliveries)
+	}
+}
+
+func TestWebhookDeliveryLog(t *testing.T) {
+	storage := newTestBoltStorage(t)
+	storage.PutWebhook(Webhook{ID: "hook", URL: "https://example.com", Events: []string{EventNotificationRead}})
+
+	// written in two batches, along with the deliveries of a webhook which
+	// has been deleted
+	for _, batch := range [][2]int{{0, 60}, {60, webhookDeliveryLogSize + 5}} {
+		deliveries := map[string][]WebhookDelivery{"deleted": {{EventID: "deleted"}}}
+		for i := batch[0]; i < batch[1]; i++ {
+			deliveries["hook"] = append(deliveries["hook"], WebhookDelivery{EventID: strconv.Itoa(i)})
+		}
+		if err := storage.AddWebhookDeliveries(deliveries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := storage.GetWebhookDeliveries("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != webhookDeliveryLogSize {
+		t.Fatalf("%d deliveries kept, want %d", len(deliveries), webhookDeliveryLogSize)
+	}
+	if deliveries[0].EventID != "104" || deliveries[len(deliveries)-1].EventID != "5" {
+		t.Errorf("kept deliveries %s to %s, want the most recent first", deliveries[0].EventID, deliveries[len(deliveries)-1].EventID)
+	}
+
+	if _, err := storage.GetWebhookDeliveries("missing"); err != errWebhookNotFound {
+		t.Errorf("GetWebhookDeliveries of a missing webhook = %v", err)
+	}
+}
+
+func TestWebhookQueueLimit(t *testing.T) {
+	release := make(chan struct{})
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		<-release
+	}))
+	defer server.Close()
+
+	storage := newTestBoltStorage(t)
+	webhook := Webhook{ID: "hook", URL: server.URL, Events: []string{EventNotificationRead}}
+	storage.PutWebhook(webhook)
+	sender := NewWebhookSender(storage)
+
+	ctx := context.Background()
+	for i := range webhookQueueSize + 10 {
+		event := Event{ID: strconv.Itoa(i), Type: EventNotificationRead}
+		sender.enqueue(ctx, webhookJob{webhook: webhook, event: event, body: jsonify(event), attempt: 1})
+	}
+	sender.mu.Lock()
+	queued := sender.queued["hook"]
+	sender.mu.Unlock()
+	if queued != webhookQueueSize {
+		t.Errorf("%d deliveries queued, want %d", queued, webhookQueueSize)
+	}
+
+	close(release)
+	sender.workers.Close()
+	if received.Load() != webhookQueueSize {
+		t.Errorf("%d deliveries made, want %d", received.Load(), webhookQueueSize)
+	}
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if len(sender.queued) != 0 || len(sender.overflowing) != 0 {
+		t.Errorf("queued = %v, overflowing = %v after the deliveries finished", sender.queued, sender.overflowing)
+	}
+	if len(sender.deliveries["hook"]) != webhookQueueSize {
+		t.Errorf("%d deliveries recorded, want %d", len(sender.deliveries["hook"]), webhookQueueSize)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, webhookMaxBackoff}
+	for i, backoff := range want {
+		if got := webhookBackoff(i + 1); got != backoff {
+			t.Errorf("backoff after attempt %d = %v, want %v", i+1, got, backoff)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"iter"
 	"maps"
+	"math/rand/v2"
 	"net"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 )
 
 type WebsocketConnectionsManager struct {
@@ -40,6 +48,48 @@ func (manager *WebsocketConnectionsManager) Delete(user string) {
 	delete(manager.authorConnMap, user)
 }
 
+// Remove deletes the user's connection if it is still conn, a user who has
+// reconnected in the meantime stays connected. It reports whether the user
+// was removed.
+func (manager *WebsocketConnectionsManager) Remove(user string, conn net.Conn) bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.authorConnMap[user] != conn {
+		return false
+	}
+	delete(manager.authorConnMap, user)
+	return true
+}
+
+// Online reports which of the users are connected.
+func (manager *WebsocketConnectionsManager) Online(users []string) map[string]bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	online := make(map[string]bool, len(users))
+	for _, user := range users {
+		_, online[user] = manager.authorConnMap[user]
+	}
+	return online
+}
+
+// Connections returns the connection of every connected user.
+func (manager *WebsocketConnectionsManager) Connections() map[string]net.Conn {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return maps.Clone(manager.authorConnMap)
+}
+
+// Users returns the users who are connected.
+func (manager *WebsocketConnectionsManager) Users() []string {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return slices.Collect(maps.Keys(manager.authorConnMap))
+}
+
 func (manager *WebsocketConnectionsManager) All() iter.Seq[net.Conn] {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
@@ -54,6 +104,57 @@ func (manager *WebsocketConnectionsManager) Count() int {
 	return len(manager.authorConnMap)
 }
 
+// closeWriteTimeout bounds how long a close frame may take to write, a
+// stalled client must not hold up the shutdown. goAwayWriters close frames
+// are written at once.
+const (
+	closeWriteTimeout = time.Second
+	goAwayWriters     = 64
+)
+
+// goingAwayCloseBody tells the client that the server is going away and
+// when to reconnect, the delay is picked at random within window so that
+// the clients of an instance don't all reconnect at once.
+func goingAwayCloseBody(window time.Duration) []byte {
+	reconnectAfter := rand.N(window)
+	reason := fmt.Sprintf(`{"reconnectAfter":%d}`, reconnectAfter.Milliseconds())
+	return ws.NewCloseFrameBody(ws.StatusGoingAway, reason)
+}
+
+// GoAway sends every client a going away close frame with a reconnect hint
+// and closes its connection. The frames are written outside the lock so
+// that the read goroutines can remove their connections meanwhile, the
+// connections left once ctx is done are closed without one.
+func (manager *WebsocketConnectionsManager) GoAway(ctx context.Context, window time.Duration) {
+	var wg sync.WaitGroup
+	writers := make(chan struct{}, goAwayWriters)
+	for conn := range maps.Values(manager.Connections()) {
+		select {
+		case writers <- struct{}{}:
+		case <-ctx.Done():
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				conn.Close()
+				<-writers
+				wg.Done()
+			}()
+
+			deadline := time.Now().Add(closeWriteTimeout)
+			if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+				deadline = ctxDeadline
+			}
+			conn.SetWriteDeadline(deadline)
+			wsutil.WriteServerMessage(conn, ws.OpClose, goingAwayCloseBody(window))
+		}()
+	}
+	wg.Wait()
+}
+
 func (manager *WebsocketConnectionsManager) Close() {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	_ "github.com/shravanasati/everynyan-notification-service/internal/testenv"
+)
+
+func TestGoAway(t *testing.T) {
+	manager := NewWebsocketConnectionsManager()
+
+	// stalled clients never read, writing to them blocks until the deadline
+	for i := range 3 {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		manager.Add(fmt.Sprint("stalled", i), server)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	manager.Add("reader", server)
+
+	frames := make(chan ws.Frame, 1)
+	go func() {
+		frame, err := ws.ReadFrame(client)
+		if err == nil {
+			frames <- frame
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		manager.GoAway(ctx, 30*time.Second)
+		close(done)
+	}()
+
+	// the read goroutines can still remove their connections
+	removed := make(chan struct{})
+	go func() {
+		manager.Delete("stalled0")
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Delete blocked while GoAway was writing close frames")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(closeWriteTimeout):
+		t.Fatal("GoAway did not return by the shutdown deadline")
+	}
+	if elapsed := time.Since(start); elapsed > closeWriteTimeout {
+		t.Errorf("GoAway took %s, longer than the context allowed", elapsed)
+	}
+
+	select {
+	case frame := <-frames:
+		if frame.Header.OpCode != ws.OpClose {
+			t.Fatalf("opcode = %v, want close", frame.Header.OpCode)
+		}
+		code, reason := ws.ParseCloseFrameData(frame.Payload)
+		if code != ws.StatusGoingAway || !strings.Contains(reason, `"reconnectAfter":`) {
+			t.Errorf("close frame = %d %q", code, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the reading client got no close frame")
+	}
+
+	if _, err := wsutil.ReadServerText(client); err == nil {
+		t.Error("the connection is still open after GoAway")
+	}
+}
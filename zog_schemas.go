@@ -1,24 +1,203 @@
 package main
 
-import z "github.com/Oudwins/zog"
+import (
+	"fmt"
+	"regexp"
+	"time"
 
-var notificationRequestSchema = z.Slice(z.Struct(z.Schema{
+	z "github.com/Oudwins/zog"
+	"github.com/Oudwins/zog/zconst"
+)
+
+// withDisplayFields adds the optional presentation fields of
+// NotificationDisplay to schema.
+func withDisplayFields(schema z.Schema) z.Schema {
+	schema["icon"] = z.String().Default(defaultIcon)
+	schema["image"] = z.String().Default(defaultImage)
+	schema["badge"] = z.String().Default(defaultBadge)
+	schema["tag"] = z.String().Optional()
+	schema["actions"] = z.Slice(z.Struct(z.Schema{
+		"action": z.String().Required(z.Message("action is required")).Min(1, z.Message("action cannot be empty")),
+		"title":  z.String().Required(z.Message("action title is required")).Min(1, z.Message("action title cannot be empty")),
+		"icon":   z.String().Optional(),
+		"URL":    z.String().Optional(),
+	})).Optional()
+	schema["renotify"] = z.Bool().Optional()
+	schema["silent"] = z.Bool().Optional()
+	schema["requireInteraction"] = z.Bool().Optional()
+	return schema
+}
+
+// renotifyNeedsTag mirrors the Notifications API, which rejects renotify
+// without a tag.
+var renotifyNeedsTag = z.TestFunc(zconst.ErrCodeCustom, func(val any, ctx z.ParseCtx) bool {
+	var display NotificationDisplay
+	switch v := val.(type) {
+	case *NotificationRequest:
+		display = v.NotificationDisplay
+	case *BroadcastRequest:
+		display = v.NotificationDisplay
+	}
+	return !display.Renotify || display.Tag != ""
+})
+
+var notificationRequestSchema = z.Slice(z.Struct(withDisplayFields(z.Schema{
 	"user":        z.String().Required(z.Message("users array is required")).Min(1, z.Message("user cannot be empty")),
-	"title":       z.String().Required(z.Message("title is required")).Min(1, z.Message("title cannot be empty")),
-	"description": z.String().Required(z.Message("description is required")).Min(1, z.Message("description cannot be empty")),
-	"link":        z.String().Required(z.Message("link is required")).Min(1, z.Message("link cannot be empty")),
-}))
+	"title":       z.String().Optional(),
+	"description": z.String().Optional(),
+	"link":        z.String().Optional(),
+	"priority":    z.String().Default(PriorityNormal).OneOf(priorities, z.Message("priority must be one of low, normal, high or critical")),
+	"template":    z.String().Optional(),
+})).Test(renotifyNeedsTag, z.Message("renotify requires a tag")).Test(z.TestFunc(zconst.ErrCodeCustom, func(val any, ctx z.ParseCtx) bool {
+	// title, description and link come from the template when one is named
+	notif, ok := val.(*NotificationRequest)
+	if !ok {
+		return false
+	}
+	return notif.Template != "" || (notif.Title != "" && notif.Description != "" && notif.Link != "")
+}), z.Message("title, description and link are required unless a template is used")))
+
+// parseTemplateVariables reads the optional "variables" object of every
+// notification request, zog has no schema for arbitrary maps.
+func parseTemplateVariables(reqMaps []map[string]any, notifs []NotificationRequest) error {
+	for i, reqMap := range reqMaps {
+		raw, ok := reqMap["variables"]
+		if !ok || raw == nil {
+			continue
+		}
 
-var broadcastRequestSchema = z.Struct(z.Schema{
+		varsMap, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("variables must be an object")
+		}
+
+		vars := make(map[string]string, len(varsMap))
+		for k, v := range varsMap {
+			switch v.(type) {
+			case string, float64, bool:
+				vars[k] = fmt.Sprint(v)
+			default:
+				return fmt.Errorf("variable %s must be a string, number or boolean", k)
+			}
+		}
+		notifs[i].Variables = vars
+	}
+
+	return nil
+}
+
+// withAudienceCriteria adds the criteria of an audience to schema.
+func withAudienceCriteria(schema z.Schema) z.Schema {
+	schema["users"] = z.Slice(z.String().Required(z.Message("user cannot be empty"))).Max(maxAudienceUsers, z.Message(fmt.Sprintf("an audience can list at most %d users", maxAudienceUsers)))
+	schema["topics"] = z.Slice(z.String().Required(z.Message("topic cannot be empty")))
+	schema["roles"] = z.Slice(z.String().Required(z.Message("role cannot be empty")))
+	schema["online"] = z.Bool()
+	schema["push"] = z.Bool()
+	return schema
+}
+
+// audienceSchema accepts a single level of inverse, the inverse of an
+// audience can't have an inverse of its own
+var audienceSchema = z.Ptr(z.Struct(withAudienceCriteria(z.Schema{
+	"not": z.Ptr(z.Struct(withAudienceCriteria(z.Schema{}))),
+})))
+
+var audienceRequestSchema = z.Struct(z.Schema{
+	"audience": audienceSchema,
+})
+
+var broadcastRequestSchema = z.Struct(withDisplayFields(z.Schema{
+	"audience":    audienceSchema,
 	"title":       z.String().Required(z.Message("title is required")).Min(1, z.Message("title cannot be empty")),
 	"description": z.String().Required(z.Message("description is required")).Min(1, z.Message("description cannot be empty")),
 	"link":        z.String().Required(z.Message("link is required")).Min(1, z.Message("link cannot be empty")),
-})
+	"priority":    z.String().Default(PriorityNormal).OneOf(priorities, z.Message("priority must be one of low, normal, high or critical")),
+})).Test(renotifyNeedsTag, z.Message("renotify requires a tag"))
 
+// pushSubscriptionSchema accepts a browser PushSubscription, or a device
+// token for the FCM and APNs providers
 var pushSubscriptionSchema = z.Struct(z.Schema{
-	"endpoint": z.String().Required(z.Message("endpoint URL is required")),
+	"provider":       z.String().Default(ProviderWebPush).OneOf(providerNames, z.Message("provider must be one of webpush, fcm or apns")),
+	"VAPIDPublicKey": z.String().Optional(),
+	"endpoint":       z.String().Optional(),
 	"keys": z.Struct(z.Schema{
 		"auth":   z.String().Required(z.Message("auth key is required")),
 		"p256dh": z.String().Required(z.Message("p256dh key is required")),
 	}),
+	"deviceToken": z.String().Optional(),
+}).Test(z.TestFunc(zconst.ErrCodeCustom, func(val any, ctx z.ParseCtx) bool {
+	sub, ok := val.(*StoredSubscription)
+	if !ok || sub.Provider != ProviderWebPush {
+		return true
+	}
+	return sub.Endpoint != "" && sub.Keys.Auth != "" && sub.Keys.P256dh != ""
+}), z.Message("endpoint URL and keys are required for web push")).Test(z.TestFunc(zconst.ErrCodeCustom, func(val any, ctx z.ParseCtx) bool {
+	sub, ok := val.(*StoredSubscription)
+	if !ok || sub.Provider == ProviderWebPush {
+		return true
+	}
+	return sub.DeviceToken != ""
+}), z.Message("deviceToken is required for fcm and apns"))
+
+var webhookSchema = z.Struct(z.Schema{
+	"URL":    z.String().Required(z.Message("url is required")).URL(z.Message("url must be a valid URL")),
+	"secret": z.String().Optional(),
+	"events": z.Slice(z.String().OneOf(eventTypes, z.Message("unknown event type"))).Required(z.Message("events are required")).Min(1, z.Message("events cannot be empty")),
+})
+
+var presenceRequestSchema = z.Struct(z.Schema{
+	"users": z.Slice(z.String().Required(z.Message("user cannot be empty"))).Required(z.Message("users array is required")).Min(1, z.Message("users array cannot be empty")).Max(maxPresenceLookup, z.Message(fmt.Sprintf("at most %d users can be looked up at once", maxPresenceLookup))),
+})
+
+var clockRegex = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+var preferencesSchema = z.Struct(z.Schema{
+	"locale": z.String().Optional(),
+	"quietHours": z.Ptr(z.Struct(z.Schema{
+		"timezone": z.String().Required(z.Message("timezone is required")).Test(z.TestFunc(zconst.ErrCodeCustom, func(val any, ctx z.ParseCtx) bool {
+			_, err := time.LoadLocation(val.(string))
+			return err == nil
+		}), z.Message("timezone must be a valid IANA timezone")),
+		"start": z.String().Required(z.Message("start is required")).Match(clockRegex, z.Message("start must be in HH:MM format")),
+		"end":   z.String().Required(z.Message("end is required")).Match(clockRegex, z.Message("end must be in HH:MM format")),
+	})),
+	"email": z.Ptr(z.Struct(z.Schema{
+		"address": z.String().Required(z.Message("email address is required")).Email(z.Message("email address is invalid")),
+		"enabled": z.Bool(),
+	})),
+	"topics": z.Slice(z.String().Required(z.Message("topic cannot be empty"))).Max(maxTopics, z.Message(fmt.Sprintf("at most %d topics can be followed", maxTopics))),
 })
+
+var templateVariantSchema = z.Struct(z.Schema{
+	"title":       z.String().Required(z.Message("title is required")).Min(1, z.Message("title cannot be empty")),
+	"description": z.String().Required(z.Message("description is required")).Min(1, z.Message("description cannot be empty")),
+	"link":        z.String().Optional(),
+	"icon":        z.String().Optional(),
+	"image":       z.String().Optional(),
+})
+
+var templateSchema = z.Struct(z.Schema{
+	"defaultLocale": z.String().Required(z.Message("defaultLocale is required")).Min(1, z.Message("defaultLocale cannot be empty")),
+})
+
+// parseTemplate validates a template request body, the locales object is
+// parsed variant by variant since zog has no schema for arbitrary maps.
+func parseTemplate(reqMap map[string]any, tmpl *NotificationTemplate) map[string][]z.ZogError {
+	errs := templateSchema.Parse(reqMap, tmpl)
+	if errs != nil {
+		return errs
+	}
+
+	locales, _ := reqMap["locales"].(map[string]any)
+	tmpl.Locales = make(map[string]TemplateVariant, len(locales))
+	for locale, raw := range locales {
+		var variant TemplateVariant
+		errs := templateVariantSchema.Parse(raw, &variant)
+		if errs != nil {
+			return errs
+		}
+		tmpl.Locales[locale] = variant
+	}
+
+	return nil
+}